@@ -0,0 +1,475 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"slices"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/imax1000/ldap-import/ldif"
+	"github.com/imax1000/ldap-import/loader"
+	"github.com/imax1000/ldap-import/orgtree"
+)
+
+// Exit codes of the command-line mode
+const (
+	exitOK       = 0
+	exitError    = 1
+	exitUsage    = 2
+	exitPartial  = 3
+	exitCanceled = 130
+)
+
+const cliUsage = `Usage: ldap-import <command> [options]
+
+Without a command the main window is opened.
+
+Commands:
+  load      load entries from an LDIF file into an OU
+  tree      print the organizational structure of an LDIF file
+  export    write the entries of an OU to LDIF
+  list-ous  list the OUs under the address book
+
+Run "ldap-import <command> -h" for the options of a command.
+The bind password is read from $LDAP_IMPORT_PASSWORD, or from the file
+descriptor in $LDAP_IMPORT_PASSWORD_FD.
+`
+
+// runCLI runs a command given on the command line and returns the exit
+// code. It never touches GTK, so that it works without a display.
+func runCLI(args []string) int {
+	commands := map[string]func(context.Context, []string) int{
+		"load":     cliLoad,
+		"tree":     cliTree,
+		"export":   cliExport,
+		"list-ous": cliListOUs,
+	}
+
+	switch args[0] {
+	case "help", "-h", "-help", "--help":
+		fmt.Print(cliUsage)
+		return exitOK
+	}
+
+	command, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "ldap-import: unknown command %q\n\n%s", args[0], cliUsage)
+		return exitUsage
+	}
+	ctx, stop := withInterrupt()
+	defer stop()
+	return command(ctx, args[1:])
+}
+
+// withInterrupt returns a context that is canceled by the first SIGINT or
+// SIGTERM. A second one exits straight away.
+func withInterrupt() (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		for range signals {
+			if ctx.Err() != nil {
+				os.Exit(exitCanceled)
+			}
+			cancel()
+			fmt.Fprintln(os.Stderr, "Canceling, interrupt again to exit immediately...")
+		}
+	}()
+
+	return ctx, func() {
+		signal.Stop(signals)
+		close(signals)
+		cancel()
+	}
+}
+
+// fail reports err from the named command and returns the exit code for it
+func fail(ctx context.Context, name string, err error) int {
+	fmt.Fprintf(os.Stderr, "ldap-import %s: %v\n", name, err)
+	if ctx.Err() != nil {
+		return exitCanceled
+	}
+	return exitError
+}
+
+// connectionFlags are the options every command that talks to the server
+// takes. Settings given explicitly override those from the profile.
+type connectionFlags struct {
+	profile string
+	config  loader.Config
+	ou      string
+}
+
+func addConnectionFlags(fs *flag.FlagSet) *connectionFlags {
+	cf := &connectionFlags{}
+	c := &cf.config
+	fs.StringVar(&cf.profile, "profile", "", "saved connection profile to use")
+	fs.StringVar(&c.Host, "host", "localhost", "host or ldap://, ldaps:// or ldapi:// URL of the server")
+	fs.StringVar(&c.Port, "port", "", "port of the server (default 389, or 636 with ldaps)")
+	fs.StringVar(&c.BindMechanism, "bind-mech", loader.BindSimple, "bind mechanism: simple, anonymous, external, ntlm or digest-md5")
+	fs.StringVar(&c.BindDN, "bind-dn", "", "DN or user to bind as")
+	fs.StringVar(&c.BaseDN, "base-dn", "", "base DN of the directory")
+	fs.StringVar(&c.AbookOU, "abook-ou", loader.DefaultAbookOU, "OU of the address book under the base DN")
+	fs.StringVar(&c.Security, "security", loader.SecurityPlain, "connection security: plain, starttls or ldaps")
+	fs.StringVar(&c.CAFile, "ca-file", "", "PEM file with the CA certificates to trust")
+	fs.StringVar(&c.CertFile, "cert", "", "PEM file with the client certificate")
+	fs.StringVar(&c.KeyFile, "key", "", "PEM file with the client key")
+	fs.StringVar(&c.MinTLSVersion, "min-tls", "", "minimum TLS version: 1.0, 1.1, 1.2 or 1.3")
+	fs.BoolVar(&c.InsecureSkipVerify, "insecure", false, "do not verify the server certificate")
+	fs.DurationVar(&c.ConnectTimeout, "connect-timeout", loader.DefaultConnectTimeout, "connect timeout, 0 for none")
+	fs.DurationVar(&c.RequestTimeout, "request-timeout", loader.DefaultRequestTimeout, "request timeout, 0 for none")
+	fs.IntVar(&c.Retries, "retries", loader.DefaultRetries, "retries of operations that failed transiently")
+	fs.IntVar(&c.PageSize, "page-size", loader.DefaultPageSize, "entries per page when reading, 0 to turn paging off")
+	fs.IntVar(&c.Workers, "workers", loader.DefaultWorkers, "operations in flight at once")
+	fs.IntVar(&c.Connections, "connections", loader.DefaultConnections, "connections to spread the operations over")
+	fs.IntVar(&c.RateLimit, "rate", 0, "maximum operations per second, 0 for no limit")
+	fs.StringVar(&cf.ou, "ou", "", "target OU (default the profile's target OU)")
+	return cf
+}
+
+// resolve returns the configuration to connect with and the target OU,
+// applying the profile under the flags that were set explicitly. It warns
+// on standard error when certificate verification is off, whether the
+// flag or the profile turned it off.
+func (cf *connectionFlags) resolve(fs *flag.FlagSet) (loader.Config, string, error) {
+	cfg := cf.config
+	targetOU := cf.ou
+
+	if cf.profile != "" {
+		profiles, err := loadProfiles()
+		if err != nil {
+			return cfg, "", fmt.Errorf("failed to load profiles: %v", err)
+		}
+		i := findProfile(profiles, cf.profile)
+		if i < 0 {
+			return cfg, "", fmt.Errorf("no profile named %q", cf.profile)
+		}
+		profiles[i].Apply(&cfg)
+		if targetOU == "" {
+			targetOU = profiles[i].TargetOU
+		}
+
+		// Flags on the command line win over the profile
+		fs.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "host":
+				cfg.Host = cf.config.Host
+			case "port":
+				cfg.Port = cf.config.Port
+			case "bind-mech":
+				cfg.BindMechanism = cf.config.BindMechanism
+			case "bind-dn":
+				cfg.BindDN = cf.config.BindDN
+			case "base-dn":
+				cfg.BaseDN = cf.config.BaseDN
+			case "abook-ou":
+				cfg.AbookOU = cf.config.AbookOU
+			case "security":
+				cfg.Security = cf.config.Security
+			case "ca-file":
+				cfg.CAFile = cf.config.CAFile
+			case "cert":
+				cfg.CertFile = cf.config.CertFile
+			case "key":
+				cfg.KeyFile = cf.config.KeyFile
+			case "min-tls":
+				cfg.MinTLSVersion = cf.config.MinTLSVersion
+			case "insecure":
+				cfg.InsecureSkipVerify = cf.config.InsecureSkipVerify
+			}
+		})
+	}
+
+	if cfg.BindMechanism == "" {
+		cfg.BindMechanism = loader.BindSimple
+	}
+	if cfg.Security == "" {
+		cfg.Security = loader.SecurityPlain
+	}
+	if cfg.Port == "" {
+		cfg.Port = "389"
+		if cfg.Security == loader.SecurityLDAPS {
+			cfg.Port = "636"
+		}
+	}
+
+	if cfg.BindMechanism != loader.BindAnonymous && cfg.BindMechanism != loader.BindExternal {
+		password, ok, err := passwordFromEnvironment()
+		if err != nil {
+			return cfg, "", fmt.Errorf("failed to read password: %v", err)
+		}
+		if !ok {
+			return cfg, "", fmt.Errorf("no bind password; set %s or %s", passwordEnv, passwordFdEnv)
+		}
+		cfg.Password = password
+	}
+
+	if cfg.InsecureSkipVerify {
+		fmt.Fprintln(os.Stderr, "warning: the server certificate is not verified; anyone able to intercept "+
+			"the connection can pose as the server and read the bind password")
+	}
+
+	return cfg, targetOU, nil
+}
+
+// parseFlags parses args and reports whether the command should go on. On
+// failure code is the exit code to return.
+func parseFlags(fs *flag.FlagSet, args []string) (code int, ok bool) {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK, false
+		}
+		return exitUsage, false
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "ldap-import %s: unexpected argument %q\n", fs.Name(), fs.Arg(0))
+		return exitUsage, false
+	}
+	return exitOK, true
+}
+
+func cliLoad(ctx context.Context, args []string) int {
+	fs := flag.NewFlagSet("load", flag.ContinueOnError)
+	cf := addConnectionFlags(fs)
+	filename := fs.String("file", "", "LDIF file to load (required)")
+	mode := fs.String("mode", loader.ModeReplace, "load mode: replace or sync")
+	key := fs.String("sync-key", loader.SyncKeys[0], "attribute that matches entries in sync mode: "+strings.Join(loader.SyncKeys, ", "))
+	onError := fs.String("on-error", loader.OnErrorStop, "what to do when the server rejects an entry: stop, rollback or continue")
+	namingSpec := fs.String("naming", loader.NamingPresets[0], "naming rule for the RDN of new entries")
+	reportFile := fs.String("error-report", "", "write the rejected entries as CSV to this file")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+
+	if *filename == "" {
+		fmt.Fprintln(os.Stderr, "ldap-import load: -file is required")
+		return exitUsage
+	}
+	if *mode != loader.ModeReplace && *mode != loader.ModeSync {
+		fmt.Fprintf(os.Stderr, "ldap-import load: unknown mode %q\n", *mode)
+		return exitUsage
+	}
+	if *mode == loader.ModeSync && !slices.Contains(loader.SyncKeys, *key) {
+		fmt.Fprintf(os.Stderr, "ldap-import load: unknown sync key %q\n", *key)
+		return exitUsage
+	}
+	if *onError != loader.OnErrorStop && *onError != loader.OnErrorRollback && *onError != loader.OnErrorContinue {
+		fmt.Fprintf(os.Stderr, "ldap-import load: unknown -on-error value %q\n", *onError)
+		return exitUsage
+	}
+	naming, err := loader.ParseNamingRule(*namingSpec)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ldap-import load:", err)
+		return exitUsage
+	}
+
+	cfg, targetOU, err := cf.resolve(fs)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ldap-import load:", err)
+		return exitError
+	}
+	if targetOU == "" {
+		fmt.Fprintln(os.Stderr, "ldap-import load: -ou is required")
+		return exitUsage
+	}
+
+	entries, warnings, err := ldif.ReadFile(ctx, *filename)
+	if err != nil {
+		return fail(ctx, "load", err)
+	}
+	for _, warning := range warnings {
+		fmt.Fprintln(os.Stderr, "warning:", warning)
+	}
+	if len(entries) == 0 {
+		fmt.Fprintln(os.Stderr, "ldap-import load: no entries in", *filename)
+		return exitError
+	}
+
+	session := loader.NewSession(cfg)
+	session.OnRetry = printRetry
+	defer session.Close()
+
+	opts := loader.Options{TargetOU: targetOU, Mode: *mode, Key: *key, OnError: *onError, Naming: naming}
+	progress := &stderrProgress{}
+	result, err := loader.Load(ctx, session, opts, entries, progress.Report)
+	if result.BackupFile != "" {
+		fmt.Fprintln(os.Stderr, "Backup saved to", result.BackupFile)
+	}
+	if err != nil {
+		return fail(ctx, "load", err)
+	}
+
+	if len(result.Failed) > 0 {
+		for _, e := range result.Failed {
+			fmt.Fprintln(os.Stderr, e.Error())
+		}
+		fmt.Fprintf(os.Stderr, "%d of %d changes failed\n", len(result.Failed), result.Total)
+		if *reportFile != "" {
+			if err := writeErrorReportFile(*reportFile, result.Failed); err != nil {
+				fmt.Fprintln(os.Stderr, "ldap-import load:", err)
+			}
+		}
+		return exitPartial
+	}
+
+	fmt.Fprintf(os.Stderr, "Loaded %d entries into %s\n", len(entries), targetOU)
+	return exitOK
+}
+
+// writeErrorReportFile writes the CSV error report to filename
+func writeErrorReportFile(filename string, failed []loader.EntryError) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("failed to write error report: %v", err)
+	}
+	if err := loader.WriteErrorReportCSV(file, failed); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write error report: %v", err)
+	}
+	return file.Close()
+}
+
+func cliTree(ctx context.Context, args []string) int {
+	fs := flag.NewFlagSet("tree", flag.ContinueOnError)
+	filename := fs.String("file", "", "LDIF file to read (required)")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	if *filename == "" {
+		fmt.Fprintln(os.Stderr, "ldap-import tree: -file is required")
+		return exitUsage
+	}
+
+	entries, warnings, err := ldif.ReadFile(ctx, *filename)
+	if err != nil {
+		return fail(ctx, "tree", err)
+	}
+	for _, warning := range warnings {
+		fmt.Fprintln(os.Stderr, "warning:", warning)
+	}
+
+	orgtree.Print(os.Stdout, orgtree.Build(entries))
+	return exitOK
+}
+
+func cliExport(ctx context.Context, args []string) int {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	cf := addConnectionFlags(fs)
+	out := fs.String("out", "", "file to write to (default standard output)")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+
+	cfg, targetOU, err := cf.resolve(fs)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ldap-import export:", err)
+		return exitError
+	}
+	if targetOU == "" {
+		fmt.Fprintln(os.Stderr, "ldap-import export: -ou is required")
+		return exitUsage
+	}
+	ouDN, err := loader.TargetOUDN(cfg, targetOU)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ldap-import export:", err)
+		return exitError
+	}
+
+	session := loader.NewSession(cfg)
+	session.OnRetry = printRetry
+	defer session.Close()
+
+	entries, err := loader.SearchSubtree(ctx, session, ouDN)
+	if err != nil {
+		return fail(ctx, "export", err)
+	}
+
+	w := io.Writer(os.Stdout)
+	if *out != "" {
+		file, err := os.Create(*out)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "ldap-import export:", err)
+			return exitError
+		}
+		defer file.Close()
+		w = file
+	}
+
+	writer := ldif.NewWriter(w)
+	for _, entry := range entries {
+		if err := writer.WriteEntry(entry.DN, entry.Attributes); err != nil {
+			fmt.Fprintln(os.Stderr, "ldap-import export:", err)
+			return exitError
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		fmt.Fprintln(os.Stderr, "ldap-import export:", err)
+		return exitError
+	}
+
+	fmt.Fprintf(os.Stderr, "Exported %d entries from %s\n", len(entries), ouDN)
+	return exitOK
+}
+
+func cliListOUs(ctx context.Context, args []string) int {
+	fs := flag.NewFlagSet("list-ous", flag.ContinueOnError)
+	cf := addConnectionFlags(fs)
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+
+	cfg, _, err := cf.resolve(fs)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ldap-import list-ous:", err)
+		return exitError
+	}
+
+	session := loader.NewSession(cfg)
+	session.OnRetry = printRetry
+	defer session.Close()
+
+	ous, err := loader.ListOUs(ctx, session)
+	if err != nil {
+		return fail(ctx, "list-ous", err)
+	}
+	sort.Strings(ous)
+	for _, ou := range ous {
+		fmt.Println(ou)
+	}
+	return exitOK
+}
+
+// stderrProgress prints progress reports on standard error, at most one
+// line every progressInterval while a stage is under way
+type stderrProgress struct {
+	last time.Time
+}
+
+const progressInterval = time.Second
+
+// Report prints a progress report from the loader
+func (p *stderrProgress) Report(progress loader.Progress) {
+	if progress.Total == 0 {
+		fmt.Fprintln(os.Stderr, progress)
+		return
+	}
+	if progress.Done < progress.Total && time.Since(p.last) < progressInterval {
+		return
+	}
+	p.last = time.Now()
+	fmt.Fprintf(os.Stderr, "%3.0f%% %s\n", progress.Fraction()*100, progress)
+}
+
+// printRetry tells the user that an operation failed and is tried again
+func printRetry(attempt, retries int, delay time.Duration, err error) {
+	fmt.Fprintf(os.Stderr, "%v\nRetrying in %s (attempt %d of %d)...\n", err, delay, attempt, retries)
+}
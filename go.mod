@@ -3,14 +3,14 @@ module github.com/imax1000/ldap-import
 go 1.24.2
 
 require (
+	github.com/gen2brain/iup-go/iup v0.0.0-20241106050025-0f971ac33ed4
+	github.com/go-asn1-ber/asn1-ber v1.5.8-0.20250403174932-29230038a667
 	github.com/go-ldap/ldap/v3 v3.4.11
 	github.com/gotk3/gotk3 v0.6.1
+	golang.org/x/crypto v0.36.0
 )
 
 require (
 	github.com/Azure/go-ntlmssp v0.0.0-20221128193559-754e69321358 // indirect
-	github.com/gen2brain/iup-go/iup v0.0.0-20241106050025-0f971ac33ed4 // indirect
-	github.com/go-asn1-ber/asn1-ber v1.5.8-0.20250403174932-29230038a667 // indirect
 	github.com/google/uuid v1.6.0 // indirect
-	golang.org/x/crypto v0.36.0 // indirect
 )
@@ -0,0 +1,103 @@
+package ldif
+
+import "strings"
+
+// canonicalAttributes maps lowercased attribute names, aliases and OIDs to
+// the spelling sent to the server. It covers person, organizationalPerson
+// and inetOrgPerson plus the handful of operational names we read back.
+var canonicalAttributes = map[string]string{
+	"objectclass":                "objectClass",
+	"2.5.4.0":                    "objectClass",
+	"cn":                         "cn",
+	"commonname":                 "cn",
+	"2.5.4.3":                    "cn",
+	"sn":                         "sn",
+	"surname":                    "sn",
+	"2.5.4.4":                    "sn",
+	"givenname":                  "givenName",
+	"gn":                         "givenName",
+	"2.5.4.42":                   "givenName",
+	"initials":                   "initials",
+	"2.5.4.43":                   "initials",
+	"displayname":                "displayName",
+	"title":                      "title",
+	"2.5.4.12":                   "title",
+	"description":                "description",
+	"2.5.4.13":                   "description",
+	"o":                          "o",
+	"organizationname":           "o",
+	"2.5.4.10":                   "o",
+	"ou":                         "ou",
+	"organizationalunitname":     "ou",
+	"2.5.4.11":                   "ou",
+	"l":                          "l",
+	"localityname":               "l",
+	"2.5.4.7":                    "l",
+	"st":                         "st",
+	"stateorprovincename":        "st",
+	"street":                     "street",
+	"streetaddress":              "street",
+	"postaladdress":              "postalAddress",
+	"2.5.4.16":                   "postalAddress",
+	"postalcode":                 "postalCode",
+	"postofficebox":              "postOfficeBox",
+	"physicaldeliveryofficename": "physicalDeliveryOfficeName",
+	"registeredaddress":          "registeredAddress",
+	"mail":                       "mail",
+	"rfc822mailbox":              "mail",
+	"0.9.2342.19200300.100.1.3":  "mail",
+	"telephonenumber":            "telephoneNumber",
+	"2.5.4.20":                   "telephoneNumber",
+	"mobile":                     "mobile",
+	"mobiletelephonenumber":      "mobile",
+	"homephone":                  "homePhone",
+	"hometelephonenumber":        "homePhone",
+	"pager":                      "pager",
+	"pagertelephonenumber":       "pager",
+	"facsimiletelephonenumber":   "facsimileTelephoneNumber",
+	"fax":                        "facsimileTelephoneNumber",
+	"homepostaladdress":          "homePostalAddress",
+	"uid":                        "uid",
+	"userid":                     "uid",
+	"employeenumber":             "employeeNumber",
+	"employeetype":               "employeeType",
+	"departmentnumber":           "departmentNumber",
+	"businesscategory":           "businessCategory",
+	"manager":                    "manager",
+	"secretary":                  "secretary",
+	"roomnumber":                 "roomNumber",
+	"carlicense":                 "carLicense",
+	"preferredlanguage":          "preferredLanguage",
+	"labeleduri":                 "labeledURI",
+	"seealso":                    "seeAlso",
+	"jpegphoto":                  "jpegPhoto",
+	"photo":                      "photo",
+	"audio":                      "audio",
+	"usercertificate":            "userCertificate",
+	"usersmimecertificate":       "userSMIMECertificate",
+	"userpkcs12":                 "userPKCS12",
+	"userpassword":               "userPassword",
+	"x500uniqueidentifier":       "x500UniqueIdentifier",
+	"c":                          "c",
+	"countryname":                "c",
+	"dc":                         "dc",
+	"domaincomponent":            "dc",
+	"entryuuid":                  "entryUUID",
+}
+
+// CanonicalAttributeName returns the canonical spelling of an attribute
+// description, keeping options such as ";lang-ru" or ";binary". known is
+// false if the attribute type is not in canonicalAttributes, in which case
+// the name is returned unchanged.
+func CanonicalAttributeName(name string) (string, bool) {
+	attrType, options, hasOptions := strings.Cut(name, ";")
+
+	canonical, known := canonicalAttributes[strings.ToLower(attrType)]
+	if !known {
+		return name, false
+	}
+	if hasOptions {
+		return canonical + ";" + strings.ToLower(options), true
+	}
+	return canonical, true
+}
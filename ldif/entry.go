@@ -0,0 +1,128 @@
+package ldif
+
+import "strings"
+
+// Attribute holds every value of one attribute, under the name it was
+// first seen with
+type Attribute struct {
+	Name   string
+	Values []string
+}
+
+// AttributeMap is an ordered, case-insensitive attribute -> values map.
+// Attributes keep the order in which they were first added, so entries
+// are written back out the way they were read.
+type AttributeMap struct {
+	attrs []*Attribute
+	index map[string]int
+}
+
+func NewAttributeMap() *AttributeMap {
+	return &AttributeMap{index: make(map[string]int)}
+}
+
+// Add appends values to the attribute, creating it if needed. Values that
+// are already present are skipped, since LDAP rejects duplicates.
+func (m *AttributeMap) Add(name string, values ...string) {
+	i, exists := m.index[strings.ToLower(name)]
+	if !exists {
+		m.attrs = append(m.attrs, &Attribute{Name: name})
+		i = len(m.attrs) - 1
+		m.index[strings.ToLower(name)] = i
+	}
+
+	attr := m.attrs[i]
+	for _, value := range values {
+		if !containsString(attr.Values, value) {
+			attr.Values = append(attr.Values, value)
+		}
+	}
+}
+
+// Set replaces all values of the attribute; no values removes it
+func (m *AttributeMap) Set(name string, values ...string) {
+	if len(values) == 0 {
+		m.Delete(name)
+		return
+	}
+	if i, exists := m.index[strings.ToLower(name)]; exists {
+		m.attrs[i].Values = nil
+	}
+	m.Add(name, values...)
+}
+
+// Delete removes the attribute and all of its values
+func (m *AttributeMap) Delete(name string) {
+	i, exists := m.index[strings.ToLower(name)]
+	if !exists {
+		return
+	}
+
+	m.attrs = append(m.attrs[:i], m.attrs[i+1:]...)
+	delete(m.index, strings.ToLower(name))
+	for key, j := range m.index {
+		if j > i {
+			m.index[key] = j - 1
+		}
+	}
+}
+
+// Get returns all values of the attribute
+func (m *AttributeMap) Get(name string) []string {
+	if m == nil {
+		return nil
+	}
+	if i, exists := m.index[strings.ToLower(name)]; exists {
+		return m.attrs[i].Values
+	}
+	return nil
+}
+
+// First returns the first value of the attribute, or "" if it is not set
+func (m *AttributeMap) First(name string) string {
+	values := m.Get(name)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+func (m *AttributeMap) Has(name string) bool {
+	return len(m.Get(name)) > 0
+}
+
+// All returns the attributes in insertion order
+func (m *AttributeMap) All() []Attribute {
+	if m == nil {
+		return nil
+	}
+	attrs := make([]Attribute, 0, len(m.attrs))
+	for _, attr := range m.attrs {
+		attrs = append(attrs, Attribute{Name: attr.Name, Values: append([]string(nil), attr.Values...)})
+	}
+	return attrs
+}
+
+func (m *AttributeMap) Len() int {
+	if m == nil {
+		return 0
+	}
+	return len(m.attrs)
+}
+
+func (m *AttributeMap) Clone() *AttributeMap {
+	clone := NewAttributeMap()
+	for _, attr := range m.All() {
+		clone.Add(attr.Name, attr.Values...)
+	}
+	return clone
+}
+
+func containsString(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,82 @@
+package ldif
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Entry is a single directory entry
+type Entry struct {
+	DN         string
+	Attributes *AttributeMap
+}
+
+// ReadFile reads all entries from an LDIF file. Attribute names are
+// normalized against the canonical names; names that are not known are
+// kept as written and reported in the returned warnings. Reading stops
+// with ctx.Err() when ctx is canceled.
+func ReadFile(ctx context.Context, filename string) ([]Entry, []string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open file: %v", err)
+	}
+	defer file.Close()
+
+	var entries []Entry
+	var unknownNames []string
+	unknownLines := make(map[string][]int)
+
+	reader := NewReader(file)
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+
+		record, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("error reading file: %v", err)
+		}
+
+		if record.ChangeType != "" && record.ChangeType != "add" {
+			return nil, nil, fmt.Errorf("line %d: unsupported changetype %q", record.Line, record.ChangeType)
+		}
+
+		currentEntry := Entry{DN: record.DN, Attributes: NewAttributeMap()}
+		for _, attr := range record.Attributes {
+			// Empty values are legal LDIF but no directory syntax accepts them
+			if attr.Value == "" {
+				continue
+			}
+
+			name, known := CanonicalAttributeName(attr.Name)
+			if !known {
+				key := strings.ToLower(name)
+				lines, seen := unknownLines[key]
+				if !seen {
+					unknownNames = append(unknownNames, name)
+				}
+				// One line per entry, however many values it has
+				if !seen || lines[len(lines)-1] != record.Line {
+					unknownLines[key] = append(lines, record.Line)
+				}
+			}
+			currentEntry.Attributes.Add(name, attr.Value)
+		}
+		entries = append(entries, currentEntry)
+	}
+
+	var warnings []string
+	for _, name := range unknownNames {
+		lines := unknownLines[strings.ToLower(name)]
+		warnings = append(warnings, fmt.Sprintf(
+			"unknown attribute %q in %d entries (first at line %d)", name, len(lines), lines[0]))
+	}
+
+	return entries, warnings, nil
+}
@@ -0,0 +1,51 @@
+package ldif
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestReadFileWarnings(t *testing.T) {
+	input := `dn: cn=Alice,dc=example,dc=com
+cn: Alice
+TELEPHONENUMBER: 100
+favouriteDrink: tea
+favouriteDrink: coffee
+description:
+
+dn: cn=Bob,dc=example,dc=com
+commonName: Bob
+FavouriteDrink: water
+`
+	filename := filepath.Join(t.TempDir(), "people.ldif")
+	if err := os.WriteFile(filename, []byte(input), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, warnings, err := ReadFile(context.Background(), filename)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("read %d entries, want 2", len(entries))
+	}
+
+	alice := entries[0].Attributes
+	if got := alice.Get("telephoneNumber"); !slices.Equal(got, []string{"100"}) {
+		t.Errorf("telephoneNumber = %q, want [100]", got)
+	}
+	if alice.Has("description") {
+		t.Errorf("empty description was kept")
+	}
+	if got := entries[1].Attributes.First("cn"); got != "Bob" {
+		t.Errorf("cn = %q, want Bob", got)
+	}
+
+	want := []string{`unknown attribute "favouriteDrink" in 2 entries (first at line 1)`}
+	if !slices.Equal(warnings, want) {
+		t.Errorf("warnings = %q, want %q", warnings, want)
+	}
+}
@@ -0,0 +1,521 @@
+// Package ldif reads and writes RFC 2849 LDIF and holds the entries read
+// from it.
+package ldif
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// AttributeValue is a single attribute description/value pair from an LDIF
+// record. Value is always fully decoded, whether it was written as a plain
+// string, as base64 ("::") or as a URL reference (":<").
+type AttributeValue struct {
+	Name  string
+	Value string
+}
+
+// Modification is one mod-spec of a "changetype: modify" record
+type Modification struct {
+	Op     string // add, delete, replace or increment
+	Name   string
+	Values []string
+}
+
+// Record is a single record read from an LDIF file. ChangeType is empty
+// for plain content records.
+type Record struct {
+	Line          int
+	DN            string
+	Controls      []string
+	ChangeType    string
+	Attributes    []AttributeValue
+	Modifications []Modification
+	NewRDN        string
+	DeleteOldRDN  bool
+	NewSuperior   string
+}
+
+// Error describes a syntax error in an LDIF file
+type Error struct {
+	Line int
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+}
+
+// Reader reads RFC 2849 LDIF records one at a time
+type Reader struct {
+	r       *bufio.Reader
+	line    int
+	peeked  *string
+	eof     bool
+	started bool
+	Version int
+}
+
+// ldifLine is a logical (unfolded) LDIF line
+type ldifLine struct {
+	text string
+	num  int
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReader(r)}
+}
+
+// readPhysical returns the next physical line without its line terminator
+func (lr *Reader) readPhysical() (string, bool, error) {
+	if lr.peeked != nil {
+		s := *lr.peeked
+		lr.peeked = nil
+		lr.line++
+		return s, true, nil
+	}
+	if lr.eof {
+		return "", false, nil
+	}
+	s, err := lr.r.ReadString('\n')
+	if err != nil {
+		if err != io.EOF {
+			return "", false, err
+		}
+		lr.eof = true
+		if s == "" {
+			return "", false, nil
+		}
+	}
+	s = strings.TrimSuffix(s, "\n")
+	s = strings.TrimSuffix(s, "\r")
+	lr.line++
+	return s, true, nil
+}
+
+func (lr *Reader) unread(s string) {
+	lr.peeked = &s
+	lr.line--
+}
+
+// readLogical returns the next logical line with folded continuation lines
+// joined. An empty text means a record separator; ok is false at EOF.
+func (lr *Reader) readLogical() (ldifLine, bool, error) {
+	for {
+		s, ok, err := lr.readPhysical()
+		if err != nil || !ok {
+			return ldifLine{}, false, err
+		}
+		start := lr.line
+
+		if strings.TrimSpace(s) == "" {
+			return ldifLine{num: start}, true, nil
+		}
+		if strings.HasPrefix(s, " ") {
+			return ldifLine{}, false, &Error{Line: start, Msg: "continuation line without a preceding line"}
+		}
+
+		var b strings.Builder
+		b.WriteString(s)
+		for {
+			next, ok, err := lr.readPhysical()
+			if err != nil {
+				return ldifLine{}, false, err
+			}
+			if !ok {
+				break
+			}
+			if !strings.HasPrefix(next, " ") {
+				lr.unread(next)
+				break
+			}
+			b.WriteString(next[1:])
+		}
+
+		// Comments may be folded too, so they are dropped only after unfolding
+		if strings.HasPrefix(s, "#") {
+			continue
+		}
+		return ldifLine{text: b.String(), num: start}, true, nil
+	}
+}
+
+// Next returns the next record, or io.EOF when the input is exhausted
+func (lr *Reader) Next() (*Record, error) {
+	var lines []ldifLine
+	for {
+		l, ok, err := lr.readLogical()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+		if l.text == "" {
+			if len(lines) > 0 {
+				break
+			}
+			continue
+		}
+		lines = append(lines, l)
+	}
+	if len(lines) == 0 {
+		return nil, io.EOF
+	}
+
+	if !lr.started {
+		lr.started = true
+		name, value, err := parseLine(lines[0])
+		if err != nil {
+			return nil, err
+		}
+		if strings.EqualFold(name, "version") {
+			if value != "1" {
+				return nil, &Error{Line: lines[0].num, Msg: fmt.Sprintf("unsupported LDIF version %q", value)}
+			}
+			lr.Version = 1
+			lines = lines[1:]
+			if len(lines) == 0 {
+				return lr.Next()
+			}
+		}
+	}
+
+	return parseRecord(lines)
+}
+
+func parseRecord(lines []ldifLine) (*Record, error) {
+	name, value, err := parseLine(lines[0])
+	if err != nil {
+		return nil, err
+	}
+	if !strings.EqualFold(name, "dn") {
+		return nil, &Error{Line: lines[0].num, Msg: fmt.Sprintf("record must start with \"dn:\", got %q", name)}
+	}
+	if value != "" {
+		if _, err := ldap.ParseDN(value); err != nil {
+			return nil, &Error{Line: lines[0].num, Msg: fmt.Sprintf("invalid DN %q: %v", value, err)}
+		}
+	}
+
+	rec := &Record{Line: lines[0].num, DN: value}
+	rest := lines[1:]
+
+	for len(rest) > 0 {
+		name, value, err := parseLine(rest[0])
+		if err != nil {
+			return nil, err
+		}
+		if !strings.EqualFold(name, "control") {
+			break
+		}
+		rec.Controls = append(rec.Controls, value)
+		rest = rest[1:]
+	}
+
+	if len(rest) > 0 {
+		name, value, err := parseLine(rest[0])
+		if err != nil {
+			return nil, err
+		}
+		if strings.EqualFold(name, "changetype") {
+			rec.ChangeType = strings.ToLower(value)
+			rest = rest[1:]
+		}
+	}
+
+	switch rec.ChangeType {
+	case "", "add":
+		for _, l := range rest {
+			name, value, err := parseLine(l)
+			if err != nil {
+				return nil, err
+			}
+			rec.Attributes = append(rec.Attributes, AttributeValue{Name: name, Value: value})
+		}
+	case "delete":
+		if len(rest) > 0 {
+			return nil, &Error{Line: rest[0].num, Msg: "unexpected line in delete record"}
+		}
+	case "modrdn", "moddn":
+		if err := parseModRDN(rec, rest); err != nil {
+			return nil, err
+		}
+	case "modify":
+		if err := parseModify(rec, rest); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, &Error{Line: rec.Line, Msg: fmt.Sprintf("unknown changetype %q", rec.ChangeType)}
+	}
+
+	return rec, nil
+}
+
+func parseModRDN(rec *Record, lines []ldifLine) error {
+	haveRDN, haveDelete := false, false
+	for _, l := range lines {
+		name, value, err := parseLine(l)
+		if err != nil {
+			return err
+		}
+		switch strings.ToLower(name) {
+		case "newrdn":
+			rec.NewRDN = value
+			haveRDN = true
+		case "deleteoldrdn":
+			switch value {
+			case "0":
+				rec.DeleteOldRDN = false
+			case "1":
+				rec.DeleteOldRDN = true
+			default:
+				return &Error{Line: l.num, Msg: fmt.Sprintf("deleteoldrdn must be 0 or 1, got %q", value)}
+			}
+			haveDelete = true
+		case "newsuperior":
+			rec.NewSuperior = value
+		default:
+			return &Error{Line: l.num, Msg: fmt.Sprintf("unexpected %q in modrdn record", name)}
+		}
+	}
+	if !haveRDN || !haveDelete {
+		return &Error{Line: rec.Line, Msg: "modrdn record requires newrdn and deleteoldrdn"}
+	}
+	return nil
+}
+
+func parseModify(rec *Record, lines []ldifLine) error {
+	var current *Modification
+	for _, l := range lines {
+		if l.text == "-" {
+			if current == nil {
+				return &Error{Line: l.num, Msg: "\"-\" without a preceding mod-spec"}
+			}
+			rec.Modifications = append(rec.Modifications, *current)
+			current = nil
+			continue
+		}
+
+		name, value, err := parseLine(l)
+		if err != nil {
+			return err
+		}
+		if current == nil {
+			op := strings.ToLower(name)
+			switch op {
+			case "add", "delete", "replace", "increment":
+			default:
+				return &Error{Line: l.num, Msg: fmt.Sprintf("unknown modify operation %q", name)}
+			}
+			current = &Modification{Op: op, Name: value}
+			continue
+		}
+		if !strings.EqualFold(name, current.Name) {
+			return &Error{Line: l.num, Msg: fmt.Sprintf("attribute %q does not match mod-spec %q", name, current.Name)}
+		}
+		current.Values = append(current.Values, value)
+	}
+	if current != nil {
+		return &Error{Line: lines[len(lines)-1].num, Msg: "mod-spec not terminated with \"-\""}
+	}
+	return nil
+}
+
+// parseLine splits an attrval-spec into its name and decoded value
+func parseLine(l ldifLine) (string, string, error) {
+	i := strings.IndexByte(l.text, ':')
+	if i < 0 {
+		return "", "", &Error{Line: l.num, Msg: fmt.Sprintf("missing ':' in %q", l.text)}
+	}
+
+	name := l.text[:i]
+	if !validAttributeDescription(name) {
+		return "", "", &Error{Line: l.num, Msg: fmt.Sprintf("invalid attribute description %q", name)}
+	}
+
+	rest := l.text[i+1:]
+	switch {
+	case strings.HasPrefix(rest, ":"):
+		data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(rest[1:]))
+		if err != nil {
+			return "", "", &Error{Line: l.num, Msg: fmt.Sprintf("invalid base64 value for %s: %v", name, err)}
+		}
+		return name, string(data), nil
+	case strings.HasPrefix(rest, "<"):
+		data, err := readURL(strings.TrimSpace(rest[1:]))
+		if err != nil {
+			return "", "", &Error{Line: l.num, Msg: fmt.Sprintf("cannot read value for %s: %v", name, err)}
+		}
+		return name, string(data), nil
+	default:
+		return name, strings.TrimLeft(rest, " "), nil
+	}
+}
+
+func readURL(raw string) ([]byte, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "file" {
+		return nil, fmt.Errorf("unsupported URL scheme %q", u.Scheme)
+	}
+	if u.Path == "" {
+		return nil, errors.New("empty file URL")
+	}
+	return os.ReadFile(u.Path)
+}
+
+// validAttributeDescription checks an attribute type (name or OID) with
+// optional ";option" suffixes
+func validAttributeDescription(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, part := range strings.Split(s, ";") {
+		if part == "" {
+			return false
+		}
+		for _, c := range part {
+			switch {
+			case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-':
+			case c == '.' && i == 0:
+			default:
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// foldWidth is the longest line the writer emits, counting the leading
+// space of continuation lines
+const foldWidth = 76
+
+// Writer writes RFC 2849 LDIF records. Values that are not safe
+// strings are base64-encoded and long lines are folded.
+type Writer struct {
+	w            *bufio.Writer
+	wroteVersion bool
+	records      int
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: bufio.NewWriter(w)}
+}
+
+// WriteEntry writes a content record
+func (lw *Writer) WriteEntry(dn string, attrs *AttributeMap) error {
+	lw.startRecord()
+	lw.writeLine("dn", dn)
+	for _, attr := range attrs.All() {
+		for _, value := range attr.Values {
+			lw.writeLine(attr.Name, value)
+		}
+	}
+	return lw.endRecord()
+}
+
+// WriteAdd writes a "changetype: add" record
+func (lw *Writer) WriteAdd(dn string, attrs *AttributeMap) error {
+	lw.startRecord()
+	lw.writeLine("dn", dn)
+	lw.writeLine("changetype", "add")
+	for _, attr := range attrs.All() {
+		for _, value := range attr.Values {
+			lw.writeLine(attr.Name, value)
+		}
+	}
+	return lw.endRecord()
+}
+
+// WriteModify writes a "changetype: modify" record
+func (lw *Writer) WriteModify(dn string, mods []Modification) error {
+	lw.startRecord()
+	lw.writeLine("dn", dn)
+	lw.writeLine("changetype", "modify")
+	for _, mod := range mods {
+		lw.writeLine(mod.Op, mod.Name)
+		for _, value := range mod.Values {
+			lw.writeLine(mod.Name, value)
+		}
+		lw.w.WriteString("-\n")
+	}
+	return lw.endRecord()
+}
+
+// WriteDelete writes a "changetype: delete" record
+func (lw *Writer) WriteDelete(dn string) error {
+	lw.startRecord()
+	lw.writeLine("dn", dn)
+	lw.writeLine("changetype", "delete")
+	return lw.endRecord()
+}
+
+// Flush writes any buffered data to the underlying writer
+func (lw *Writer) Flush() error {
+	return lw.w.Flush()
+}
+
+func (lw *Writer) startRecord() {
+	if !lw.wroteVersion {
+		lw.w.WriteString("version: 1\n\n")
+		lw.wroteVersion = true
+	}
+}
+
+func (lw *Writer) endRecord() error {
+	_, err := lw.w.WriteString("\n")
+	lw.records++
+	return err
+}
+
+func (lw *Writer) writeLine(name, value string) {
+	var line string
+	if isSafeString(value) {
+		line = name + ": " + value
+	} else {
+		line = name + ":: " + base64.StdEncoding.EncodeToString([]byte(value))
+	}
+
+	// Continuation lines start with a space, so they carry one byte less
+	width := foldWidth
+	for len(line) > width {
+		lw.w.WriteString(line[:width])
+		lw.w.WriteString("\n ")
+		line = line[width:]
+		width = foldWidth - 1
+	}
+	lw.w.WriteString(line)
+	lw.w.WriteString("\n")
+}
+
+// isSafeString reports whether value can be written without base64
+func isSafeString(value string) bool {
+	if value == "" {
+		return true
+	}
+	switch value[0] {
+	case ' ', ':', '<':
+		return false
+	}
+	if value[len(value)-1] == ' ' {
+		return false
+	}
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c == 0 || c == '\n' || c == '\r' || c > 0x7f {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,342 @@
+package ldif
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// readAll reads every record from input
+func readAll(input string) ([]*Record, error) {
+	reader := NewReader(strings.NewReader(input))
+	var records []*Record
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return records, err
+		}
+		records = append(records, record)
+	}
+}
+
+func TestReader(t *testing.T) {
+	photo := filepath.Join(t.TempDir(), "photo.jpg")
+	if err := os.WriteFile(photo, []byte("\xff\xd8\xff\xe0"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		input    string
+		wantDN   string
+		wantLine int
+		want     []AttributeValue
+	}{
+		{
+			name:     "plain values",
+			input:    "dn: cn=Alice,dc=example,dc=com\ncn: Alice\nsn: Smith\n",
+			wantDN:   "cn=Alice,dc=example,dc=com",
+			wantLine: 1,
+			want:     []AttributeValue{{"cn", "Alice"}, {"sn", "Smith"}},
+		},
+		{
+			name:     "version header and comments",
+			input:    "# export\nversion: 1\n\n# Alice\ndn: cn=Alice,dc=example,dc=com\ncn: Alice\n",
+			wantDN:   "cn=Alice,dc=example,dc=com",
+			wantLine: 5,
+			want:     []AttributeValue{{"cn", "Alice"}},
+		},
+		{
+			name:     "base64 values",
+			input:    "dn:: Y2490J/RkdGC0YAsZGM9ZXhhbXBsZSxkYz1jb20=\ncn:: 0J/RkdGC0YA=\n",
+			wantDN:   "cn=Пётр,dc=example,dc=com",
+			wantLine: 1,
+			want:     []AttributeValue{{"cn", "Пётр"}},
+		},
+		{
+			name:     "folded lines",
+			input:    "dn: cn=Alice,\n dc=example,dc=com\ndescription: first\n  second\n# a folded\n  comment\ncn: Alice\n",
+			wantDN:   "cn=Alice,dc=example,dc=com",
+			wantLine: 1,
+			want:     []AttributeValue{{"description", "first second"}, {"cn", "Alice"}},
+		},
+		{
+			name:     "folded base64 value",
+			input:    "dn: cn=Petr,dc=example,dc=com\ncn:: 0J/R\n kdGC0YA=\n",
+			wantDN:   "cn=Petr,dc=example,dc=com",
+			wantLine: 1,
+			want:     []AttributeValue{{"cn", "Пётр"}},
+		},
+		{
+			name:     "URL value",
+			input:    "dn: cn=Alice,dc=example,dc=com\njpegPhoto:< file://" + photo + "\n",
+			wantDN:   "cn=Alice,dc=example,dc=com",
+			wantLine: 1,
+			want:     []AttributeValue{{"jpegPhoto", "\xff\xd8\xff\xe0"}},
+		},
+		{
+			name:     "CRLF line endings",
+			input:    "dn: cn=Alice,dc=example,dc=com\r\ncn: Alice\r\n",
+			wantDN:   "cn=Alice,dc=example,dc=com",
+			wantLine: 1,
+			want:     []AttributeValue{{"cn", "Alice"}},
+		},
+		{
+			name:     "attribute options",
+			input:    "dn: cn=Alice,dc=example,dc=com\ncn;lang-en: Alice\n",
+			wantDN:   "cn=Alice,dc=example,dc=com",
+			wantLine: 1,
+			want:     []AttributeValue{{"cn;lang-en", "Alice"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records, err := readAll(tt.input)
+			if err != nil {
+				t.Fatalf("Next() error = %v", err)
+			}
+			if len(records) != 1 {
+				t.Fatalf("read %d records, want 1", len(records))
+			}
+			record := records[0]
+			if record.DN != tt.wantDN {
+				t.Errorf("DN = %q, want %q", record.DN, tt.wantDN)
+			}
+			if record.Line != tt.wantLine {
+				t.Errorf("Line = %d, want %d", record.Line, tt.wantLine)
+			}
+			if !slices.Equal(record.Attributes, tt.want) {
+				t.Errorf("Attributes = %q, want %q", record.Attributes, tt.want)
+			}
+		})
+	}
+}
+
+func TestReaderErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		wantLine int
+		wantMsg  string
+	}{
+		{
+			name:     "missing colon",
+			input:    "dn: cn=Alice,dc=example,dc=com\ncn Alice\n",
+			wantLine: 2,
+			wantMsg:  "missing ':'",
+		},
+		{
+			name:     "record without dn",
+			input:    "dn: cn=Alice,dc=example,dc=com\n\ncn: Bob\n",
+			wantLine: 3,
+			wantMsg:  "must start with \"dn:\"",
+		},
+		{
+			name:     "invalid DN",
+			input:    "dn: cn=Alice,dc=example,dc=com\n\ndn: not a DN\n",
+			wantLine: 3,
+			wantMsg:  "invalid DN",
+		},
+		{
+			name:     "invalid base64",
+			input:    "dn: cn=Alice,dc=example,dc=com\ncn:: not base64!\n",
+			wantLine: 2,
+			wantMsg:  "invalid base64",
+		},
+		{
+			name:     "line number after folded lines",
+			input:    "dn: cn=Alice,\n dc=example,\n dc=com\ndescription: a\n b\nbad line\n",
+			wantLine: 6,
+			wantMsg:  "missing ':'",
+		},
+		{
+			name:     "continuation without a preceding line",
+			input:    "dn: cn=Alice,dc=example,dc=com\n\n cn: Alice\n",
+			wantLine: 3,
+			wantMsg:  "continuation line",
+		},
+		{
+			name:     "unsupported version",
+			input:    "version: 2\n\ndn: cn=Alice,dc=example,dc=com\n",
+			wantLine: 1,
+			wantMsg:  "unsupported LDIF version",
+		},
+		{
+			name:     "invalid attribute description",
+			input:    "dn: cn=Alice,dc=example,dc=com\nc_n: Alice\n",
+			wantLine: 2,
+			wantMsg:  "invalid attribute description",
+		},
+		{
+			name:     "unsupported URL scheme",
+			input:    "dn: cn=Alice,dc=example,dc=com\njpegPhoto:< http://example.com/a.jpg\n",
+			wantLine: 2,
+			wantMsg:  "unsupported URL scheme",
+		},
+		{
+			name:     "unterminated mod-spec",
+			input:    "dn: cn=Alice,dc=example,dc=com\nchangetype: modify\nreplace: sn\nsn: Smith\n",
+			wantLine: 4,
+			wantMsg:  "not terminated",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := readAll(tt.input)
+			var ldifErr *Error
+			if !errors.As(err, &ldifErr) {
+				t.Fatalf("Next() error = %v, want an *Error", err)
+			}
+			if ldifErr.Line != tt.wantLine {
+				t.Errorf("error line = %d, want %d (%v)", ldifErr.Line, tt.wantLine, err)
+			}
+			if !strings.Contains(ldifErr.Msg, tt.wantMsg) {
+				t.Errorf("error = %q, want it to mention %q", ldifErr.Msg, tt.wantMsg)
+			}
+		})
+	}
+}
+
+func TestReaderChangeRecords(t *testing.T) {
+	input := `dn: cn=Alice,dc=example,dc=com
+changetype: modify
+replace: sn
+sn: Smith
+sn: Jones
+-
+delete: mail
+-
+
+dn: cn=Bob,dc=example,dc=com
+changetype: delete
+
+dn: cn=Carol,dc=example,dc=com
+changetype: modrdn
+newrdn: cn=Caroline
+deleteoldrdn: 1
+newsuperior: ou=staff,dc=example,dc=com
+`
+	records, err := readAll(input)
+	if err != nil {
+		t.Fatalf("Next() error = %v", err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("read %d records, want 3", len(records))
+	}
+
+	mods := records[0].Modifications
+	if len(mods) != 2 || mods[0].Op != "replace" || !slices.Equal(mods[0].Values, []string{"Smith", "Jones"}) ||
+		mods[1].Op != "delete" || mods[1].Name != "mail" || len(mods[1].Values) != 0 {
+		t.Errorf("Modifications = %+v", mods)
+	}
+	if records[1].ChangeType != "delete" || records[1].Line != 10 {
+		t.Errorf("second record = %+v, want a delete at line 10", records[1])
+	}
+	if rec := records[2]; rec.NewRDN != "cn=Caroline" || !rec.DeleteOldRDN || rec.NewSuperior != "ou=staff,dc=example,dc=com" {
+		t.Errorf("third record = %+v", rec)
+	}
+}
+
+func TestWriterRoundTrip(t *testing.T) {
+	alice := NewAttributeMap()
+	alice.Add("objectClass", "top", "person")
+	alice.Add("cn", "Alice")
+	alice.Add("description", strings.Repeat("a long description ", 10))
+	alice.Add("jpegPhoto", "\xff\xd8\xff\xe0\x00")
+
+	petr := NewAttributeMap()
+	petr.Add("cn", "Пётр")
+	petr.Add("sn", " leading space")
+	petr.Add("title", "trailing space ")
+	petr.Add("description", ":colon", "<angle", "two\nlines")
+
+	entries := []Entry{
+		{DN: "cn=Alice,dc=example,dc=com", Attributes: alice},
+		{DN: "cn=Пётр,dc=example,dc=com", Attributes: petr},
+	}
+
+	var out strings.Builder
+	writer := NewWriter(&out)
+	for _, entry := range entries {
+		if err := writer.WriteEntry(entry.DN, entry.Attributes); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, line := range strings.Split(out.String(), "\n") {
+		if len(line) > foldWidth {
+			t.Errorf("line %d is %d bytes long, want it folded", i+1, len(line))
+		}
+	}
+
+	reader := NewReader(strings.NewReader(out.String()))
+	for _, entry := range entries {
+		record, err := reader.Next()
+		if err != nil {
+			t.Fatalf("Next() error = %v\n%s", err, out.String())
+		}
+		if record.DN != entry.DN {
+			t.Errorf("DN = %q, want %q", record.DN, entry.DN)
+		}
+
+		var want []AttributeValue
+		for _, attr := range entry.Attributes.All() {
+			for _, value := range attr.Values {
+				want = append(want, AttributeValue{Name: attr.Name, Value: value})
+			}
+		}
+		if !slices.Equal(record.Attributes, want) {
+			t.Errorf("%s: Attributes = %q, want %q", entry.DN, record.Attributes, want)
+		}
+	}
+	if _, err := reader.Next(); err != io.EOF {
+		t.Errorf("Next() after the last record = %v, want io.EOF", err)
+	}
+	if reader.Version != 1 {
+		t.Errorf("Version = %d, want 1", reader.Version)
+	}
+}
+
+func TestWriterFolding(t *testing.T) {
+	// Lengths around one, two and three folds, in plain and base64 form
+	for n := 60; n <= 240; n++ {
+		for _, value := range []string{strings.Repeat("x", n), strings.Repeat("é", n/2)} {
+			attrs := NewAttributeMap()
+			attrs.Add("description", value)
+
+			var out strings.Builder
+			writer := NewWriter(&out)
+			if err := writer.WriteEntry("cn=Alice,dc=example,dc=com", attrs); err != nil {
+				t.Fatal(err)
+			}
+			if err := writer.Flush(); err != nil {
+				t.Fatal(err)
+			}
+
+			for i, line := range strings.Split(out.String(), "\n") {
+				if len(line) > foldWidth {
+					t.Fatalf("value of %d bytes: line %d is %d bytes long, want at most %d", len(value), i+1, len(line), foldWidth)
+				}
+			}
+			records, err := readAll(out.String())
+			if err != nil {
+				t.Fatalf("value of %d bytes: Next() error = %v", len(value), err)
+			}
+			if got := records[0].Attributes[0].Value; got != value {
+				t.Fatalf("value of %d bytes read back as %q", len(value), got)
+			}
+		}
+	}
+}
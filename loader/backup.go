@@ -0,0 +1,213 @@
+package loader
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/imax1000/ldap-import/ldif"
+)
+
+// BackupDir returns the directory OU snapshots are written to, creating it
+// if needed. It follows the XDG base directory spec.
+func BackupDir() (string, error) {
+	dataHome := os.Getenv("XDG_DATA_HOME")
+	if dataHome == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		dataHome = filepath.Join(home, ".local", "share")
+	}
+
+	dir := filepath.Join(dataHome, "ldap-import", "backups")
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// Backup dumps the target OU and everything below it, with all user
+// attributes, to a timestamped LDIF file and returns the file name.
+// Operational attributes (entryUUID, timestamps) are assigned by the server
+// and cannot be written back, so they are not part of the snapshot.
+func Backup(ctx context.Context, session *Session, targetOU string) (string, error) {
+	ouDN, err := TargetOUDN(session.Config, targetOU)
+	if err != nil {
+		return "", err
+	}
+
+	entries, err := SearchSubtree(ctx, session, ouDN)
+	if err != nil {
+		return "", err
+	}
+
+	dir, err := BackupDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to create backup directory: %v", err)
+	}
+
+	// The random suffix keeps backups taken in the same second apart
+	pattern := fmt.Sprintf("%s-%s-*.ldif", safeFileName(targetOU), time.Now().Format("20060102-150405"))
+	file, err := os.CreateTemp(dir, pattern)
+	if err != nil {
+		return "", fmt.Errorf("failed to create backup file: %v", err)
+	}
+	defer file.Close()
+	filename := file.Name()
+
+	writer := ldif.NewWriter(file)
+	for _, entry := range entries {
+		if err := writer.WriteEntry(entry.DN, entry.Attributes); err != nil {
+			return "", fmt.Errorf("failed to write backup: %v", err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return "", fmt.Errorf("failed to write backup: %v", err)
+	}
+
+	return filename, nil
+}
+
+// Restore puts an OU back the way it is recorded in a backup file: the
+// current content below the OU is deleted, leaves first, and the entries
+// from the backup are added again, parents first. The restore is all or
+// nothing: when a change fails or ctx is canceled, the changes made so far
+// are undone from a snapshot of the OU taken beforehand, as for a load with
+// OnErrorRollback.
+func Restore(ctx context.Context, session *Session, filename string, progress ProgressFunc) error {
+	entries, err := readBackup(filename)
+	if err != nil {
+		return err
+	}
+	root := entries[0]
+
+	current, err := SearchSubtree(ctx, session, root.DN)
+	if ctx.Err() != nil {
+		return canceled(err)
+	}
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+		return err
+	}
+
+	var changes []Change
+	if len(current) == 0 {
+		changes = append(changes, Change{Op: ChangeAdd, DN: root.DN, Attributes: root.Attributes})
+	} else if mods := diffAttributes(current[0].Attributes, root.Attributes); len(mods) > 0 {
+		changes = append(changes, Change{Op: ChangeModify, DN: root.DN, Modifications: mods})
+	}
+	for i := len(current) - 1; i > 0; i-- {
+		changes = append(changes, Change{Op: ChangeDelete, DN: current[i].DN})
+	}
+	for _, entry := range entries[1:] {
+		changes = append(changes, Change{Op: ChangeAdd, DN: entry.DN, Attributes: entry.Attributes})
+	}
+
+	return applyWithRollback(ctx, session, changes, current, progress, "Restoring entries")
+}
+
+// readBackup reads a backup file and returns its entries parents first.
+// The first entry is the OU the backup was taken of.
+func readBackup(filename string) ([]ldif.Entry, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open backup: %v", err)
+	}
+	defer file.Close()
+
+	var entries []ldif.Entry
+	reader := ldif.NewReader(file)
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading backup: %v", err)
+		}
+		if record.ChangeType != "" {
+			return nil, fmt.Errorf("line %d: backup contains a change record", record.Line)
+		}
+
+		entry := ldif.Entry{DN: record.DN, Attributes: ldif.NewAttributeMap()}
+		for _, attr := range record.Attributes {
+			entry.Attributes.Add(attr.Name, attr.Value)
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("backup %s is empty", filename)
+	}
+
+	sortByDepth(entries)
+
+	rootDN, err := ldap.ParseDN(entries[0].DN)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DN %q in backup: %v", entries[0].DN, err)
+	}
+	for _, entry := range entries[1:] {
+		dn, err := ldap.ParseDN(entry.DN)
+		if err != nil || !rootDN.AncestorOfFold(dn) {
+			return nil, fmt.Errorf("entry %s in backup is not below %s", entry.DN, entries[0].DN)
+		}
+	}
+
+	return entries, nil
+}
+
+// SearchSubtree returns baseDN and everything below it with all user
+// attributes, parents before their children
+func SearchSubtree(ctx context.Context, session *Session, baseDN string) ([]ldif.Entry, error) {
+	searchRequest := ldap.NewSearchRequest(
+		baseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)",
+		[]string{"*"},
+		nil,
+	)
+
+	result, err := session.SearchPaged(ctx, searchRequest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search entries: %w", err)
+	}
+
+	entries := make([]ldif.Entry, 0, len(result.Entries))
+	for _, e := range result.Entries {
+		entries = append(entries, entryFromLDAP(e))
+	}
+	sortByDepth(entries)
+	return entries, nil
+}
+
+// sortByDepth orders entries so that every parent comes before its children
+func sortByDepth(entries []ldif.Entry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return dnDepth(entries[i].DN) < dnDepth(entries[j].DN)
+	})
+}
+
+// dnDepth returns the number of RDNs in a DN
+func dnDepth(dn string) int {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil {
+		return strings.Count(dn, ",") + 1
+	}
+	return len(parsed.RDNs)
+}
+
+// safeFileName replaces characters that do not belong in a file name
+func safeFileName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' || r == '_' || r == '.' {
+			return r
+		}
+		return '_'
+	}, name)
+}
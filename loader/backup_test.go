@@ -0,0 +1,127 @@
+package loader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/imax1000/ldap-import/loader/loadertest"
+)
+
+// dump returns every entry of dir with its attributes, for comparing
+// whole directories
+func dump(dir *loadertest.Directory) map[string]string {
+	entries := make(map[string]string)
+	for _, dn := range dir.DNs() {
+		var attrs []string
+		for _, attr := range dir.Entry(dn).Attributes {
+			values := slices.Clone(attr.Values)
+			slices.Sort(values)
+			attrs = append(attrs, fmt.Sprintf("%s=%q", strings.ToLower(attr.Name), values))
+		}
+		slices.Sort(attrs)
+		entries[strings.ToLower(dn)] = strings.Join(attrs, " ")
+	}
+	return entries
+}
+
+func TestBackupTwiceInOneSecond(t *testing.T) {
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+
+	dir := newTestDirectory(t, seedCarol, false)
+	session := newTestSession(dir)
+	defer session.Close()
+
+	first, err := Backup(context.Background(), session, "staff")
+	if err != nil {
+		t.Fatalf("first Backup() error = %v", err)
+	}
+	second, err := Backup(context.Background(), session, "staff")
+	if err != nil {
+		t.Fatalf("second Backup() error = %v", err)
+	}
+	if first == second {
+		t.Errorf("both backups were written to %s", first)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	tests := []struct {
+		name    string
+		fault   *loadertest.Fault
+		wantErr bool
+	}{
+		{name: "round trip"},
+		{
+			name:    "failed add rolls back",
+			fault:   &loadertest.Fault{Op: "add", DN: "cn=phone,cn=Carol," + testOUDN, Err: ldap.NewError(ldap.LDAPResultUnwillingToPerform, errors.New("read-only")), Times: 1},
+			wantErr: true,
+		},
+		{
+			name:    "failed delete rolls back",
+			fault:   &loadertest.Fault{Op: "delete", DN: "cn=Carol," + testOUDN, Err: ldap.NewError(ldap.LDAPResultUnwillingToPerform, errors.New("read-only")), Times: 1},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("XDG_DATA_HOME", t.TempDir())
+
+			dir := newTestDirectory(t, seedCarol+seedCarolPhone, false)
+			session := newTestSession(dir)
+			defer session.Close()
+
+			filename, err := Backup(context.Background(), session, "staff")
+			if err != nil {
+				t.Fatalf("Backup() error = %v", err)
+			}
+			backedUp := dump(dir)
+
+			// Change the OU in every way a load can
+			ctx := context.Background()
+			if err := session.Del(ctx, ldap.NewDelRequest("cn=phone,cn=Carol,"+testOUDN, nil)); err != nil {
+				t.Fatal(err)
+			}
+			modify := ldap.NewModifyRequest("cn=Carol,"+testOUDN, nil)
+			modify.Replace("sn", []string{"Jones"})
+			modify.Add("telephoneNumber", []string{"300"})
+			if err := session.Modify(ctx, modify); err != nil {
+				t.Fatal(err)
+			}
+			add := ldap.NewAddRequest("cn=Alice,"+testOUDN, nil)
+			add.Attribute("objectClass", []string{"inetOrgPerson"})
+			add.Attribute("cn", []string{"Alice"})
+			add.Attribute("sn", []string{"Smith"})
+			if err := session.Add(ctx, add); err != nil {
+				t.Fatal(err)
+			}
+			modified := dump(dir)
+
+			if tt.fault != nil {
+				dir.InjectFault(*tt.fault)
+			}
+			err = Restore(ctx, session, filename, nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Restore() error = %v, want error %v", err, tt.wantErr)
+			}
+
+			want := backedUp
+			if tt.wantErr {
+				// Nothing of the restore is left behind
+				want = modified
+				if !strings.Contains(err.Error(), "rolled back") {
+					t.Errorf("Restore() error = %v, want it to say the changes were rolled back", err)
+				}
+			}
+			if got := dump(dir); !maps.Equal(got, want) {
+				t.Errorf("directory after Restore() =\n%v\nwant\n%v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,39 @@
+package loader
+
+import (
+	"errors"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// Client is a connection to a directory server, the part of *ldap.Conn
+// the loader relies on. Tests put an in-memory directory in its place.
+type Client interface {
+	Bind(username, password string) error
+	Search(request *ldap.SearchRequest) (*ldap.SearchResult, error)
+	Add(request *ldap.AddRequest) error
+	Modify(request *ldap.ModifyRequest) error
+	Del(request *ldap.DelRequest) error
+	Close() error
+}
+
+var _ Client = (*ldap.Conn)(nil)
+
+// Optional capabilities of a Client. *ldap.Conn has all of them; a client
+// without pagedSearcher is searched without paging, and one without
+// extender does not support extended operations.
+type (
+	pagedSearcher interface {
+		SearchWithPaging(request *ldap.SearchRequest, pagingSize uint32) (*ldap.SearchResult, error)
+	}
+	extender interface {
+		Extended(request *ldap.ExtendedRequest) (*ldap.ExtendedResponse, error)
+	}
+	closingReporter interface {
+		IsClosing() bool
+	}
+)
+
+// errNoExtendedOperations is returned for extended operations on a client
+// that cannot send them, with the code a server gives for an unknown one
+var errNoExtendedOperations = ldap.NewError(ldap.LDAPResultProtocolError, errors.New("extended operations are not supported"))
@@ -0,0 +1,37 @@
+package loader
+
+import "time"
+
+// Config holds the connection and performance settings of a session
+type Config struct {
+	Host     string
+	Port     string
+	BindDN   string
+	Password string
+	BaseDN   string
+	AbookOU  string
+
+	BindMechanism      string
+	Security           string
+	CAFile             string
+	CertFile           string
+	KeyFile            string
+	MinTLSVersion      string
+	InsecureSkipVerify bool
+
+	// Zero timeouts mean no limit
+	ConnectTimeout time.Duration
+	RequestTimeout time.Duration
+	Retries        int
+
+	// PageSize is the number of entries per page when reading from the
+	// directory; zero turns paging off
+	PageSize int
+
+	// Workers is the number of operations in flight at once, spread over
+	// Connections connections; RateLimit caps operations per second, with
+	// zero meaning no limit
+	Workers     int
+	Connections int
+	RateLimit   int
+}
@@ -0,0 +1,278 @@
+package loader
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// Connection security modes
+const (
+	SecurityPlain    = "plain"
+	SecurityStartTLS = "starttls"
+	SecurityLDAPS    = "ldaps"
+)
+
+// Bind mechanisms
+const (
+	BindSimple    = "simple"
+	BindAnonymous = "anonymous"
+	BindExternal  = "external"
+	BindNTLM      = "ntlm"
+	BindDigestMD5 = "digest-md5"
+)
+
+// Defaults for the timeout, retry and paging settings
+const (
+	DefaultConnectTimeout = 10 * time.Second
+	DefaultRequestTimeout = 60 * time.Second
+	DefaultRetries        = 3
+	DefaultPageSize       = 200
+)
+
+// tlsVersions maps the minimum TLS versions offered in the TLS options
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// defaultLDAPISocket is the socket used for ldapi:/// without a path
+const defaultLDAPISocket = "/var/run/slapd/ldapi"
+
+// ldapServer is where to connect to, taken from an LDAP URL in the host
+// field or from the host, port and security settings
+type ldapServer struct {
+	Scheme   string // ldap, ldaps or ldapi
+	Addr     string // host:port, or the socket path for ldapi
+	Host     string // host name for certificate checks and DIGEST-MD5
+	Security string
+}
+
+// parseServer works out the server address. The host field takes either a
+// host name or an ldap://, ldaps:// or ldapi:// URL; with a URL the port
+// field is not used. The ldapi socket path is percent-encoded in the host
+// part, as in ldapi://%2Fvar%2Frun%2Fslapd%2Fldapi.
+func parseServer(config Config) (ldapServer, error) {
+	security := config.Security
+	if security == "" {
+		security = SecurityPlain
+	}
+
+	urlScheme, rest, isURL := strings.Cut(strings.TrimSpace(config.Host), "://")
+	if !isURL {
+		scheme, port := "ldap", "389"
+		if security == SecurityLDAPS {
+			scheme, port = "ldaps", "636"
+		}
+		if config.Port != "" {
+			port = config.Port
+		}
+		return ldapServer{
+			Scheme:   scheme,
+			Addr:     net.JoinHostPort(config.Host, port),
+			Host:     config.Host,
+			Security: security,
+		}, nil
+	}
+
+	switch strings.ToLower(urlScheme) {
+	case "ldapi":
+		if security != SecurityPlain {
+			return ldapServer{}, fmt.Errorf("TLS cannot be used over ldapi://")
+		}
+		hostPart, _, _ := strings.Cut(rest, "/")
+		socket, err := url.PathUnescape(hostPart)
+		if err != nil {
+			return ldapServer{}, fmt.Errorf("invalid ldapi socket path %q: %v", hostPart, err)
+		}
+		if socket == "" {
+			socket = defaultLDAPISocket
+		}
+		return ldapServer{Scheme: "ldapi", Addr: socket, Host: "localhost", Security: SecurityPlain}, nil
+	case "ldap", "ldaps":
+		u, err := url.Parse(config.Host)
+		if err != nil {
+			return ldapServer{}, fmt.Errorf("invalid LDAP URL: %v", err)
+		}
+		if u.Hostname() == "" {
+			return ldapServer{}, fmt.Errorf("LDAP URL %s has no host", config.Host)
+		}
+
+		port := u.Port()
+		if u.Scheme == "ldaps" {
+			security = SecurityLDAPS
+			if port == "" {
+				port = "636"
+			}
+		} else {
+			if security == SecurityLDAPS {
+				return ldapServer{}, fmt.Errorf("LDAPS was selected but the URL is ldap://, use ldaps:// instead")
+			}
+			if port == "" {
+				port = "389"
+			}
+		}
+		return ldapServer{
+			Scheme:   u.Scheme,
+			Addr:     net.JoinHostPort(u.Hostname(), port),
+			Host:     u.Hostname(),
+			Security: security,
+		}, nil
+	}
+	return ldapServer{}, fmt.Errorf("unsupported URL scheme %q, use ldap://, ldaps:// or ldapi://", urlScheme)
+}
+
+// connect opens a connection as configured and binds with it. Every
+// operation talks to the server through here.
+func connect(ctx context.Context, config Config) (*ldap.Conn, error) {
+	server, err := parseServer(config)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := dial(config, server)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to LDAP server: %w", err)
+	}
+	conn.SetTimeout(config.RequestTimeout)
+
+	// Dialing is bounded by the connect timeout; a bind that hangs is
+	// aborted by closing the connection
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	err = bind(conn, config, server)
+	stop()
+	if ctx.Err() != nil {
+		conn.Close()
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to bind to LDAP server: %w", err)
+	}
+	return conn, nil
+}
+
+// dial opens a connection to server using its security mode
+func dial(config Config, server ldapServer) (*ldap.Conn, error) {
+	// TCP keepalives stop firewalls from dropping the connection while a
+	// session is idle
+	dialer := &net.Dialer{Timeout: config.ConnectTimeout, KeepAlive: 30 * time.Second}
+
+	if server.Scheme == "ldapi" {
+		return ldap.DialURL((&url.URL{Scheme: "ldapi", Path: server.Addr}).String(), ldap.DialWithDialer(dialer))
+	}
+
+	switch server.Security {
+	case SecurityPlain:
+		return ldap.DialURL("ldap://"+server.Addr, ldap.DialWithDialer(dialer))
+	case SecurityStartTLS:
+		tlsConfig, err := newTLSConfig(config, server.Host)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := ldap.DialURL("ldap://"+server.Addr, ldap.DialWithDialer(dialer))
+		if err != nil {
+			return nil, err
+		}
+		conn.SetTimeout(config.RequestTimeout)
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("StartTLS failed: %w", err)
+		}
+		return conn, nil
+	case SecurityLDAPS:
+		tlsConfig, err := newTLSConfig(config, server.Host)
+		if err != nil {
+			return nil, err
+		}
+		return ldap.DialURL("ldaps://"+server.Addr, ldap.DialWithTLSDialer(tlsConfig, dialer))
+	}
+	return nil, fmt.Errorf("unknown connection security %q", server.Security)
+}
+
+// newTLSConfig builds the TLS settings from the CA bundle, client
+// certificate and minimum version in the config
+func newTLSConfig(config Config, host string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         host,
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}
+
+	if config.MinTLSVersion != "" {
+		version, ok := tlsVersions[config.MinTLSVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS version %q", config.MinTLSVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+
+	if config.CAFile != "" {
+		pem, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", config.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if config.CertFile != "" || config.KeyFile != "" {
+		if config.CertFile == "" || config.KeyFile == "" {
+			return nil, fmt.Errorf("client certificate and key must be given together")
+		}
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// bind authenticates conn with the configured mechanism. For NTLM the bind
+// DN field holds DOMAIN\user or user@domain, for DIGEST-MD5 the user name.
+// SASL EXTERNAL uses the TLS client certificate, or over ldapi:// the
+// identity of the local user.
+func bind(conn *ldap.Conn, config Config, server ldapServer) error {
+	switch config.BindMechanism {
+	case "", BindSimple:
+		return conn.Bind(config.BindDN, config.Password)
+	case BindAnonymous:
+		_, err := conn.SimpleBind(&ldap.SimpleBindRequest{AllowEmptyPassword: true})
+		return err
+	case BindExternal:
+		if server.Scheme != "ldapi" && (server.Security == SecurityPlain || config.CertFile == "") {
+			return fmt.Errorf("SASL EXTERNAL needs ldapi:// or a TLS connection with a client certificate")
+		}
+		return conn.ExternalBind()
+	case BindNTLM:
+		domain, username := splitNTLMUser(config.BindDN)
+		return conn.NTLMBind(domain, username, config.Password)
+	case BindDigestMD5:
+		return conn.MD5Bind(server.Host, config.BindDN, config.Password)
+	}
+	return fmt.Errorf("unknown bind mechanism %q", config.BindMechanism)
+}
+
+// splitNTLMUser splits DOMAIN\user into domain and user name. Other forms,
+// such as user@domain, are passed on whole with an empty domain.
+func splitNTLMUser(user string) (string, string) {
+	if domain, name, ok := strings.Cut(user, "\\"); ok {
+		return domain, name
+	}
+	return "", user
+}
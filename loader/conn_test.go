@@ -0,0 +1,124 @@
+package loader
+
+import "testing"
+
+func TestParseServer(t *testing.T) {
+	tests := []struct {
+		name     string
+		host     string
+		port     string
+		security string
+		want     ldapServer
+		wantErr  bool
+	}{
+		{
+			name: "host name",
+			host: "ldap.example.com",
+			want: ldapServer{Scheme: "ldap", Addr: "ldap.example.com:389", Host: "ldap.example.com", Security: SecurityPlain},
+		},
+		{
+			name: "host name and port",
+			host: "ldap.example.com",
+			port: "1389",
+			want: ldapServer{Scheme: "ldap", Addr: "ldap.example.com:1389", Host: "ldap.example.com", Security: SecurityPlain},
+		},
+		{
+			name:     "host name with StartTLS",
+			host:     "ldap.example.com",
+			security: SecurityStartTLS,
+			want:     ldapServer{Scheme: "ldap", Addr: "ldap.example.com:389", Host: "ldap.example.com", Security: SecurityStartTLS},
+		},
+		{
+			name:     "host name with LDAPS",
+			host:     "ldap.example.com",
+			security: SecurityLDAPS,
+			want:     ldapServer{Scheme: "ldaps", Addr: "ldap.example.com:636", Host: "ldap.example.com", Security: SecurityLDAPS},
+		},
+		{
+			name: "IPv6 address",
+			host: "::1",
+			want: ldapServer{Scheme: "ldap", Addr: "[::1]:389", Host: "::1", Security: SecurityPlain},
+		},
+		{
+			name: "ldap URL",
+			host: "ldap://ldap.example.com",
+			port: "1389",
+			want: ldapServer{Scheme: "ldap", Addr: "ldap.example.com:389", Host: "ldap.example.com", Security: SecurityPlain},
+		},
+		{
+			name:     "ldap URL with StartTLS",
+			host:     "ldap://ldap.example.com:10389/",
+			security: SecurityStartTLS,
+			want:     ldapServer{Scheme: "ldap", Addr: "ldap.example.com:10389", Host: "ldap.example.com", Security: SecurityStartTLS},
+		},
+		{
+			name: "ldaps URL",
+			host: "ldaps://ldap.example.com",
+			want: ldapServer{Scheme: "ldaps", Addr: "ldap.example.com:636", Host: "ldap.example.com", Security: SecurityLDAPS},
+		},
+		{
+			name: "ldaps URL with port",
+			host: "ldaps://ldap.example.com:636",
+			want: ldapServer{Scheme: "ldaps", Addr: "ldap.example.com:636", Host: "ldap.example.com", Security: SecurityLDAPS},
+		},
+		{
+			name: "upper case scheme",
+			host: "LDAPS://ldap.example.com:3269",
+			want: ldapServer{Scheme: "ldaps", Addr: "ldap.example.com:3269", Host: "ldap.example.com", Security: SecurityLDAPS},
+		},
+		{
+			name: "ldapi URL",
+			host: "ldapi://%2Fvar%2Frun%2Fslapd.sock",
+			want: ldapServer{Scheme: "ldapi", Addr: "/var/run/slapd.sock", Host: "localhost", Security: SecurityPlain},
+		},
+		{
+			name: "ldapi URL without a path",
+			host: "ldapi:///",
+			want: ldapServer{Scheme: "ldapi", Addr: defaultLDAPISocket, Host: "localhost", Security: SecurityPlain},
+		},
+		{
+			name:     "ldapi URL with TLS",
+			host:     "ldapi://%2Fvar%2Frun%2Fslapd.sock",
+			security: SecurityStartTLS,
+			wantErr:  true,
+		},
+		{
+			name:    "ldapi URL with a bad escape",
+			host:    "ldapi://%2",
+			wantErr: true,
+		},
+		{
+			name:     "ldap URL with LDAPS",
+			host:     "ldap://ldap.example.com",
+			security: SecurityLDAPS,
+			wantErr:  true,
+		},
+		{
+			name:    "URL without host",
+			host:    "ldap://:389",
+			wantErr: true,
+		},
+		{
+			name:    "http URL",
+			host:    "http://ldap.example.com",
+			wantErr: true,
+		},
+		{
+			name:    "cldap URL",
+			host:    "cldap://ldap.example.com",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseServer(Config{Host: tt.host, Port: tt.port, Security: tt.security})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseServer() error = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseServer() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package loader
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// deleteChanges returns the deletes that remove the given entries below
+// ouDN together with anything underneath them. If the server supports the
+// Tree Delete control, one delete per entry is enough. Otherwise the whole
+// subtree of every entry is deleted depth-first, leaves before parents.
+//
+// No subtree delete extended operation is looked for: the tree delete
+// draft defines only the control, and the vendor operations have neither
+// a common OID nor a common request format. Servers that offer one get
+// the depth-first deletes, which only use plain searches and deletes and
+// leave the directory the same way, at the cost of one request per entry.
+func deleteChanges(ctx context.Context, session *Session, ouDN string, dns []string) ([]Change, error) {
+	if len(dns) == 0 {
+		return nil, nil
+	}
+
+	rootDSE, err := readRootDSE(ctx, session)
+	if err != nil {
+		return nil, err
+	}
+
+	if rootDSE.SupportsControl(ldap.ControlTypeSubtreeDelete) {
+		changes := make([]Change, 0, len(dns))
+		for _, dn := range dns {
+			changes = append(changes, Change{
+				Op:       ChangeDelete,
+				DN:       dn,
+				Controls: []ldap.Control{ldap.NewControlSubtreeDelete()},
+			})
+		}
+		return changes, nil
+	}
+
+	targets := make(map[string]bool, len(dns))
+	for _, dn := range dns {
+		targets[normalizeDN(dn)] = true
+	}
+
+	ou, err := ldap.ParseDN(ouDN)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DN %q: %v", ouDN, err)
+	}
+
+	searchRequest := ldap.NewSearchRequest(
+		ouDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)",
+		[]string{"1.1"},
+		nil,
+	)
+
+	result, err := session.SearchPaged(ctx, searchRequest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search entries: %v", err)
+	}
+
+	var changes []Change
+	for _, entry := range result.Entries {
+		dn, err := ldap.ParseDN(entry.DN)
+		if err != nil || len(dn.RDNs) <= len(ou.RDNs) {
+			continue
+		}
+
+		// Only entries that are a target or lie below one are deleted
+		top := &ldap.DN{RDNs: dn.RDNs[len(dn.RDNs)-len(ou.RDNs)-1:]}
+		if targets[normalizeDN(top.String())] {
+			changes = append(changes, Change{Op: ChangeDelete, DN: entry.DN})
+		}
+	}
+
+	sort.SliceStable(changes, func(i, j int) bool {
+		return dnDepth(changes[i].DN) > dnDepth(changes[j].DN)
+	})
+	return changes, nil
+}
@@ -0,0 +1,91 @@
+package loader
+
+import (
+	"context"
+	"testing"
+)
+
+func TestDeleteChanges(t *testing.T) {
+	const tree = seedCarol + seedCarolPhone + `
+dn: cn=charger,cn=phone,cn=Carol,ou=staff,ou=abook,dc=example,dc=com
+objectClass: device
+cn: charger
+
+` + seedAlice
+
+	carol := "cn=Carol," + testOUDN
+	phone := "cn=phone," + carol
+	charger := "cn=charger," + phone
+	alice := "cn=Alice," + testOUDN
+
+	tests := []struct {
+		name       string
+		treeDelete bool
+		targets    []string
+		want       []string
+		wantTree   bool
+	}{
+		{
+			name:    "leaf",
+			targets: []string{alice},
+			want:    []string{alice},
+		},
+		{
+			name:    "subtree leaves first",
+			targets: []string{carol},
+			want:    []string{charger, phone, carol},
+		},
+		{
+			name:    "several subtrees",
+			targets: []string{alice, carol},
+			want:    []string{charger, phone, carol, alice},
+		},
+		{
+			name:       "Tree Delete",
+			treeDelete: true,
+			targets:    []string{alice, carol},
+			want:       []string{alice, carol},
+			wantTree:   true,
+		},
+		{
+			name:    "nothing",
+			targets: nil,
+			want:    nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := newTestDirectory(t, tree, tt.treeDelete)
+			session := newTestSession(dir)
+			defer session.Close()
+
+			changes, err := deleteChanges(context.Background(), session, testOUDN, tt.targets)
+			if err != nil {
+				t.Fatalf("deleteChanges() error = %v", err)
+			}
+
+			if len(changes) != len(tt.want) {
+				t.Fatalf("deleteChanges() returned %d changes, want %d", len(changes), len(tt.want))
+			}
+			for i, change := range changes {
+				if change.Op != ChangeDelete || !sameDN(change.DN, tt.want[i]) {
+					t.Errorf("change %d = %v %s, want delete %s", i, change.Op, change.DN, tt.want[i])
+				}
+				if hasTree := len(change.Controls) > 0; hasTree != tt.wantTree {
+					t.Errorf("change %d has Tree Delete control = %v, want %v", i, hasTree, tt.wantTree)
+				}
+			}
+
+			// Applied in order, the deletes have to go through
+			if _, err := applyChanges(context.Background(), session, changes, true, nil, "Deleting"); err != nil {
+				t.Fatalf("applying the deletes failed: %v", err)
+			}
+			for _, dn := range tt.targets {
+				if dir.Entry(dn) != nil {
+					t.Errorf("entry %s was not deleted", dn)
+				}
+			}
+		})
+	}
+}
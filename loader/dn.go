@@ -0,0 +1,115 @@
+package loader
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/imax1000/ldap-import/ldif"
+)
+
+// escapeRDNValue escapes an attribute value for use in a DN as described
+// in RFC 4514, section 2.4. Non-ASCII characters are kept as UTF-8, so
+// Cyrillic names stay readable in the resulting DN.
+func escapeRDNValue(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c == '"' || c == '+' || c == ',' || c == ';' || c == '<' || c == '>' || c == '\\' || c == '=':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c == 0:
+			b.WriteString("\\00")
+		case (c == ' ' || c == '#') && i == 0:
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c == ' ' && i == len(value)-1:
+			b.WriteString("\\ ")
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// makeRDN returns a single-valued RDN with the value escaped
+func makeRDN(attr, value string) string {
+	return attr + "=" + escapeRDNValue(value)
+}
+
+// buildDN joins already escaped RDNs onto a parent DN and checks that the
+// result is a valid DN
+func buildDN(parent string, rdns ...string) (string, error) {
+	parts := append([]string(nil), rdns...)
+	if parent != "" {
+		parts = append(parts, parent)
+	}
+	dn := strings.Join(parts, ",")
+
+	if err := validateDN(dn); err != nil {
+		return "", err
+	}
+	return dn, nil
+}
+
+// validateDN checks that dn parses and has no empty attribute values
+func validateDN(dn string) error {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil {
+		return fmt.Errorf("invalid DN %q: %v", dn, err)
+	}
+	for _, rdn := range parsed.RDNs {
+		for _, attr := range rdn.Attributes {
+			if attr.Type == "" || attr.Value == "" {
+				return fmt.Errorf("invalid DN %q: empty attribute type or value", dn)
+			}
+		}
+	}
+	return nil
+}
+
+// DefaultAbookOU is the address book container used when none is configured
+const DefaultAbookOU = "abook"
+
+// abookDN returns the DN of the address book container
+func abookDN(config Config) (string, error) {
+	if config.BaseDN == "" {
+		return "", errors.New("base DN is empty")
+	}
+	if err := validateDN(config.BaseDN); err != nil {
+		return "", fmt.Errorf("base DN: %v", err)
+	}
+	abook := config.AbookOU
+	if abook == "" {
+		abook = DefaultAbookOU
+	}
+	return buildDN(config.BaseDN, makeRDN("ou", abook))
+}
+
+// TargetOUDN returns the DN of an OU inside the address book container
+func TargetOUDN(config Config, targetOU string) (string, error) {
+	if targetOU == "" {
+		return "", errors.New("target OU is empty")
+	}
+	parent, err := abookDN(config)
+	if err != nil {
+		return "", err
+	}
+	return buildDN(parent, makeRDN("ou", targetOU))
+}
+
+// entryDN returns the DN an entry with the given attributes is created
+// with under the target OU, and the naming values it has to contain
+func entryDN(ouDN string, naming *NamingRule, attrs *ldif.AttributeMap) (string, []ldif.Attribute, error) {
+	rdn, values, err := naming.RDN(attrs)
+	if err != nil {
+		return "", nil, err
+	}
+	dn, err := buildDN(ouDN, rdn)
+	if err != nil {
+		return "", nil, err
+	}
+	return dn, values, nil
+}
@@ -0,0 +1,111 @@
+package loader
+
+import (
+	"testing"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+func TestEscapeRDNValue(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{value: "Alice", want: "Alice"},
+		{value: "Иванов, Иван", want: `Иванов\, Иван`},
+		{value: "Smith+Jones", want: `Smith\+Jones`},
+		{value: " leading space", want: `\ leading space`},
+		{value: "trailing space ", want: `trailing space\ `},
+		{value: " ", want: `\ `},
+		{value: "inner  spaces", want: "inner  spaces"},
+		{value: "#1 fan", want: `\#1 fan`},
+		{value: "no #1", want: "no #1"},
+		{value: "a=b", want: `a\=b`},
+		{value: `C:\Users`, want: `C:\\Users`},
+		{value: "<angle>", want: `\<angle\>`},
+		{value: "semi;colon", want: `semi\;colon`},
+		{value: `"quoted"`, want: `\"quoted\"`},
+		{value: "nul\x00byte", want: `nul\00byte`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got := escapeRDNValue(tt.value)
+			if got != tt.want {
+				t.Errorf("escapeRDNValue(%q) = %q, want %q", tt.value, got, tt.want)
+			}
+
+			dn, err := ldap.ParseDN(makeRDN("cn", tt.value) + ",dc=example,dc=com")
+			if err != nil {
+				t.Fatalf("ParseDN() error = %v", err)
+			}
+			if value := dn.RDNs[0].Attributes[0].Value; value != tt.value {
+				t.Errorf("value parsed back = %q, want %q", value, tt.value)
+			}
+		})
+	}
+}
+
+func TestBuildDN(t *testing.T) {
+	tests := []struct {
+		name    string
+		parent  string
+		rdns    []string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:   "one RDN",
+			parent: testOUDN,
+			rdns:   []string{makeRDN("cn", "Иванов, Иван")},
+			want:   `cn=Иванов\, Иван,` + testOUDN,
+		},
+		{
+			name:   "several RDNs",
+			parent: testBaseDN,
+			rdns:   []string{makeRDN("ou", "staff"), makeRDN("ou", "abook")},
+			want:   "ou=staff,ou=abook," + testBaseDN,
+		},
+		{
+			name:   "multi-valued RDN",
+			parent: testOUDN,
+			rdns:   []string{makeRDN("cn", "Smith+Jones") + "+" + makeRDN("employeeNumber", "42")},
+			want:   `cn=Smith\+Jones+employeeNumber=42,` + testOUDN,
+		},
+		{
+			name: "no parent",
+			rdns: []string{makeRDN("dc", "com")},
+			want: "dc=com",
+		},
+		{
+			name:    "empty value",
+			parent:  testOUDN,
+			rdns:    []string{makeRDN("cn", "")},
+			wantErr: true,
+		},
+		{
+			name:    "unescaped RDN",
+			parent:  testOUDN,
+			rdns:    []string{"cn=a=b,c"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid parent",
+			parent:  "not a DN",
+			rdns:    []string{makeRDN("cn", "Alice")},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := buildDN(tt.parent, tt.rdns...)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("buildDN() error = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("buildDN() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+// Package loader loads address book entries into an LDAP directory. It
+// owns the connection handling, the load modes and the backups; front ends
+// pass a context.Context to cancel an operation and a ProgressFunc to
+// follow it.
+package loader
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/imax1000/ldap-import/ldif"
+)
+
+// Options are the settings of a load other than the connection
+type Options struct {
+	TargetOU string
+	Mode     string
+	Key      string
+	OnError  string
+	Naming   *NamingRule // nil names entries by cn
+}
+
+// Result describes a finished load. BackupFile is set as soon as the
+// target OU has been backed up, also when the load fails later on.
+type Result struct {
+	BackupFile string
+	Failed     []EntryError
+	Total      int
+}
+
+// Load backs up the target OU and then loads entries into it the way
+// the options say. Unless the load continues past failed entries, a bad
+// record or a DN collision fails it before the server is contacted. When
+// ctx is canceled, the operations in flight are aborted and a
+// *CanceledError tells how far the load got.
+func Load(ctx context.Context, session *Session, opts Options, entries []ldif.Entry, progress ProgressFunc) (Result, error) {
+	var result Result
+
+	if opts.OnError != OnErrorContinue {
+		ouDN, err := TargetOUDN(session.Config, opts.TargetOU)
+		if err != nil {
+			return result, err
+		}
+		if _, err := desiredEntries(ouDN, opts.Naming, entries); err != nil {
+			return result, fmt.Errorf("failed to build new DNs, nothing was changed: %w", err)
+		}
+	}
+
+	progress.stage("Backing up target OU")
+	backupFile, err := Backup(ctx, session, opts.TargetOU)
+	if err != nil {
+		if ctx.Err() != nil {
+			return result, canceled(err)
+		}
+		return result, fmt.Errorf("failed to back up target OU, nothing was changed: %w", err)
+	}
+	result.BackupFile = backupFile
+
+	var failure string
+	switch {
+	case opts.OnError == OnErrorContinue:
+		result.Failed, result.Total, err = loadContinueOnError(ctx, session, opts.TargetOU, opts.Mode, opts.Key, opts.Naming, entries, progress)
+		failure = "failed to load data"
+
+	case opts.OnError == OnErrorRollback:
+		err = loadTransactional(ctx, session, opts.TargetOU, opts.Mode, opts.Key, opts.Naming, entries, progress)
+		failure = "failed to load data"
+
+	case opts.Mode == ModeSync:
+		progress.stage("Synchronizing entries")
+		err = syncEntries(ctx, session, opts.TargetOU, opts.Key, opts.Naming, entries, progress)
+		failure = "failed to synchronize entries"
+
+	default:
+		err = replaceEntries(ctx, session, opts.TargetOU, opts.Naming, entries, progress)
+		failure = "failed to replace entries"
+	}
+
+	if err != nil {
+		if ctx.Err() != nil {
+			return result, canceled(err)
+		}
+		return result, fmt.Errorf("%s: %w", failure, err)
+	}
+	return result, nil
+}
+
+// ListOUs returns the names of the OUs directly below the address book
+func ListOUs(ctx context.Context, session *Session) ([]string, error) {
+	baseDN, err := abookDN(session.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	searchRequest := ldap.NewSearchRequest(
+		baseDN,
+		ldap.ScopeSingleLevel, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=organizationalUnit)",
+		[]string{"ou"},
+		nil,
+	)
+
+	result, err := session.SearchPaged(ctx, searchRequest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search OUs: %v", err)
+	}
+
+	var ous []string
+	for _, entry := range result.Entries {
+		ous = append(ous, entry.GetAttributeValue("ou"))
+	}
+
+	return ous, nil
+}
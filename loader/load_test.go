@@ -0,0 +1,391 @@
+package loader
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/imax1000/ldap-import/ldif"
+	"github.com/imax1000/ldap-import/loader/loadertest"
+)
+
+const (
+	testBaseDN = "dc=example,dc=com"
+	testOUDN   = "ou=staff,ou=abook," + testBaseDN
+	testAdmin  = "cn=admin," + testBaseDN
+)
+
+// testDIT is the tree every test starts from, with an empty target OU
+const testDIT = `dn: dc=example,dc=com
+objectClass: dcObject
+objectClass: organization
+dc: example
+o: Example
+
+dn: ou=abook,dc=example,dc=com
+objectClass: organizationalUnit
+ou: abook
+
+dn: ou=staff,ou=abook,dc=example,dc=com
+objectClass: organizationalUnit
+ou: staff
+`
+
+// newTestDirectory returns the test tree with seed added below it
+func newTestDirectory(t *testing.T, seed string, treeDelete bool) *loadertest.Directory {
+	t.Helper()
+
+	dir := loadertest.NewDirectory(testBaseDN)
+	dir.SetPassword(testAdmin, "secret")
+	if treeDelete {
+		dir.SupportControl(ldap.ControlTypeSubtreeDelete)
+	}
+	if err := dir.Load(strings.NewReader(testDIT + "\n" + seed)); err != nil {
+		t.Fatalf("failed to load test tree: %v", err)
+	}
+	return dir
+}
+
+// newTestSession returns a session that talks to dir
+func newTestSession(dir *loadertest.Directory) *Session {
+	session := NewSession(Config{
+		BindDN:      testAdmin,
+		Password:    "secret",
+		BaseDN:      testBaseDN,
+		Workers:     DefaultWorkers,
+		Connections: DefaultConnections,
+	})
+	session.Dial = func(ctx context.Context, config Config) (Client, error) {
+		return dir.Client(), nil
+	}
+	return session
+}
+
+// person returns an entry as read from a file, with attributes given as
+// name, value pairs
+func person(attrs ...string) ldif.Entry {
+	entry := ldif.Entry{DN: "cn=" + attrs[1] + ",o=file", Attributes: ldif.NewAttributeMap()}
+	entry.Attributes.Add("objectClass", "inetOrgPerson")
+	for i := 0; i+1 < len(attrs); i += 2 {
+		entry.Attributes.Add(attrs[i], attrs[i+1])
+	}
+	return entry
+}
+
+// ouContents returns the DNs below the target OU, sorted
+func ouContents(dir *loadertest.Directory) []string {
+	var dns []string
+	for _, dn := range dir.DNs() {
+		if strings.HasSuffix(strings.ToLower(dn), ","+testOUDN) {
+			dns = append(dns, dn)
+		}
+	}
+	slices.Sort(dns)
+	return dns
+}
+
+const (
+	seedCarol = `dn: cn=Carol,ou=staff,ou=abook,dc=example,dc=com
+objectClass: inetOrgPerson
+cn: Carol
+sn: Carol
+mail: carol@example.com
+`
+	seedCarolPhone = `
+dn: cn=phone,cn=Carol,ou=staff,ou=abook,dc=example,dc=com
+objectClass: device
+cn: phone
+`
+	seedAlice = `dn: cn=Alice,ou=staff,ou=abook,dc=example,dc=com
+objectClass: inetOrgPerson
+cn: Alice
+sn: Smith
+mail: alice@example.com
+telephoneNumber: 100
+`
+	// seedBobDevice takes the DN Bob is added with without being an
+	// inetOrgPerson, so that neither mode removes it first
+	seedBobDevice = `dn: cn=Bob,ou=staff,ou=abook,dc=example,dc=com
+objectClass: device
+cn: Bob
+`
+)
+
+func TestLoad(t *testing.T) {
+	alice := person("cn", "Alice", "sn", "Smith", "mail", "alice@example.com", "telephoneNumber", "200")
+	bob := person("cn", "Bob", "sn", "Brown", "mail", "bob@example.com")
+
+	tests := []struct {
+		name       string
+		seed       string
+		treeDelete bool
+		opts       Options
+		entries    []ldif.Entry
+
+		wantErr      bool
+		wantNoBackup bool
+		wantFailed   []uint16
+		wantDNs      []string
+		wantValues   map[string]string // "DN attr" to its value
+	}{
+		{
+			name:    "replace into empty OU",
+			entries: []ldif.Entry{alice, bob},
+			wantDNs: []string{"cn=Alice," + testOUDN, "cn=Bob," + testOUDN},
+		},
+		{
+			name:    "replace deletes subtrees depth-first",
+			seed:    seedCarol + seedCarolPhone,
+			entries: []ldif.Entry{alice},
+			wantDNs: []string{"cn=Alice," + testOUDN},
+		},
+		{
+			name:       "replace deletes subtrees with Tree Delete",
+			seed:       seedCarol + seedCarolPhone,
+			treeDelete: true,
+			entries:    []ldif.Entry{alice},
+			wantDNs:    []string{"cn=Alice," + testOUDN},
+		},
+		{
+			name:    "replace stops after the rejected add",
+			seed:    seedBobDevice,
+			entries: []ldif.Entry{alice, bob},
+			wantErr: true,
+			wantDNs: []string{"cn=Alice," + testOUDN, "cn=Bob," + testOUDN},
+		},
+		{
+			name:       "continue reports rejected adds",
+			seed:       seedBobDevice,
+			opts:       Options{OnError: OnErrorContinue},
+			entries:    []ldif.Entry{alice, bob},
+			wantFailed: []uint16{ldap.LDAPResultEntryAlreadyExists},
+			wantDNs:    []string{"cn=Alice," + testOUDN, "cn=Bob," + testOUDN},
+		},
+		{
+			name:    "continue deletes subtrees depth-first",
+			seed:    seedCarol + seedCarolPhone,
+			opts:    Options{OnError: OnErrorContinue},
+			entries: []ldif.Entry{alice},
+			wantDNs: []string{"cn=Alice," + testOUDN},
+		},
+		{
+			name:    "rollback deletes subtrees depth-first",
+			seed:    seedCarol + seedCarolPhone,
+			opts:    Options{OnError: OnErrorRollback},
+			entries: []ldif.Entry{alice},
+			wantDNs: []string{"cn=Alice," + testOUDN},
+		},
+		{
+			name:    "rollback restores deleted subtrees",
+			seed:    seedCarol + seedCarolPhone + "\n" + seedBobDevice,
+			opts:    Options{OnError: OnErrorRollback},
+			entries: []ldif.Entry{alice, bob},
+			wantErr: true,
+			wantDNs: []string{"cn=Bob," + testOUDN, "cn=Carol," + testOUDN, "cn=phone,cn=Carol," + testOUDN},
+		},
+		{
+			name:       "rollback restores subtrees removed with Tree Delete",
+			seed:       seedCarol + seedCarolPhone + "\n" + seedBobDevice,
+			treeDelete: true,
+			opts:       Options{OnError: OnErrorRollback},
+			entries:    []ldif.Entry{alice, bob},
+			wantErr:    true,
+			wantDNs:    []string{"cn=Bob," + testOUDN, "cn=Carol," + testOUDN, "cn=phone,cn=Carol," + testOUDN},
+		},
+		{
+			name:    "rollback restores deleted entries",
+			seed:    seedCarol + "\n" + seedBobDevice,
+			opts:    Options{OnError: OnErrorRollback},
+			entries: []ldif.Entry{alice, bob},
+			wantErr: true,
+			wantDNs: []string{"cn=Bob," + testOUDN, "cn=Carol," + testOUDN},
+		},
+		{
+			name:    "sync modifies, adds and deletes",
+			seed:    seedAlice + "\n" + seedCarol,
+			opts:    Options{Mode: ModeSync, Key: "mail"},
+			entries: []ldif.Entry{alice, bob},
+			wantDNs: []string{"cn=Alice," + testOUDN, "cn=Bob," + testOUDN},
+			wantValues: map[string]string{
+				"cn=Alice," + testOUDN + " telephoneNumber": "200",
+				"cn=Bob," + testOUDN + " sn":                "Brown",
+			},
+		},
+		{
+			name:    "sync deletes subtrees depth-first",
+			seed:    seedAlice + "\n" + seedCarol + seedCarolPhone,
+			opts:    Options{Mode: ModeSync, Key: "mail"},
+			entries: []ldif.Entry{alice},
+			wantDNs: []string{"cn=Alice," + testOUDN},
+		},
+		{
+			name: "sync moves an entry whose DN changed",
+			seed: seedAlice,
+			opts: Options{Mode: ModeSync, Key: "mail"},
+			entries: []ldif.Entry{
+				person("cn", "Alice Jones", "sn", "Jones", "mail", "alice@example.com"),
+			},
+			wantDNs: []string{"cn=Alice Jones," + testOUDN},
+			wantValues: map[string]string{
+				"cn=Alice Jones," + testOUDN + " sn": "Jones",
+			},
+		},
+		{
+			name:    "sync needs the key in every entry",
+			seed:    seedAlice,
+			opts:    Options{Mode: ModeSync, Key: "employeeNumber"},
+			entries: []ldif.Entry{alice},
+			wantErr: true,
+			wantDNs: []string{"cn=Alice," + testOUDN},
+		},
+		{
+			name:       "continue reports entries without the sync key",
+			seed:       seedAlice + "\n" + seedCarol,
+			opts:       Options{Mode: ModeSync, Key: "mail", OnError: OnErrorContinue},
+			entries:    []ldif.Entry{alice, person("cn", "Carol", "sn", "Jones")},
+			wantFailed: []uint16{ldap.LDAPResultObjectClassViolation},
+			wantDNs:    []string{"cn=Alice," + testOUDN, "cn=Carol," + testOUDN},
+			wantValues: map[string]string{
+				"cn=Alice," + testOUDN + " telephoneNumber": "200",
+				"cn=Carol," + testOUDN + " sn":              "Carol",
+			},
+		},
+		{
+			name:       "continue reports entries that share the sync key",
+			seed:       seedAlice,
+			opts:       Options{Mode: ModeSync, Key: "mail", OnError: OnErrorContinue},
+			entries:    []ldif.Entry{alice, bob, person("cn", "Bobby", "sn", "Brown", "mail", "bob@example.com")},
+			wantFailed: []uint16{ldap.LDAPResultConstraintViolation},
+			wantDNs:    []string{"cn=Alice," + testOUDN, "cn=Bob," + testOUDN},
+		},
+		{
+			name:    "sync stops at entries that share the key",
+			seed:    seedAlice,
+			opts:    Options{Mode: ModeSync, Key: "mail"},
+			entries: []ldif.Entry{alice, bob, person("cn", "Bobby", "sn", "Brown", "mail", "bob@example.com")},
+			wantErr: true,
+			wantDNs: []string{"cn=Alice," + testOUDN},
+		},
+		{
+			name:         "entries with the same DN are rejected up front",
+			seed:         seedCarol,
+			entries:      []ldif.Entry{alice, person("cn", "Alice", "sn", "Other")},
+			wantErr:      true,
+			wantNoBackup: true,
+			wantDNs:      []string{"cn=Carol," + testOUDN},
+		},
+		{
+			name:         "rollback rejects entries with the same DN up front",
+			seed:         seedCarol,
+			opts:         Options{OnError: OnErrorRollback},
+			entries:      []ldif.Entry{alice, person("cn", "Alice", "sn", "Other")},
+			wantErr:      true,
+			wantNoBackup: true,
+			wantDNs:      []string{"cn=Carol," + testOUDN},
+		},
+		{
+			name:       "continue reports entries with the same DN",
+			seed:       seedCarol,
+			opts:       Options{OnError: OnErrorContinue},
+			entries:    []ldif.Entry{alice, person("cn", "Alice", "sn", "Other")},
+			wantFailed: []uint16{ldap.LDAPResultEntryAlreadyExists},
+			wantDNs:    []string{"cn=Alice," + testOUDN},
+		},
+	}
+
+	naming, err := ParseNamingRule("cn")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("XDG_DATA_HOME", t.TempDir())
+
+			dir := newTestDirectory(t, tt.seed, tt.treeDelete)
+			session := newTestSession(dir)
+			defer session.Close()
+
+			opts := tt.opts
+			opts.TargetOU = "staff"
+			opts.Naming = naming
+			if opts.Mode == "" {
+				opts.Mode = ModeReplace
+			}
+			if opts.OnError == "" {
+				opts.OnError = OnErrorStop
+			}
+
+			result, err := Load(context.Background(), session, opts, tt.entries, nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Load() error = %v, want error %v", err, tt.wantErr)
+			}
+			if (result.BackupFile == "") != tt.wantNoBackup {
+				t.Errorf("Load() backup file = %q, want a backup %v", result.BackupFile, !tt.wantNoBackup)
+			}
+
+			var failed []uint16
+			for _, f := range result.Failed {
+				failed = append(failed, f.ResultCode)
+			}
+			if !slices.Equal(failed, tt.wantFailed) {
+				t.Errorf("failed result codes = %v, want %v", failed, tt.wantFailed)
+			}
+
+			if got := ouContents(dir); !slices.Equal(got, tt.wantDNs) {
+				t.Errorf("entries in OU = %q, want %q", got, tt.wantDNs)
+			}
+
+			for key, want := range tt.wantValues {
+				i := strings.LastIndex(key, " ")
+				dn, attr := key[:i], key[i+1:]
+				entry := dir.Entry(dn)
+				if entry == nil {
+					t.Errorf("entry %s is missing", dn)
+					continue
+				}
+				if got := entry.GetAttributeValue(attr); got != want {
+					t.Errorf("%s of %s = %q, want %q", attr, dn, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadCanceled(t *testing.T) {
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+
+	dir := newTestDirectory(t, seedCarol, false)
+	session := newTestSession(dir)
+	defer session.Close()
+
+	naming, err := ParseNamingRule("cn")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	progress := func(p Progress) {
+		if p.Stage == "Replacing entries" && p.Done == 1 {
+			cancel()
+		}
+	}
+
+	opts := Options{TargetOU: "staff", Mode: ModeReplace, OnError: OnErrorStop, Naming: naming}
+	entries := []ldif.Entry{person("cn", "Alice", "sn", "Smith"), person("cn", "Bob", "sn", "Brown")}
+	_, err = Load(ctx, session, opts, entries, progress)
+
+	var canceledErr *CanceledError
+	if !errors.As(err, &canceledErr) {
+		t.Fatalf("Load() error = %v, want a CanceledError", err)
+	}
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Load() error %v does not match context.Canceled", err)
+	}
+	if canceledErr.Total != 3 || canceledErr.Done == 0 || canceledErr.Done == canceledErr.Total {
+		t.Errorf("canceled after %d of %d, want part of 3", canceledErr.Done, canceledErr.Total)
+	}
+}
@@ -0,0 +1,255 @@
+package loadertest
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"golang.org/x/crypto/md4"
+)
+
+// Authentication choices of a BindRequest. 10 and 11 are the Sicily
+// messages Active Directory uses to carry NTLM (MS-ADTS, section 5.1.1.1).
+const (
+	authSimple        = 0
+	authSASL          = 3
+	authNTLMNegotiate = 10
+	authNTLMResponse  = 11
+)
+
+// digestRealm is the realm offered in DIGEST-MD5 challenges
+const digestRealm = "loadertest"
+
+func (sess *session) bind(id int64, op *ber.Packet) error {
+	if len(op.Children) < 3 {
+		return sess.respond(id, ldap.ApplicationBindResponse, resultError(ldap.LDAPResultProtocolError, "malformed bind request"), nil)
+	}
+	name := op.Children[1].Data.String()
+	auth := op.Children[2]
+	if auth.ClassType != ber.ClassContext {
+		return sess.respond(id, ldap.ApplicationBindResponse, resultError(ldap.LDAPResultProtocolError, "malformed bind request"), nil)
+	}
+
+	switch auth.Tag {
+	case authSimple:
+		return sess.respond(id, ldap.ApplicationBindResponse, sess.client.Bind(name, auth.Data.String()), nil)
+	case authSASL:
+		return sess.saslBind(id, auth)
+	case authNTLMNegotiate:
+		return sess.ntlmNegotiate(id)
+	case authNTLMResponse:
+		return sess.respond(id, ldap.ApplicationBindResponse, sess.ntlmAuthenticate(auth.Data.Bytes()), nil)
+	}
+	return sess.respond(id, ldap.ApplicationBindResponse, resultError(ldap.LDAPResultAuthMethodNotSupported, "authentication choice %d is not supported", auth.Tag), nil)
+}
+
+// saslBind runs the SASL EXTERNAL and DIGEST-MD5 mechanisms
+func (sess *session) saslBind(id int64, auth *ber.Packet) error {
+	if len(auth.Children) == 0 {
+		return sess.respond(id, ldap.ApplicationBindResponse, resultError(ldap.LDAPResultProtocolError, "malformed SASL credentials"), nil)
+	}
+	mechanism := auth.Children[0].Data.String()
+	credentials := ""
+	if len(auth.Children) > 1 {
+		credentials = auth.Children[1].Data.String()
+	}
+
+	switch mechanism {
+	case "EXTERNAL":
+		return sess.respond(id, ldap.ApplicationBindResponse, sess.externalBind(), nil)
+	case "DIGEST-MD5":
+		if credentials == "" {
+			return sess.digestChallenge(id)
+		}
+		return sess.respond(id, ldap.ApplicationBindResponse, sess.digestAuthenticate(credentials), nil)
+	}
+	return sess.respond(id, ldap.ApplicationBindResponse, resultError(ldap.LDAPResultAuthMethodNotSupported, "SASL mechanism %s is not supported", mechanism), nil)
+}
+
+// externalBind accepts a TLS client certificate the server has issued
+func (sess *session) externalBind() error {
+	tlsConn, ok := sess.conn.(*tls.Conn)
+	if !ok || len(tlsConn.ConnectionState().PeerCertificates) == 0 {
+		return resultError(ldap.LDAPResultInappropriateAuthentication, "SASL EXTERNAL needs a TLS client certificate")
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(sess.server.tlsConfig.Certificates[0].Leaf)
+	cert := tlsConn.ConnectionState().PeerCertificates[0]
+	_, err := cert.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+	if err != nil {
+		return resultError(ldap.LDAPResultInvalidCredentials, "invalid client certificate: %v", err)
+	}
+
+	sess.client.authenticated()
+	return nil
+}
+
+// digestChallenge answers the first step of a DIGEST-MD5 bind (RFC 2831)
+func (sess *session) digestChallenge(id int64) error {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	sess.digestNonce = hex.EncodeToString(nonce)
+
+	challenge := fmt.Sprintf(`realm="%s",nonce="%s",qop="auth",charset=utf-8,algorithm=md5-sess`, digestRealm, sess.digestNonce)
+	response := ldapResult(ldap.ApplicationBindResponse, resultError(ldap.LDAPResultSaslBindInProgress, "SASL bind in progress"), "")
+	response.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 7, challenge, "Server SASL Credentials"))
+	return sess.write(id, response, nil)
+}
+
+// digestAuthenticate checks the response to a DIGEST-MD5 challenge
+func (sess *session) digestAuthenticate(credentials string) error {
+	nonce := sess.digestNonce
+	sess.digestNonce = ""
+
+	params := parseDigest(credentials)
+	password, ok := sess.server.dir.password(params["username"])
+	if !ok || nonce == "" || params["nonce"] != nonce || !strings.HasPrefix(params["digest-uri"], "ldap/") {
+		return resultError(ldap.LDAPResultInvalidCredentials, "invalid credentials")
+	}
+
+	a1 := md5Sum(params["username"] + ":" + digestRealm + ":" + password)
+	ha1 := md5Hex(a1 + ":" + nonce + ":" + params["cnonce"])
+	ha2 := md5Hex("AUTHENTICATE:" + params["digest-uri"])
+	want := md5Hex(ha1 + ":" + nonce + ":" + params["nc"] + ":" + params["cnonce"] + ":" + params["qop"] + ":" + ha2)
+	if !hmac.Equal([]byte(params["response"]), []byte(want)) {
+		return resultError(ldap.LDAPResultInvalidCredentials, "invalid credentials")
+	}
+
+	sess.client.authenticated()
+	return nil
+}
+
+// parseDigest splits a DIGEST-MD5 response into its directives. Values
+// may be quoted, and quoted values may contain commas.
+func parseDigest(s string) map[string]string {
+	params := make(map[string]string)
+	for s != "" {
+		key, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			break
+		}
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				break
+			}
+			value, rest = rest[1:end+1], rest[end+2:]
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+		}
+		params[strings.TrimSpace(key)] = value
+		s = strings.TrimPrefix(rest, ",")
+	}
+	return params
+}
+
+func md5Sum(s string) string {
+	sum := md5.Sum([]byte(s))
+	return string(sum[:])
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// ntlmNegotiate answers an NTLM NEGOTIATE message with a CHALLENGE
+// message, which goes back in the matched DN of the bind response
+func (sess *session) ntlmNegotiate(id int64) error {
+	sess.ntlmChallenge = make([]byte, 8)
+	rand.Read(sess.ntlmChallenge)
+
+	// Header, empty target name, flags, server challenge, reserved and
+	// empty target info; the only flags are Unicode and NTLM
+	const size = 48
+	message := make([]byte, size)
+	copy(message, "NTLMSSP\x00")
+	binary.LittleEndian.PutUint32(message[8:], 2)
+	binary.LittleEndian.PutUint32(message[16:], size)
+	binary.LittleEndian.PutUint32(message[20:], 0x00000201)
+	copy(message[24:32], sess.ntlmChallenge)
+	binary.LittleEndian.PutUint32(message[44:], size)
+
+	return sess.write(id, ldapResult(ldap.ApplicationBindResponse, nil, string(message)), nil)
+}
+
+// ntlmAuthenticate checks the NTLMv2 response in an AUTHENTICATE message
+// (MS-NLMP, section 3.3.2)
+func (sess *session) ntlmAuthenticate(message []byte) error {
+	challenge := sess.ntlmChallenge
+	sess.ntlmChallenge = nil
+
+	invalid := resultError(ldap.LDAPResultInvalidCredentials, "invalid credentials")
+	if challenge == nil || len(message) < 64 || string(message[:8]) != "NTLMSSP\x00" || binary.LittleEndian.Uint32(message[8:]) != 3 {
+		return invalid
+	}
+	ntResponse, ok1 := ntlmField(message, 20)
+	domain, ok2 := ntlmField(message, 28)
+	user, ok3 := ntlmField(message, 36)
+	if !ok1 || !ok2 || !ok3 || len(ntResponse) < 16 {
+		return invalid
+	}
+
+	password, ok := sess.server.dir.password(fromUTF16(user))
+	if !ok {
+		return invalid
+	}
+
+	hash := md4.New()
+	hash.Write(toUTF16(password))
+	v2Hash := hmacMD5(hash.Sum(nil), toUTF16(strings.ToUpper(fromUTF16(user))+fromUTF16(domain)))
+	blob := ntResponse[16:]
+	if !hmac.Equal(ntResponse[:16], hmacMD5(v2Hash, challenge, blob)) {
+		return invalid
+	}
+
+	sess.client.authenticated()
+	return nil
+}
+
+// ntlmField returns the payload a security buffer at offset points to
+func ntlmField(message []byte, offset int) ([]byte, bool) {
+	length := int(binary.LittleEndian.Uint16(message[offset:]))
+	start := int(binary.LittleEndian.Uint32(message[offset+4:]))
+	if start+length > len(message) {
+		return nil, false
+	}
+	return message[start : start+length], true
+}
+
+func hmacMD5(key []byte, data ...[]byte) []byte {
+	mac := hmac.New(md5.New, key)
+	for _, d := range data {
+		mac.Write(d)
+	}
+	return mac.Sum(nil)
+}
+
+func toUTF16(s string) []byte {
+	units := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(units))
+	for i, unit := range units {
+		binary.LittleEndian.PutUint16(b[2*i:], unit)
+	}
+	return b
+}
+
+func fromUTF16(b []byte) string {
+	units := make([]uint16, len(b)/2)
+	for i := range units {
+		units[i] = binary.LittleEndian.Uint16(b[2*i:])
+	}
+	return string(utf16.Decode(units))
+}
@@ -0,0 +1,766 @@
+// Package loadertest provides an in-memory directory for testing the
+// loader without a server, and an LDAP server on top of it for tests that
+// go through the real protocol. The directory keeps the DN hierarchy and
+// answers with the result codes a real server uses, so that the loader's
+// error handling runs the same way it would against OpenLDAP.
+package loadertest
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/imax1000/ldap-import/ldif"
+)
+
+// Directory is an in-memory DIT. All values are compared without regard to
+// case, as with caseIgnoreMatch; there is no schema beyond requiring an
+// objectClass and the naming attributes of every entry.
+type Directory struct {
+	mu        sync.Mutex
+	entries   map[string]*entry // by normalized DN
+	suffixes  map[string]bool
+	passwords map[string]string
+	controls  []string
+	faults    []*Fault
+	seq       int
+
+	// extensions are the extended operations advertised besides StartTLS,
+	// and txns the writes held back by open transactions
+	extensions []string
+	txns       map[string][]func() error
+	nextTxn    int
+}
+
+// Fault makes writes fail on purpose. It matches writes of kind Op ("add",
+// "modify" or "delete") to the entry DN; an empty Op or DN matches any.
+// The first Times matching writes fail with Err, after being carried out
+// if Applied is set. A network error (ldap.ErrorNetwork) stands for an
+// answer that never arrives: Client returns it as go-ldap reports a
+// timeout, and Server sends no response at all.
+type Fault struct {
+	Op      string
+	DN      string
+	Err     error
+	Applied bool
+	Times   int
+}
+
+type entry struct {
+	dn    string
+	rdns  []*ldap.RelativeDN
+	attrs []*ldap.EntryAttribute
+	seq   int // creation order, the order searches return entries in
+}
+
+// NewDirectory returns an empty directory holding the given naming
+// contexts. The suffix entries themselves are added like any other entry.
+func NewDirectory(suffixes ...string) *Directory {
+	d := &Directory{
+		entries:   make(map[string]*entry),
+		suffixes:  make(map[string]bool),
+		passwords: make(map[string]string),
+	}
+	for _, suffix := range suffixes {
+		key, _, err := normalize(suffix)
+		if err != nil {
+			panic(fmt.Sprintf("loadertest: invalid suffix %q: %v", suffix, err))
+		}
+		d.suffixes[key] = true
+	}
+	return d
+}
+
+// SetPassword lets dn bind with password. The DN does not have to exist,
+// like the rootdn of an OpenLDAP database. For DIGEST-MD5 and NTLM binds,
+// which authenticate a user name rather than a DN, dn can also be a plain
+// user name.
+func (d *Directory) SetPassword(dn, password string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.passwords[userKey(dn)] = password
+}
+
+// password returns the password set for a DN or user name
+func (d *Directory) password(name string) (string, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	password, ok := d.passwords[userKey(name)]
+	return password, ok
+}
+
+// SupportControl advertises a control in the root DSE and honours it on
+// requests. Only the Tree Delete control changes what a request does.
+func (d *Directory) SupportControl(oid string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if !slices.Contains(d.controls, oid) {
+		d.controls = append(d.controls, oid)
+	}
+}
+
+// InjectFault adds a fault for the writes that follow
+func (d *Directory) InjectFault(fault Fault) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.faults = append(d.faults, &fault)
+}
+
+// Load adds the entries of an LDIF file, parents before children
+func (d *Directory) Load(r io.Reader) error {
+	reader := ldif.NewReader(r)
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		request := ldap.NewAddRequest(record.DN, nil)
+		attrs := ldif.NewAttributeMap()
+		for _, attr := range record.Attributes {
+			attrs.Add(attr.Name, attr.Value)
+		}
+		for _, attr := range attrs.All() {
+			request.Attribute(attr.Name, attr.Values)
+		}
+		if err := d.add(request); err != nil {
+			return fmt.Errorf("line %d: %w", record.Line, err)
+		}
+	}
+}
+
+// Entry returns a copy of the entry with the given DN, or nil
+func (d *Directory) Entry(dn string) *ldap.Entry {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	key, _, err := normalize(dn)
+	if err != nil {
+		return nil
+	}
+	e, ok := d.entries[key]
+	if !ok {
+		return nil
+	}
+	return e.copy(nil)
+}
+
+// DNs returns the DNs of all entries in the order they were created
+func (d *Directory) DNs() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var dns []string
+	for _, e := range d.sorted() {
+		dns = append(dns, e.dn)
+	}
+	return dns
+}
+
+// Client returns a new connection to the directory. It starts out
+// anonymous; writes need a successful bind first.
+func (d *Directory) Client() *Client {
+	return &Client{dir: d}
+}
+
+// Client is a connection to a Directory. It has the methods of *ldap.Conn
+// that the loader uses.
+type Client struct {
+	dir *Directory
+
+	mu     sync.Mutex
+	bound  bool
+	closed bool
+}
+
+// Bind does a simple bind. An empty name and password bind anonymously.
+func (c *Client) Bind(username, password string) error {
+	if err := c.check(false); err != nil {
+		return err
+	}
+	if err := c.dir.bind(username, password); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.bound = username != ""
+	c.mu.Unlock()
+	return nil
+}
+
+// authenticated marks the client as bound after a SASL or NTLM bind that
+// the server has checked
+func (c *Client) authenticated() {
+	c.mu.Lock()
+	c.bound = true
+	c.mu.Unlock()
+}
+
+// Search runs a search request
+func (c *Client) Search(request *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	filter, err := ldap.CompileFilter(request.Filter)
+	if err != nil {
+		return nil, resultError(ldap.LDAPResultFilterError, "%v", err)
+	}
+	return c.search(request, filter)
+}
+
+// search runs a search request with its filter already compiled, or
+// decoded off the wire
+func (c *Client) search(request *ldap.SearchRequest, filter *ber.Packet) (*ldap.SearchResult, error) {
+	if err := c.check(false); err != nil {
+		return nil, err
+	}
+	return c.dir.search(request, filter)
+}
+
+// Add runs an add request
+func (c *Client) Add(request *ldap.AddRequest) error {
+	if err := c.check(true); err != nil {
+		return err
+	}
+	return c.dir.write("add", request.DN, request.Controls, func() error { return c.dir.add(request) })
+}
+
+// Modify runs a modify request
+func (c *Client) Modify(request *ldap.ModifyRequest) error {
+	if err := c.check(true); err != nil {
+		return err
+	}
+	return c.dir.write("modify", request.DN, request.Controls, func() error { return c.dir.modify(request) })
+}
+
+// Del runs a delete request
+func (c *Client) Del(request *ldap.DelRequest) error {
+	if err := c.check(true); err != nil {
+		return err
+	}
+	return c.dir.write("delete", request.DN, request.Controls, func() error { return c.dir.del(request) })
+}
+
+// Extended runs the Start and End Transaction operations once
+// SupportTransactions has been called, and fails for every other one, as
+// for an unknown operation
+func (c *Client) Extended(request *ldap.ExtendedRequest) (*ldap.ExtendedResponse, error) {
+	switch request.Name {
+	case oidStartTransaction:
+		txnID, err := c.startTransaction()
+		if err != nil {
+			return nil, err
+		}
+		// This is how go-ldap reports a response value without a name
+		return &ldap.ExtendedResponse{Name: txnID}, nil
+	case oidEndTransaction:
+		if err := c.endTransaction(request.Value); err != nil {
+			return nil, err
+		}
+		return &ldap.ExtendedResponse{}, nil
+	}
+
+	if err := c.check(false); err != nil {
+		return nil, err
+	}
+	return nil, resultError(ldap.LDAPResultProtocolError, "unsupported extended operation %s", request.Name)
+}
+
+// startTransaction opens a transaction
+func (c *Client) startTransaction() (string, error) {
+	if err := c.check(true); err != nil {
+		return "", err
+	}
+	return c.dir.startTransaction()
+}
+
+// endTransaction commits or aborts a transaction
+func (c *Client) endTransaction(value *ber.Packet) error {
+	if err := c.check(true); err != nil {
+		return err
+	}
+	return c.dir.endTransaction(value)
+}
+
+// Close closes the connection; every later request fails with a network error
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closed = true
+	return nil
+}
+
+// IsClosing reports whether the connection has been closed
+func (c *Client) IsClosing() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.closed
+}
+
+// check fails if the connection is closed or, for writes, not bound
+func (c *Client) check(write bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return ldap.NewError(ldap.ErrorNetwork, errors.New("ldap: connection closed"))
+	}
+	if write && !c.bound {
+		return resultError(ldap.LDAPResultInsufficientAccessRights, "anonymous writes are not allowed")
+	}
+	return nil
+}
+
+// write carries out a write through the first fault that matches it.
+// A write that belongs to a transaction is held back until the
+// transaction is committed.
+func (d *Directory) write(op, dn string, controls []ldap.Control, apply func() error) error {
+	run := func() error {
+		fault := d.fault(op, dn)
+		if fault == nil {
+			return apply()
+		}
+		if fault.Applied {
+			if err := apply(); err != nil {
+				return err
+			}
+		}
+		return fault.Err
+	}
+
+	if control := ldap.FindControl(controls, oidTransactionSpec); control != nil {
+		return d.queue(control, run)
+	}
+	return run()
+}
+
+// fault returns the first fault that matches a write and counts it off
+func (d *Directory) fault(op, dn string) *Fault {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, f := range d.faults {
+		if f.Times > 0 && (f.Op == "" || f.Op == op) && (f.DN == "" || strings.EqualFold(f.DN, dn)) {
+			f.Times--
+			return f
+		}
+	}
+	return nil
+}
+
+func (d *Directory) bind(username, password string) error {
+	if username == "" && password == "" {
+		return nil
+	}
+	if password == "" {
+		return resultError(ldap.LDAPResultUnwillingToPerform, "unauthenticated bind (DN with no password) disallowed")
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	key, _, err := normalize(username)
+	if err != nil {
+		return resultError(ldap.LDAPResultInvalidDNSyntax, "invalid DN %q", username)
+	}
+	if want, ok := d.passwords[key]; !ok || want != password {
+		return resultError(ldap.LDAPResultInvalidCredentials, "invalid credentials")
+	}
+	return nil
+}
+
+func (d *Directory) search(request *ldap.SearchRequest, filter *ber.Packet) (*ldap.SearchResult, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if request.BaseDN == "" && request.Scope == ldap.ScopeBaseObject {
+		root := d.rootDSE()
+		result := &ldap.SearchResult{}
+		if ok, err := matchFilter(filter, root); err != nil {
+			return nil, err
+		} else if ok {
+			result.Entries = append(result.Entries, root.copy(request.Attributes))
+		}
+		return result, nil
+	}
+
+	key, rdns, err := normalize(request.BaseDN)
+	if err != nil {
+		return nil, resultError(ldap.LDAPResultInvalidDNSyntax, "invalid DN %q", request.BaseDN)
+	}
+	if _, ok := d.entries[key]; !ok {
+		return nil, resultError(ldap.LDAPResultNoSuchObject, "no such object %s", request.BaseDN)
+	}
+
+	result := &ldap.SearchResult{}
+	for _, e := range d.sorted() {
+		if !inScope(e.rdns, rdns, request.Scope) {
+			continue
+		}
+		ok, err := matchFilter(filter, e)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		if request.SizeLimit > 0 && len(result.Entries) == request.SizeLimit {
+			return result, resultError(ldap.LDAPResultSizeLimitExceeded, "size limit exceeded")
+		}
+		found := e.copy(request.Attributes)
+		if request.TypesOnly {
+			for _, attr := range found.Attributes {
+				attr.Values, attr.ByteValues = nil, nil
+			}
+		}
+		result.Entries = append(result.Entries, found)
+	}
+	return result, nil
+}
+
+func (d *Directory) add(request *ldap.AddRequest) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := d.checkControls(request.Controls); err != nil {
+		return err
+	}
+
+	key, rdns, err := normalize(request.DN)
+	if err != nil || len(rdns) == 0 {
+		return resultError(ldap.LDAPResultInvalidDNSyntax, "invalid DN %q", request.DN)
+	}
+	if _, exists := d.entries[key]; exists {
+		return resultError(ldap.LDAPResultEntryAlreadyExists, "entry %s already exists", request.DN)
+	}
+	if !d.suffixes[key] {
+		parent := dnKey(rdns[1:])
+		if _, ok := d.entries[parent]; !ok {
+			return resultError(ldap.LDAPResultNoSuchObject, "parent of %s does not exist", request.DN)
+		}
+	}
+
+	e := &entry{dn: request.DN, rdns: rdns}
+	for _, attr := range request.Attributes {
+		if len(attr.Vals) == 0 {
+			return resultError(ldap.LDAPResultInvalidAttributeSyntax, "%s: no values for attribute type", attr.Type)
+		}
+		for _, value := range attr.Vals {
+			if slices.ContainsFunc(e.values(attr.Type), equalFold(value)) {
+				return resultError(ldap.LDAPResultAttributeOrValueExists, "%s: value %q provided more than once", attr.Type, value)
+			}
+			e.add(attr.Type, value)
+		}
+	}
+	if err := e.validate(ldap.LDAPResultNamingViolation); err != nil {
+		return err
+	}
+
+	d.seq++
+	e.seq = d.seq
+	d.entries[key] = e
+	return nil
+}
+
+func (d *Directory) modify(request *ldap.ModifyRequest) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := d.checkControls(request.Controls); err != nil {
+		return err
+	}
+
+	key, _, err := normalize(request.DN)
+	if err != nil {
+		return resultError(ldap.LDAPResultInvalidDNSyntax, "invalid DN %q", request.DN)
+	}
+	current, ok := d.entries[key]
+	if !ok {
+		return resultError(ldap.LDAPResultNoSuchObject, "no such object %s", request.DN)
+	}
+
+	// The changes are made on a copy, so that a request that fails half
+	// way leaves the entry alone
+	e := &entry{dn: current.dn, rdns: current.rdns, seq: current.seq}
+	for _, attr := range current.attrs {
+		e.attrs = append(e.attrs, &ldap.EntryAttribute{Name: attr.Name, Values: slices.Clone(attr.Values)})
+	}
+
+	for _, change := range request.Changes {
+		name, values := change.Modification.Type, change.Modification.Vals
+		switch change.Operation {
+		case ldap.AddAttribute:
+			if len(values) == 0 {
+				return resultError(ldap.LDAPResultProtocolError, "modify/add: %s: no values given", name)
+			}
+			for _, value := range values {
+				if slices.ContainsFunc(e.values(name), equalFold(value)) {
+					return resultError(ldap.LDAPResultAttributeOrValueExists, "modify/add: %s: value %q already exists", name, value)
+				}
+				e.add(name, value)
+			}
+		case ldap.DeleteAttribute:
+			if e.attr(name) == nil {
+				return resultError(ldap.LDAPResultNoSuchAttribute, "modify/delete: %s: no such attribute", name)
+			}
+			if len(values) == 0 {
+				e.remove(name)
+				continue
+			}
+			for _, value := range values {
+				if !e.removeValue(name, value) {
+					return resultError(ldap.LDAPResultNoSuchAttribute, "modify/delete: %s: no such value", name)
+				}
+			}
+		case ldap.ReplaceAttribute:
+			e.remove(name)
+			for _, value := range values {
+				e.add(name, value)
+			}
+		default:
+			return resultError(ldap.LDAPResultUnwillingToPerform, "modify operation %d is not supported", change.Operation)
+		}
+	}
+	if err := e.validate(ldap.LDAPResultNotAllowedOnRDN); err != nil {
+		return err
+	}
+
+	d.entries[key] = e
+	return nil
+}
+
+func (d *Directory) del(request *ldap.DelRequest) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := d.checkControls(request.Controls); err != nil {
+		return err
+	}
+
+	key, rdns, err := normalize(request.DN)
+	if err != nil {
+		return resultError(ldap.LDAPResultInvalidDNSyntax, "invalid DN %q", request.DN)
+	}
+	if _, ok := d.entries[key]; !ok {
+		return resultError(ldap.LDAPResultNoSuchObject, "no such object %s", request.DN)
+	}
+
+	var children []string
+	for childKey, e := range d.entries {
+		if len(e.rdns) > len(rdns) && inScope(e.rdns, rdns, ldap.ScopeWholeSubtree) {
+			children = append(children, childKey)
+		}
+	}
+	if len(children) > 0 {
+		if !d.treeDelete(request.Controls) {
+			return resultError(ldap.LDAPResultNotAllowedOnNonLeaf, "subordinate objects must be deleted first")
+		}
+		for _, childKey := range children {
+			delete(d.entries, childKey)
+		}
+	}
+	delete(d.entries, key)
+	return nil
+}
+
+// checkControls rejects a critical control the directory does not support
+func (d *Directory) checkControls(controls []ldap.Control) error {
+	for _, control := range controls {
+		if !slices.Contains(d.controls, control.GetControlType()) && isCritical(control) {
+			return resultError(ldap.LDAPResultUnavailableCriticalExtension, "critical extension %s is unavailable", control.GetControlType())
+		}
+	}
+	return nil
+}
+
+// treeDelete reports whether a delete asks for the whole subtree and the
+// directory supports that
+func (d *Directory) treeDelete(controls []ldap.Control) bool {
+	if !slices.Contains(d.controls, ldap.ControlTypeSubtreeDelete) {
+		return false
+	}
+	return slices.ContainsFunc(controls, func(control ldap.Control) bool {
+		return control.GetControlType() == ldap.ControlTypeSubtreeDelete
+	})
+}
+
+func (d *Directory) rootDSE() *entry {
+	root := &entry{}
+	for _, e := range d.sorted() {
+		key, _, _ := normalize(e.dn)
+		if d.suffixes[key] {
+			root.add("namingContexts", e.dn)
+		}
+	}
+	root.add("objectClass", "top")
+	for _, oid := range d.controls {
+		root.add("supportedControl", oid)
+	}
+	for _, oid := range d.extensions {
+		root.add("supportedExtension", oid)
+	}
+	root.add("supportedLDAPVersion", "3")
+	return root
+}
+
+// sorted returns the entries in the order they were created
+func (d *Directory) sorted() []*entry {
+	entries := make([]*entry, 0, len(d.entries))
+	for _, e := range d.entries {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].seq < entries[j].seq })
+	return entries
+}
+
+func (e *entry) attr(name string) *ldap.EntryAttribute {
+	for _, attr := range e.attrs {
+		if strings.EqualFold(attr.Name, name) {
+			return attr
+		}
+	}
+	return nil
+}
+
+func (e *entry) values(name string) []string {
+	if attr := e.attr(name); attr != nil {
+		return attr.Values
+	}
+	return nil
+}
+
+func (e *entry) add(name, value string) {
+	if attr := e.attr(name); attr != nil {
+		attr.Values = append(attr.Values, value)
+		return
+	}
+	e.attrs = append(e.attrs, &ldap.EntryAttribute{Name: name, Values: []string{value}})
+}
+
+func (e *entry) remove(name string) {
+	e.attrs = slices.DeleteFunc(e.attrs, func(attr *ldap.EntryAttribute) bool {
+		return strings.EqualFold(attr.Name, name)
+	})
+}
+
+// removeValue removes one value and the attribute with its last value. It
+// reports whether the value was there.
+func (e *entry) removeValue(name, value string) bool {
+	attr := e.attr(name)
+	if attr == nil {
+		return false
+	}
+	i := slices.IndexFunc(attr.Values, equalFold(value))
+	if i < 0 {
+		return false
+	}
+	attr.Values = slices.Delete(attr.Values, i, i+1)
+	if len(attr.Values) == 0 {
+		e.remove(name)
+	}
+	return true
+}
+
+// validate checks that the entry has an object class and holds the values
+// of its RDN; code is the result when an RDN value is missing
+func (e *entry) validate(code uint16) error {
+	if len(e.values("objectClass")) == 0 {
+		return resultError(ldap.LDAPResultObjectClassViolation, "no objectClass attribute")
+	}
+	for _, attr := range e.rdns[0].Attributes {
+		if !slices.ContainsFunc(e.values(attr.Type), equalFold(attr.Value)) {
+			return resultError(code, "naming attribute '%s' is not present in entry", attr.Type)
+		}
+	}
+	return nil
+}
+
+// copy returns the entry as a search result with the requested attributes:
+// all of them for none or "*", none for "1.1"
+func (e *entry) copy(requested []string) *ldap.Entry {
+	all := len(requested) == 0 || slices.Contains(requested, "*")
+
+	found := &ldap.Entry{DN: e.dn}
+	for _, attr := range e.attrs {
+		if !all && !slices.ContainsFunc(requested, equalFold(attr.Name)) {
+			continue
+		}
+		values := slices.Clone(attr.Values)
+		byteValues := make([][]byte, len(values))
+		for i, value := range values {
+			byteValues[i] = []byte(value)
+		}
+		found.Attributes = append(found.Attributes, &ldap.EntryAttribute{Name: attr.Name, Values: values, ByteValues: byteValues})
+	}
+	return found
+}
+
+// normalize parses dn and returns it as a map key along with its RDNs
+func normalize(dn string) (string, []*ldap.RelativeDN, error) {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil {
+		return "", nil, err
+	}
+	return dnKey(parsed.RDNs), parsed.RDNs, nil
+}
+
+// userKey returns the key of a DN or user name in the password table
+func userKey(name string) string {
+	if key, _, err := normalize(name); err == nil {
+		return key
+	}
+	return strings.ToLower(name)
+}
+
+func dnKey(rdns []*ldap.RelativeDN) string {
+	return strings.ToLower((&ldap.DN{RDNs: rdns}).String())
+}
+
+// inScope reports whether the entry with the given RDNs lies in scope of
+// the base with baseRDNs
+func inScope(rdns, baseRDNs []*ldap.RelativeDN, scope int) bool {
+	depth := len(rdns) - len(baseRDNs)
+	if depth < 0 || dnKey(rdns[depth:]) != dnKey(baseRDNs) {
+		return false
+	}
+	switch scope {
+	case ldap.ScopeBaseObject:
+		return depth == 0
+	case ldap.ScopeSingleLevel:
+		return depth == 1
+	}
+	return true
+}
+
+// isCritical reports whether a control is marked critical
+func isCritical(control ldap.Control) bool {
+	packet := control.Encode()
+	if len(packet.Children) < 2 || packet.Children[1].Tag != ber.TagBoolean {
+		return false
+	}
+	critical, _ := packet.Children[1].Value.(bool)
+	return critical
+}
+
+func equalFold(value string) func(string) bool {
+	return func(other string) bool {
+		return strings.EqualFold(value, other)
+	}
+}
+
+// resultError returns an error the way go-ldap reports a result code
+func resultError(code uint16, format string, args ...any) error {
+	return ldap.NewError(code, fmt.Errorf(format, args...))
+}
@@ -0,0 +1,270 @@
+package loadertest
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+const testTree = `dn: dc=example,dc=com
+objectClass: domain
+dc: example
+
+dn: ou=people,dc=example,dc=com
+objectClass: organizationalUnit
+ou: people
+
+dn: cn=Alice,ou=people,dc=example,dc=com
+objectClass: inetOrgPerson
+cn: Alice
+sn: Smith
+mail: alice@example.com
+employeeNumber: 7
+
+dn: cn=Bob,ou=people,dc=example,dc=com
+objectClass: inetOrgPerson
+cn: Bob
+sn: Brown
+employeeNumber: 12
+`
+
+func newTestClient(t *testing.T) (*Directory, *Client) {
+	t.Helper()
+
+	dir := NewDirectory("dc=example,dc=com")
+	dir.SetPassword("cn=admin,dc=example,dc=com", "secret")
+	if err := dir.Load(strings.NewReader(testTree)); err != nil {
+		t.Fatalf("failed to load test tree: %v", err)
+	}
+
+	client := dir.Client()
+	if err := client.Bind("cn=admin,dc=example,dc=com", "secret"); err != nil {
+		t.Fatalf("Bind() error = %v", err)
+	}
+	return dir, client
+}
+
+func TestResultCodes(t *testing.T) {
+	const people = "ou=people,dc=example,dc=com"
+
+	addPerson := func(dn, cn string) func(c *Client) error {
+		return func(c *Client) error {
+			request := ldap.NewAddRequest(dn, nil)
+			request.Attribute("objectClass", []string{"inetOrgPerson"})
+			request.Attribute("cn", []string{cn})
+			request.Attribute("sn", []string{cn})
+			return c.Add(request)
+		}
+	}
+	modify := func(dn string, change func(r *ldap.ModifyRequest)) func(c *Client) error {
+		return func(c *Client) error {
+			request := ldap.NewModifyRequest(dn, nil)
+			change(request)
+			return c.Modify(request)
+		}
+	}
+
+	tests := []struct {
+		name string
+		op   func(c *Client) error
+		want uint16
+	}{
+		{"add", addPerson("cn=Carol,"+people, "Carol"), ldap.LDAPResultSuccess},
+		{"add existing", addPerson("cn=alice,"+people, "alice"), ldap.LDAPResultEntryAlreadyExists},
+		{"add without parent", addPerson("cn=Carol,ou=nowhere,dc=example,dc=com", "Carol"), ldap.LDAPResultNoSuchObject},
+		{"add outside suffix", addPerson("cn=Carol,dc=other", "Carol"), ldap.LDAPResultNoSuchObject},
+		{"add without naming value", addPerson("cn=Carol,"+people, "Caroline"), ldap.LDAPResultNamingViolation},
+		{"add without objectClass", func(c *Client) error {
+			request := ldap.NewAddRequest("cn=Carol,"+people, nil)
+			request.Attribute("cn", []string{"Carol"})
+			return c.Add(request)
+		}, ldap.LDAPResultObjectClassViolation},
+		{"add with critical unknown control", func(c *Client) error {
+			control := &ldap.ControlString{ControlType: "1.2.3.4", Criticality: true}
+			request := ldap.NewAddRequest("cn=Carol,"+people, []ldap.Control{control})
+			request.Attribute("objectClass", []string{"inetOrgPerson"})
+			request.Attribute("cn", []string{"Carol"})
+			return c.Add(request)
+		}, ldap.LDAPResultUnavailableCriticalExtension},
+
+		{"modify replace", modify("cn=Alice,"+people, func(r *ldap.ModifyRequest) {
+			r.Replace("sn", []string{"Jones"})
+		}), ldap.LDAPResultSuccess},
+		{"modify missing entry", modify("cn=Carol,"+people, func(r *ldap.ModifyRequest) {
+			r.Replace("sn", []string{"Jones"})
+		}), ldap.LDAPResultNoSuchObject},
+		{"modify add existing value", modify("cn=Alice,"+people, func(r *ldap.ModifyRequest) {
+			r.Add("sn", []string{"smith"})
+		}), ldap.LDAPResultAttributeOrValueExists},
+		{"modify delete missing value", modify("cn=Alice,"+people, func(r *ldap.ModifyRequest) {
+			r.Delete("sn", []string{"Jones"})
+		}), ldap.LDAPResultNoSuchAttribute},
+		{"modify delete missing attribute", modify("cn=Alice,"+people, func(r *ldap.ModifyRequest) {
+			r.Delete("telephoneNumber", nil)
+		}), ldap.LDAPResultNoSuchAttribute},
+		{"modify naming value", modify("cn=Alice,"+people, func(r *ldap.ModifyRequest) {
+			r.Replace("cn", []string{"Alicia"})
+		}), ldap.LDAPResultNotAllowedOnRDN},
+
+		{"delete leaf", func(c *Client) error {
+			return c.Del(ldap.NewDelRequest("cn=Bob,"+people, nil))
+		}, ldap.LDAPResultSuccess},
+		{"delete missing entry", func(c *Client) error {
+			return c.Del(ldap.NewDelRequest("cn=Carol,"+people, nil))
+		}, ldap.LDAPResultNoSuchObject},
+		{"delete non-leaf", func(c *Client) error {
+			return c.Del(ldap.NewDelRequest(people, nil))
+		}, ldap.LDAPResultNotAllowedOnNonLeaf},
+		{"delete non-leaf with unsupported Tree Delete", func(c *Client) error {
+			return c.Del(ldap.NewDelRequest(people, []ldap.Control{ldap.NewControlSubtreeDelete()}))
+		}, ldap.LDAPResultNotAllowedOnNonLeaf},
+
+		{"search missing base", func(c *Client) error {
+			_, err := c.Search(ldap.NewSearchRequest("ou=nowhere,dc=example,dc=com",
+				ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false, "(objectClass=*)", nil, nil))
+			return err
+		}, ldap.LDAPResultNoSuchObject},
+		{"search with bad filter", func(c *Client) error {
+			_, err := c.Search(ldap.NewSearchRequest(people,
+				ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false, "(cn=Alice", nil, nil))
+			return err
+		}, ldap.LDAPResultFilterError},
+
+		{"bind with wrong password", func(c *Client) error {
+			return c.Bind("cn=admin,dc=example,dc=com", "wrong")
+		}, ldap.LDAPResultInvalidCredentials},
+		{"write after anonymous bind", func(c *Client) error {
+			if err := c.Bind("", ""); err != nil {
+				return err
+			}
+			return addPerson("cn=Carol,"+people, "Carol")(c)
+		}, ldap.LDAPResultInsufficientAccessRights},
+		{"request after close", func(c *Client) error {
+			c.Close()
+			return addPerson("cn=Carol,"+people, "Carol")(c)
+		}, ldap.ErrorNetwork},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, client := newTestClient(t)
+
+			err := tt.op(client)
+			if tt.want == ldap.LDAPResultSuccess {
+				if err != nil {
+					t.Fatalf("error = %v, want success", err)
+				}
+				return
+			}
+			if !ldap.IsErrorWithCode(err, tt.want) {
+				t.Fatalf("error = %v, want %s", err, ldap.LDAPResultCodeMap[tt.want])
+			}
+		})
+	}
+}
+
+func TestFailedModifyLeavesEntryAlone(t *testing.T) {
+	dir, client := newTestClient(t)
+
+	request := ldap.NewModifyRequest("cn=Alice,ou=people,dc=example,dc=com", nil)
+	request.Replace("sn", []string{"Jones"})
+	request.Delete("telephoneNumber", nil)
+	if err := client.Modify(request); err == nil {
+		t.Fatal("Modify() succeeded, want an error")
+	}
+
+	if got := dir.Entry("cn=Alice,ou=people,dc=example,dc=com").GetAttributeValue("sn"); got != "Smith" {
+		t.Errorf("sn = %q after a failed modify, want Smith", got)
+	}
+}
+
+func TestTreeDelete(t *testing.T) {
+	dir, client := newTestClient(t)
+	dir.SupportControl(ldap.ControlTypeSubtreeDelete)
+
+	err := client.Del(ldap.NewDelRequest("ou=people,dc=example,dc=com", []ldap.Control{ldap.NewControlSubtreeDelete()}))
+	if err != nil {
+		t.Fatalf("Del() error = %v", err)
+	}
+	if got := dir.DNs(); !slices.Equal(got, []string{"dc=example,dc=com"}) {
+		t.Errorf("DNs() = %q after deleting the subtree", got)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	const (
+		base   = "dc=example,dc=com"
+		people = "ou=people,dc=example,dc=com"
+		alice  = "cn=Alice,ou=people,dc=example,dc=com"
+		bob    = "cn=Bob,ou=people,dc=example,dc=com"
+	)
+
+	tests := []struct {
+		name   string
+		base   string
+		scope  int
+		filter string
+		want   []string
+	}{
+		{"base", people, ldap.ScopeBaseObject, "(objectClass=*)", []string{people}},
+		{"one level", base, ldap.ScopeSingleLevel, "(objectClass=*)", []string{people}},
+		{"subtree", base, ldap.ScopeWholeSubtree, "(objectClass=*)", []string{base, people, alice, bob}},
+		{"equality ignores case", people, ldap.ScopeSingleLevel, "(sn=SMITH)", []string{alice}},
+		{"presence", people, ldap.ScopeSingleLevel, "(mail=*)", []string{alice}},
+		{"substrings", people, ldap.ScopeSingleLevel, "(cn=*o*)", []string{bob}},
+		{"initial and final", people, ldap.ScopeSingleLevel, "(mail=al*.com)", []string{alice}},
+		{"and", base, ldap.ScopeWholeSubtree, "(&(objectClass=inetOrgPerson)(sn=B*))", []string{bob}},
+		{"or", base, ldap.ScopeWholeSubtree, "(|(cn=Alice)(ou=people))", []string{people, alice}},
+		{"not", people, ldap.ScopeSingleLevel, "(!(cn=Alice))", []string{bob}},
+		{"numeric ordering", people, ldap.ScopeSingleLevel, "(employeeNumber>=10)", []string{bob}},
+		{"less or equal", people, ldap.ScopeSingleLevel, "(employeeNumber<=7)", []string{alice}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, client := newTestClient(t)
+
+			result, err := client.Search(ldap.NewSearchRequest(tt.base,
+				tt.scope, ldap.NeverDerefAliases, 0, 0, false, tt.filter, []string{"1.1"}, nil))
+			if err != nil {
+				t.Fatalf("Search() error = %v", err)
+			}
+
+			var got []string
+			for _, entry := range result.Entries {
+				got = append(got, entry.DN)
+				if len(entry.Attributes) > 0 {
+					t.Errorf("entry %s has attributes, none were requested", entry.DN)
+				}
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("Search() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRootDSE(t *testing.T) {
+	dir, client := newTestClient(t)
+	dir.SupportControl(ldap.ControlTypeSubtreeDelete)
+
+	result, err := client.Search(ldap.NewSearchRequest("",
+		ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false, "(objectClass=*)",
+		[]string{"supportedControl", "namingContexts"}, nil))
+	if err != nil {
+		t.Fatalf("Search() error = %v", err)
+	}
+	if len(result.Entries) != 1 {
+		t.Fatalf("Search() returned %d entries, want the root DSE", len(result.Entries))
+	}
+
+	root := result.Entries[0]
+	if got := root.GetAttributeValues("supportedControl"); !slices.Equal(got, []string{ldap.ControlTypeSubtreeDelete}) {
+		t.Errorf("supportedControl = %q", got)
+	}
+	if got := root.GetAttributeValue("namingContexts"); got != "dc=example,dc=com" {
+		t.Errorf("namingContexts = %q", got)
+	}
+}
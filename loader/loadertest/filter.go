@@ -0,0 +1,117 @@
+package loadertest
+
+import (
+	"strconv"
+	"strings"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// matchFilter evaluates a compiled search filter against an entry. Values
+// are compared without regard to case; ordering matches compare integers
+// numerically and everything else as strings. Extensible matches are not
+// supported.
+func matchFilter(filter *ber.Packet, e *entry) (bool, error) {
+	switch filter.Tag {
+	case ldap.FilterAnd:
+		for _, child := range filter.Children {
+			ok, err := matchFilter(child, e)
+			if err != nil || !ok {
+				return false, err
+			}
+		}
+		return true, nil
+
+	case ldap.FilterOr:
+		for _, child := range filter.Children {
+			ok, err := matchFilter(child, e)
+			if err != nil || ok {
+				return ok, err
+			}
+		}
+		return false, nil
+
+	case ldap.FilterNot:
+		if len(filter.Children) != 1 {
+			return false, resultError(ldap.LDAPResultProtocolError, "malformed not filter")
+		}
+		ok, err := matchFilter(filter.Children[0], e)
+		return !ok, err
+
+	case ldap.FilterPresent:
+		return len(e.values(filter.Data.String())) > 0, nil
+
+	case ldap.FilterEqualityMatch, ldap.FilterApproxMatch, ldap.FilterGreaterOrEqual, ldap.FilterLessOrEqual:
+		if len(filter.Children) != 2 {
+			return false, resultError(ldap.LDAPResultProtocolError, "malformed %s filter", ldap.FilterMap[uint64(filter.Tag)])
+		}
+		name, assertion := filter.Children[0].Data.String(), filter.Children[1].Data.String()
+		for _, value := range e.values(name) {
+			order := compareValues(value, assertion)
+			switch {
+			case filter.Tag == ldap.FilterGreaterOrEqual && order >= 0,
+				filter.Tag == ldap.FilterLessOrEqual && order <= 0,
+				order == 0:
+				return true, nil
+			}
+		}
+		return false, nil
+
+	case ldap.FilterSubstrings:
+		if len(filter.Children) != 2 {
+			return false, resultError(ldap.LDAPResultProtocolError, "malformed substrings filter")
+		}
+		name := filter.Children[0].Data.String()
+		for _, value := range e.values(name) {
+			if matchSubstrings(strings.ToLower(value), filter.Children[1].Children) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	return false, resultError(ldap.LDAPResultUnwillingToPerform, "unsupported filter %s", ldap.FilterMap[uint64(filter.Tag)])
+}
+
+// matchSubstrings matches a lower-case value against the initial, any and
+// final parts of a substrings filter
+func matchSubstrings(value string, parts []*ber.Packet) bool {
+	for _, part := range parts {
+		sub := strings.ToLower(part.Data.String())
+		switch part.Tag {
+		case ldap.FilterSubstringsInitial:
+			if !strings.HasPrefix(value, sub) {
+				return false
+			}
+			value = value[len(sub):]
+		case ldap.FilterSubstringsAny:
+			i := strings.Index(value, sub)
+			if i < 0 {
+				return false
+			}
+			value = value[i+len(sub):]
+		case ldap.FilterSubstringsFinal:
+			if !strings.HasSuffix(value, sub) {
+				return false
+			}
+			value = ""
+		}
+	}
+	return true
+}
+
+// compareValues orders two values, as integers when both are
+func compareValues(a, b string) int {
+	x, errA := strconv.ParseInt(a, 10, 64)
+	y, errB := strconv.ParseInt(b, 10, 64)
+	if errA == nil && errB == nil {
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(strings.ToLower(a), strings.ToLower(b))
+}
@@ -0,0 +1,515 @@
+package loadertest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// oidStartTLS is the StartTLS extended operation (RFC 4511, section 4.14)
+const oidStartTLS = "1.3.6.1.4.1.1466.20037"
+
+// Server serves a Directory over LDAP on a random localhost port, so that
+// tests run through go-ldap and the real protocol. It speaks LDAPv3 with
+// simple, SASL EXTERNAL, SASL DIGEST-MD5 and NTLM binds, search, add,
+// modify, delete, the Simple Paged Results control, LDAP transactions when
+// the directory supports them and StartTLS, using a self-signed
+// certificate for 127.0.0.1 and localhost.
+type Server struct {
+	// URL is the ldap:// or ldaps:// URL of the server
+	URL string
+	// Addr is the host:port the server listens on
+	Addr string
+
+	dir       *Directory
+	listener  net.Listener
+	tlsConfig *tls.Config
+	certPEM   []byte
+
+	mu     sync.Mutex
+	conns  map[net.Conn]bool
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// NewServer starts a plain LDAP server for dir that offers StartTLS
+func NewServer(dir *Directory) *Server {
+	s := newServer(dir)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("loadertest: failed to listen: %v", err))
+	}
+	s.start(listener, "ldap")
+	return s
+}
+
+// NewTLSServer starts an LDAPS server for dir
+func NewTLSServer(dir *Directory) *Server {
+	s := newServer(dir)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", s.tlsConfig)
+	if err != nil {
+		panic(fmt.Sprintf("loadertest: failed to listen: %v", err))
+	}
+	s.start(listener, "ldaps")
+	return s
+}
+
+func newServer(dir *Directory) *Server {
+	cert, certPEM, err := selfSignedCertificate()
+	if err != nil {
+		panic(fmt.Sprintf("loadertest: failed to create certificate: %v", err))
+	}
+	dir.SupportControl(ldap.ControlTypePaging)
+
+	// Client certificates are checked by SASL EXTERNAL, not the handshake
+	return &Server{
+		dir:       dir,
+		tlsConfig: &tls.Config{Certificates: []tls.Certificate{cert}, ClientAuth: tls.RequestClientCert},
+		certPEM:   certPEM,
+		conns:     make(map[net.Conn]bool),
+	}
+}
+
+func (s *Server) start(listener net.Listener, scheme string) {
+	s.listener = listener
+	s.Addr = listener.Addr().String()
+	s.URL = scheme + "://" + s.Addr
+
+	s.wg.Add(1)
+	go s.serve()
+}
+
+// CertificatePEM returns the server certificate, which is its own CA
+func (s *Server) CertificatePEM() []byte {
+	return s.certPEM
+}
+
+// ClientCertificate issues a TLS client certificate for name, signed by
+// the server certificate, and returns it together with its key. SASL
+// EXTERNAL accepts it.
+func (s *Server) ClientCertificate(name string) (certPEM, keyPEM []byte) {
+	ca := s.tlsConfig.Certificates[0]
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(fmt.Sprintf("loadertest: failed to create key: %v", err))
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.Leaf, &key.PublicKey, ca.PrivateKey)
+	if err != nil {
+		panic(fmt.Sprintf("loadertest: failed to create certificate: %v", err))
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		panic(fmt.Sprintf("loadertest: failed to encode key: %v", err))
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// Close stops the server and closes every open connection
+func (s *Server) Close() {
+	s.mu.Lock()
+	s.closed = true
+	s.listener.Close()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+}
+
+// CloseConnections drops every open connection while the server keeps
+// running, the way an idle timeout or a restart would
+func (s *Server) CloseConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = true
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go func() {
+			defer s.wg.Done()
+			s.handle(conn)
+
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// session is the state of one client connection
+type session struct {
+	server *Server
+	conn   net.Conn
+	client *Client
+	tls    bool
+
+	// pages holds the rest of paged searches by cookie
+	pages      map[string][]*ldap.Entry
+	nextCookie int
+
+	// ntlmChallenge and digestNonce are what the server sent in the first
+	// step of an NTLM or DIGEST-MD5 bind
+	ntlmChallenge []byte
+	digestNonce   string
+}
+
+// handle answers the requests on conn one at a time until the client
+// unbinds or goes away
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+
+	_, isTLS := conn.(*tls.Conn)
+	sess := &session{server: s, conn: conn, client: s.dir.Client(), tls: isTLS, pages: make(map[string][]*ldap.Entry)}
+	for {
+		packet, err := ber.ReadPacket(sess.conn)
+		if err != nil {
+			return
+		}
+		if len(packet.Children) < 2 {
+			return
+		}
+
+		id, _ := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+		var controls []ldap.Control
+		if len(packet.Children) > 2 {
+			for _, child := range packet.Children[2].Children {
+				control, err := ldap.DecodeControl(child)
+				if err != nil {
+					return
+				}
+				controls = append(controls, control)
+			}
+		}
+
+		if op.ClassType != ber.ClassApplication {
+			return
+		}
+		if err := sess.dispatch(id, op, controls); err != nil {
+			return
+		}
+	}
+}
+
+// errUnbind ends a connection after an unbind request
+var errUnbind = errors.New("unbind")
+
+// dispatch runs one request and writes the responses
+func (sess *session) dispatch(id int64, op *ber.Packet, controls []ldap.Control) error {
+	switch op.Tag {
+	case ldap.ApplicationBindRequest:
+		return sess.bind(id, op)
+	case ldap.ApplicationUnbindRequest:
+		return errUnbind
+	case ldap.ApplicationSearchRequest:
+		return sess.search(id, op, controls)
+	case ldap.ApplicationModifyRequest:
+		return sess.modify(id, op, controls)
+	case ldap.ApplicationAddRequest:
+		return sess.add(id, op, controls)
+	case ldap.ApplicationDelRequest:
+		request := &ldap.DelRequest{DN: op.Data.String(), Controls: controls}
+		return sess.respond(id, ldap.ApplicationDelResponse, sess.client.Del(request), nil)
+	case ldap.ApplicationAbandonRequest:
+		return nil
+	case ldap.ApplicationExtendedRequest:
+		return sess.extended(id, op)
+	}
+	// The remaining requests are answered with the response that follows
+	// them in the application tags
+	err := resultError(ldap.LDAPResultUnwillingToPerform, "operation %s is not supported", ldap.ApplicationMap[uint8(op.Tag)])
+	return sess.respond(id, op.Tag+1, err, nil)
+}
+
+func (sess *session) search(id int64, op *ber.Packet, controls []ldap.Control) error {
+	if len(op.Children) < 8 {
+		return sess.respond(id, ldap.ApplicationSearchResultDone, resultError(ldap.LDAPResultProtocolError, "malformed search request"), nil)
+	}
+	request := &ldap.SearchRequest{
+		BaseDN:    op.Children[0].Data.String(),
+		Scope:     int(integer(op.Children[1])),
+		SizeLimit: int(integer(op.Children[3])),
+		Controls:  controls,
+	}
+	request.TypesOnly, _ = op.Children[5].Value.(bool)
+	for _, attr := range op.Children[7].Children {
+		request.Attributes = append(request.Attributes, attr.Data.String())
+	}
+
+	paging, _ := ldap.FindControl(controls, ldap.ControlTypePaging).(*ldap.ControlPaging)
+	var entries []*ldap.Entry
+	var err error
+	if paging != nil && len(paging.Cookie) > 0 {
+		var ok bool
+		entries, ok = sess.pages[string(paging.Cookie)]
+		delete(sess.pages, string(paging.Cookie))
+		if !ok {
+			err = resultError(ldap.LDAPResultUnwillingToPerform, "unknown paged results cookie")
+		}
+	} else {
+		var result *ldap.SearchResult
+		result, err = sess.client.search(request, op.Children[6])
+		if result != nil {
+			entries = result.Entries
+		}
+	}
+
+	var responseControls []ldap.Control
+	if paging != nil && err == nil {
+		// A page size of zero abandons the search
+		size := min(int(paging.PagingSize), len(entries))
+		cookie := ""
+		if size < len(entries) {
+			sess.nextCookie++
+			cookie = strconv.Itoa(sess.nextCookie)
+			sess.pages[cookie] = entries[size:]
+		}
+		entries = entries[:size]
+		responseControls = append(responseControls, &ldap.ControlPaging{Cookie: []byte(cookie)})
+	}
+
+	for _, entry := range entries {
+		if err := sess.write(id, searchEntry(entry), nil); err != nil {
+			return err
+		}
+	}
+	return sess.respond(id, ldap.ApplicationSearchResultDone, err, responseControls)
+}
+
+func (sess *session) modify(id int64, op *ber.Packet, controls []ldap.Control) error {
+	if len(op.Children) < 2 {
+		return sess.respond(id, ldap.ApplicationModifyResponse, resultError(ldap.LDAPResultProtocolError, "malformed modify request"), nil)
+	}
+	request := &ldap.ModifyRequest{DN: op.Children[0].Data.String(), Controls: controls}
+	for _, change := range op.Children[1].Children {
+		if len(change.Children) < 2 || len(change.Children[1].Children) < 2 {
+			return sess.respond(id, ldap.ApplicationModifyResponse, resultError(ldap.LDAPResultProtocolError, "malformed modify request"), nil)
+		}
+		attr := change.Children[1]
+		request.Changes = append(request.Changes, ldap.Change{
+			Operation: uint(integer(change.Children[0])),
+			Modification: ldap.PartialAttribute{
+				Type: attr.Children[0].Data.String(),
+				Vals: values(attr.Children[1]),
+			},
+		})
+	}
+	return sess.respond(id, ldap.ApplicationModifyResponse, sess.client.Modify(request), nil)
+}
+
+func (sess *session) add(id int64, op *ber.Packet, controls []ldap.Control) error {
+	if len(op.Children) < 2 {
+		return sess.respond(id, ldap.ApplicationAddResponse, resultError(ldap.LDAPResultProtocolError, "malformed add request"), nil)
+	}
+	request := &ldap.AddRequest{DN: op.Children[0].Data.String(), Controls: controls}
+	for _, attr := range op.Children[1].Children {
+		if len(attr.Children) < 2 {
+			return sess.respond(id, ldap.ApplicationAddResponse, resultError(ldap.LDAPResultProtocolError, "malformed add request"), nil)
+		}
+		request.Attribute(attr.Children[0].Data.String(), values(attr.Children[1]))
+	}
+	return sess.respond(id, ldap.ApplicationAddResponse, sess.client.Add(request), nil)
+}
+
+// extended runs StartTLS and the transaction operations; every other
+// extended operation is unknown
+func (sess *session) extended(id int64, op *ber.Packet) error {
+	name := ""
+	if len(op.Children) > 0 {
+		name = op.Children[0].Data.String()
+	}
+	switch name {
+	case oidStartTransaction:
+		return sess.startTransaction(id)
+	case oidEndTransaction:
+		var value *ber.Packet
+		if len(op.Children) > 1 {
+			value = op.Children[1]
+		}
+		return sess.respond(id, ldap.ApplicationExtendedResponse, sess.client.endTransaction(value), nil)
+	}
+	if name != oidStartTLS {
+		_, err := sess.client.Extended(&ldap.ExtendedRequest{Name: name})
+		return sess.respond(id, ldap.ApplicationExtendedResponse, err, nil)
+	}
+
+	if sess.tls {
+		err := resultError(ldap.LDAPResultOperationsError, "TLS is already in use")
+		return sess.respond(id, ldap.ApplicationExtendedResponse, err, nil)
+	}
+	if err := sess.respond(id, ldap.ApplicationExtendedResponse, nil, nil); err != nil {
+		return err
+	}
+
+	tlsConn := tls.Server(sess.conn, sess.server.tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+	sess.conn = tlsConn
+	sess.tls = true
+	return nil
+}
+
+// respond writes an LDAPResult with the result code of err. A network
+// error from the directory, which only an injected fault gives here, is
+// answered with silence.
+func (sess *session) respond(id int64, tag ber.Tag, err error, controls []ldap.Control) error {
+	if ldap.IsErrorWithCode(err, ldap.ErrorNetwork) {
+		return nil
+	}
+	return sess.write(id, ldapResult(tag, err, ""), controls)
+}
+
+// ldapResult encodes an LDAPResult with the result code of err
+func ldapResult(tag ber.Tag, err error, matchedDN string) *ber.Packet {
+	code, message := uint16(ldap.LDAPResultSuccess), ""
+	if err != nil {
+		code, message = ldap.LDAPResultOther, err.Error()
+		var ldapErr *ldap.Error
+		if errors.As(err, &ldapErr) {
+			code = ldapErr.ResultCode
+			if ldapErr.Err != nil {
+				message = ldapErr.Err.Error()
+			}
+		}
+	}
+
+	response := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, ldap.ApplicationMap[uint8(tag)])
+	response.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, uint64(code), "Result Code"))
+	response.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, matchedDN, "Matched DN"))
+	response.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, message, "Diagnostic Message"))
+	return response
+}
+
+// write sends one LDAPMessage
+func (sess *session) write(id int64, op *ber.Packet, controls []ldap.Control) error {
+	message := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	message.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "Message ID"))
+	message.AppendChild(op)
+	if len(controls) > 0 {
+		packet := ber.Encode(ber.ClassContext, ber.TypeConstructed, 0, nil, "Controls")
+		for _, control := range controls {
+			packet.AppendChild(control.Encode())
+		}
+		message.AppendChild(packet)
+	}
+
+	_, err := sess.conn.Write(message.Bytes())
+	return err
+}
+
+// searchEntry encodes a SearchResultEntry
+func searchEntry(entry *ldap.Entry) *ber.Packet {
+	packet := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Search Result Entry")
+	packet.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, entry.DN, "Object Name"))
+
+	attrs := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes")
+	for _, attr := range entry.Attributes {
+		partial := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attribute")
+		partial.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, attr.Name, "Type"))
+		vals := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+		for _, value := range attr.Values {
+			vals.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, "Value"))
+		}
+		partial.AppendChild(vals)
+		attrs.AppendChild(partial)
+	}
+	packet.AppendChild(attrs)
+	return packet
+}
+
+// integer returns the value of an INTEGER or ENUMERATED packet
+func integer(packet *ber.Packet) int64 {
+	value, _ := packet.Value.(int64)
+	return value
+}
+
+// values returns the values of a SET OF AttributeValue
+func values(set *ber.Packet) []string {
+	vals := make([]string, 0, len(set.Children))
+	for _, value := range set.Children {
+		vals = append(vals, value.Data.String())
+	}
+	return vals
+}
+
+// selfSignedCertificate creates a certificate for 127.0.0.1 and localhost
+// that is its own CA and signs the client certificates
+func selfSignedCertificate() (tls.Certificate, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "loadertest"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		DNSNames:              []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+	return cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}
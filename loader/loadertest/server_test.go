@@ -0,0 +1,125 @@
+package loadertest
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"strings"
+	"testing"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+func dialTestServer(t *testing.T) (*Directory, *Server, *ldap.Conn) {
+	t.Helper()
+
+	dir := NewDirectory("dc=example,dc=com")
+	dir.SetPassword("cn=admin,dc=example,dc=com", "secret")
+	if err := dir.Load(strings.NewReader(testTree)); err != nil {
+		t.Fatalf("failed to load test tree: %v", err)
+	}
+	server := NewServer(dir)
+	t.Cleanup(server.Close)
+
+	conn, err := ldap.DialURL(server.URL)
+	if err != nil {
+		t.Fatalf("DialURL() error = %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	if err := conn.Bind("cn=admin,dc=example,dc=com", "secret"); err != nil {
+		t.Fatalf("Bind() error = %v", err)
+	}
+	return dir, server, conn
+}
+
+func TestServerPaging(t *testing.T) {
+	_, _, conn := dialTestServer(t)
+
+	request := ldap.NewSearchRequest("dc=example,dc=com",
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false, "(objectClass=*)", []string{"1.1"},
+		[]ldap.Control{ldap.NewControlPaging(3)})
+
+	var pages []int
+	for {
+		result, err := conn.Search(request)
+		if err != nil {
+			t.Fatalf("Search() error = %v", err)
+		}
+		pages = append(pages, len(result.Entries))
+
+		paging, ok := ldap.FindControl(result.Controls, ldap.ControlTypePaging).(*ldap.ControlPaging)
+		if !ok {
+			t.Fatal("response has no paging control")
+		}
+		if len(paging.Cookie) == 0 {
+			break
+		}
+		request.Controls = []ldap.Control{&ldap.ControlPaging{PagingSize: 3, Cookie: paging.Cookie}}
+	}
+
+	if len(pages) != 2 || pages[0] != 3 || pages[1] != 1 {
+		t.Errorf("page sizes = %v, want [3 1]", pages)
+	}
+}
+
+func TestServerWrites(t *testing.T) {
+	dir, _, conn := dialTestServer(t)
+
+	add := ldap.NewAddRequest("cn=Carol,ou=people,dc=example,dc=com", nil)
+	add.Attribute("objectClass", []string{"inetOrgPerson"})
+	add.Attribute("cn", []string{"Carol"})
+	add.Attribute("sn", []string{"Clark"})
+	if err := conn.Add(add); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	if err := conn.Add(add); !ldap.IsErrorWithCode(err, ldap.LDAPResultEntryAlreadyExists) {
+		t.Errorf("second Add() error = %v, want entry already exists", err)
+	}
+
+	modify := ldap.NewModifyRequest("cn=Carol,ou=people,dc=example,dc=com", nil)
+	modify.Replace("sn", []string{"Jones"})
+	modify.Add("mail", []string{"carol@example.com"})
+	if err := conn.Modify(modify); err != nil {
+		t.Fatalf("Modify() error = %v", err)
+	}
+	entry := dir.Entry("cn=Carol,ou=people,dc=example,dc=com")
+	if entry.GetAttributeValue("sn") != "Jones" || entry.GetAttributeValue("mail") != "carol@example.com" {
+		t.Errorf("entry after Modify() = %v", entry.Attributes)
+	}
+
+	if err := conn.Del(ldap.NewDelRequest("ou=people,dc=example,dc=com", nil)); !ldap.IsErrorWithCode(err, ldap.LDAPResultNotAllowedOnNonLeaf) {
+		t.Errorf("Del() of a non-leaf error = %v, want not allowed on non-leaf", err)
+	}
+	if err := conn.Del(ldap.NewDelRequest("cn=Carol,ou=people,dc=example,dc=com", nil)); err != nil {
+		t.Fatalf("Del() error = %v", err)
+	}
+	if dir.Entry("cn=Carol,ou=people,dc=example,dc=com") != nil {
+		t.Error("entry is still there after Del()")
+	}
+
+	if _, err := conn.Compare("cn=Alice,ou=people,dc=example,dc=com", "sn", "Smith"); !ldap.IsErrorWithCode(err, ldap.LDAPResultUnwillingToPerform) {
+		t.Errorf("Compare() error = %v, want unwilling to perform", err)
+	}
+}
+
+func TestServerStartTLS(t *testing.T) {
+	_, server, conn := dialTestServer(t)
+
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(server.CertificatePEM())
+	if err := conn.StartTLS(&tls.Config{RootCAs: pool, ServerName: "127.0.0.1"}); err != nil {
+		t.Fatalf("StartTLS() error = %v", err)
+	}
+	if _, ok := conn.TLSConnectionState(); !ok {
+		t.Fatal("connection is not using TLS after StartTLS()")
+	}
+
+	result, err := conn.Search(ldap.NewSearchRequest("ou=people,dc=example,dc=com",
+		ldap.ScopeSingleLevel, ldap.NeverDerefAliases, 0, 0, false, "(cn=Alice)", []string{"sn"}, nil))
+	if err != nil {
+		t.Fatalf("Search() over TLS error = %v", err)
+	}
+	if len(result.Entries) != 1 || result.Entries[0].GetAttributeValue("sn") != "Smith" {
+		t.Errorf("Search() over TLS = %v", result.Entries)
+	}
+}
@@ -0,0 +1,141 @@
+package loadertest
+
+import (
+	"maps"
+	"slices"
+	"strconv"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// OIDs of the LDAP Transactions extension (RFC 5805)
+const (
+	oidStartTransaction = "1.3.6.1.1.21.1"
+	oidTransactionSpec  = "1.3.6.1.1.21.2"
+	oidEndTransaction   = "1.3.6.1.1.21.3"
+)
+
+// SupportTransactions advertises LDAP transactions (RFC 5805) in the root
+// DSE and honours them. Writes sent with the Transaction Specification
+// control are held back until the transaction ends; on commit they are
+// carried out in order, and if one fails none of them takes effect.
+func (d *Directory) SupportTransactions() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if !slices.Contains(d.extensions, oidStartTransaction) {
+		d.extensions = append(d.extensions, oidStartTransaction, oidEndTransaction)
+		d.controls = append(d.controls, oidTransactionSpec)
+	}
+}
+
+// startTransaction opens a transaction and returns its identifier
+func (d *Directory) startTransaction() (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if !slices.Contains(d.extensions, oidStartTransaction) {
+		return "", resultError(ldap.LDAPResultProtocolError, "unsupported extended operation %s", oidStartTransaction)
+	}
+	if d.txns == nil {
+		d.txns = make(map[string][]func() error)
+	}
+	d.nextTxn++
+	txnID := strconv.Itoa(d.nextTxn)
+	d.txns[txnID] = nil
+	return txnID, nil
+}
+
+// queue holds a write back for the transaction named by control
+func (d *Directory) queue(control ldap.Control, write func() error) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	spec, _ := control.(*ldap.ControlString)
+	if spec == nil || !slices.Contains(d.controls, oidTransactionSpec) {
+		return resultError(ldap.LDAPResultUnavailableCriticalExtension, "critical extension %s is unavailable", oidTransactionSpec)
+	}
+	writes, ok := d.txns[spec.ControlValue]
+	if !ok {
+		return resultError(ldap.LDAPResultUnwillingToPerform, "unknown transaction %q", spec.ControlValue)
+	}
+	d.txns[spec.ControlValue] = append(writes, write)
+	return nil
+}
+
+// endTransaction commits or aborts a transaction. value is the
+// requestValue of the End Transaction request.
+func (d *Directory) endTransaction(value *ber.Packet) error {
+	commit, txnID, err := parseEndTransaction(value)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	writes, ok := d.txns[txnID]
+	delete(d.txns, txnID)
+	saved, seq := maps.Clone(d.entries), d.seq
+	d.mu.Unlock()
+
+	if !ok {
+		return resultError(ldap.LDAPResultUnwillingToPerform, "unknown transaction %q", txnID)
+	}
+	if !commit {
+		return nil
+	}
+
+	// Entries are replaced rather than changed in place, so the saved map
+	// still holds them as they were
+	for _, write := range writes {
+		if err := write(); err != nil {
+			d.mu.Lock()
+			d.entries, d.seq = saved, seq
+			d.mu.Unlock()
+			return err
+		}
+	}
+	return nil
+}
+
+// parseEndTransaction decodes
+//
+//	txnEndReq ::= SEQUENCE {
+//	     commit         BOOLEAN DEFAULT TRUE,
+//	     identifier     OCTET STRING }
+func parseEndTransaction(value *ber.Packet) (bool, string, error) {
+	malformed := resultError(ldap.LDAPResultProtocolError, "malformed End Transaction request")
+	if value == nil {
+		return false, "", malformed
+	}
+	request, err := ber.DecodePacketErr(value.Data.Bytes())
+	if err != nil || len(request.Children) == 0 {
+		return false, "", malformed
+	}
+
+	commit := true
+	fields := request.Children
+	if len(fields) == 2 {
+		if fields[0].Tag != ber.TagBoolean {
+			return false, "", malformed
+		}
+		commit, _ = fields[0].Value.(bool)
+		fields = fields[1:]
+	}
+	if len(fields) != 1 || fields[0].Tag != ber.TagOctetString {
+		return false, "", malformed
+	}
+	return commit, fields[0].Data.String(), nil
+}
+
+// startTransaction answers a Start Transaction request. The response has
+// a responseValue with the identifier and no responseName, as RFC 5805
+// specifies.
+func (sess *session) startTransaction(id int64) error {
+	txnID, err := sess.client.startTransaction()
+	response := ldapResult(ldap.ApplicationExtendedResponse, err, "")
+	if err == nil {
+		response.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 11, txnID, "Response Value"))
+	}
+	return sess.write(id, response, nil)
+}
@@ -0,0 +1,164 @@
+package loader
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/imax1000/ldap-import/ldif"
+)
+
+// NamingPresets are commonly used naming rules. Any other rule can be
+// used as well.
+var NamingPresets = []string{
+	"cn",
+	"uid",
+	"mail",
+	"employeeNumber",
+	"cn+employeeNumber",
+	"uid={mail_localpart}",
+}
+
+// NamingRule decides the RDN entries are created with. It is parsed from a
+// spec of one or more components joined with '+', each either an attribute
+// name, whose value is taken from the entry, or attr=template. Templates
+// may refer to attributes as {name}, {name_localpart} (the part of the
+// value before '@') or {name_lower}.
+type NamingRule struct {
+	Spec       string
+	components []namingComponent
+}
+
+// defaultNaming names entries by cn. It stands in for a nil rule.
+var defaultNaming = &NamingRule{Spec: "cn", components: []namingComponent{{attr: "cn"}}}
+
+type namingComponent struct {
+	attr     string
+	template string
+}
+
+// ParseNamingRule parses and checks a naming rule spec
+func ParseNamingRule(spec string) (*NamingRule, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return nil, fmt.Errorf("naming rule is empty")
+	}
+
+	rule := &NamingRule{Spec: spec}
+	for _, part := range strings.Split(spec, "+") {
+		attr, template, hasTemplate := strings.Cut(strings.TrimSpace(part), "=")
+		attr = strings.TrimSpace(attr)
+		if !isAttributeType(attr) {
+			return nil, fmt.Errorf("naming rule %q: invalid attribute %q", spec, attr)
+		}
+		attr, _ = ldif.CanonicalAttributeName(attr)
+		for _, c := range rule.components {
+			if strings.EqualFold(c.attr, attr) {
+				return nil, fmt.Errorf("naming rule %q: attribute %s is used twice", spec, attr)
+			}
+		}
+
+		if hasTemplate {
+			if _, err := expandTemplate(template, ldif.NewAttributeMap(), false); err != nil {
+				return nil, fmt.Errorf("naming rule %q: %v", spec, err)
+			}
+		}
+		rule.components = append(rule.components, namingComponent{attr: attr, template: template})
+	}
+	return rule, nil
+}
+
+// RDN returns the RDN of an entry with the given attributes, with values
+// escaped, together with the naming values the entry has to contain. A nil
+// rule names entries by cn.
+func (r *NamingRule) RDN(attrs *ldif.AttributeMap) (string, []ldif.Attribute, error) {
+	if r == nil {
+		r = defaultNaming
+	}
+	parts := make([]string, 0, len(r.components))
+	values := make([]ldif.Attribute, 0, len(r.components))
+	for _, c := range r.components {
+		value := attrs.First(c.attr)
+		if c.template != "" {
+			var err error
+			if value, err = expandTemplate(c.template, attrs, true); err != nil {
+				return "", nil, err
+			}
+		}
+		if value == "" {
+			return "", nil, fmt.Errorf("no value for naming attribute %s", c.attr)
+		}
+
+		parts = append(parts, makeRDN(c.attr, value))
+		values = append(values, ldif.Attribute{Name: c.attr, Values: []string{value}})
+	}
+	return strings.Join(parts, "+"), values, nil
+}
+
+// expandTemplate replaces the placeholders in template with values from
+// attrs. With strict unset, missing attributes expand to nothing, which is
+// used to check the syntax of a template.
+func expandTemplate(template string, attrs *ldif.AttributeMap, strict bool) (string, error) {
+	var b strings.Builder
+	rest := template
+	for {
+		start := strings.IndexByte(rest, '{')
+		if start < 0 {
+			if strings.IndexByte(rest, '}') >= 0 {
+				return "", fmt.Errorf("unmatched '}' in template %q", template)
+			}
+			b.WriteString(rest)
+			return b.String(), nil
+		}
+		end := strings.IndexByte(rest[start:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("unclosed '{' in template %q", template)
+		}
+		b.WriteString(rest[:start])
+
+		placeholder := rest[start+1 : start+end]
+		attr, function, _ := strings.Cut(placeholder, "_")
+		if !isAttributeType(attr) {
+			return "", fmt.Errorf("invalid placeholder {%s} in template %q", placeholder, template)
+		}
+
+		value := attrs.First(attr)
+		if value == "" && strict {
+			return "", fmt.Errorf("template %q needs attribute %s", template, attr)
+		}
+		switch function {
+		case "":
+		case "localpart":
+			value, _, _ = strings.Cut(value, "@")
+		case "lower":
+			value = strings.ToLower(value)
+		default:
+			return "", fmt.Errorf("unknown function %q in placeholder {%s}", function, placeholder)
+		}
+		b.WriteString(value)
+
+		rest = rest[start+end+1:]
+	}
+}
+
+// isAttributeType reports whether name is a valid attribute type: a
+// descriptor as in RFC 4512 or a numeric OID
+func isAttributeType(name string) bool {
+	if name == "" {
+		return false
+	}
+	if name[0] >= '0' && name[0] <= '9' {
+		for _, arc := range strings.Split(name, ".") {
+			if arc == "" || strings.Trim(arc, "0123456789") != "" {
+				return false
+			}
+		}
+		return true
+	}
+	for i, c := range name {
+		isLetter := c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+		if !isLetter && (i == 0 || c != '-' && (c < '0' || c > '9')) {
+			return false
+		}
+	}
+	return true
+}
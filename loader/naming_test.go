@@ -0,0 +1,184 @@
+package loader
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/imax1000/ldap-import/ldif"
+)
+
+func TestParseNamingRule(t *testing.T) {
+	tests := []struct {
+		spec    string
+		wantErr bool
+	}{
+		{spec: "cn"},
+		{spec: " commonName "},
+		{spec: "2.5.4.3"},
+		{spec: "cn+employeeNumber"},
+		{spec: "uid={mail_localpart}"},
+		{spec: "uid={mail_lower}"},
+		{spec: "cn={givenName} {sn}"},
+		{spec: "", wantErr: true},
+		{spec: "cn+", wantErr: true},
+		{spec: "=x", wantErr: true},
+		{spec: "c_n", wantErr: true},
+		{spec: "cn+commonName", wantErr: true},
+		{spec: "uid={mail_upper}", wantErr: true},
+		{spec: "uid={}", wantErr: true},
+		{spec: "uid={mail", wantErr: true},
+		{spec: "uid=mail}", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			_, err := ParseNamingRule(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseNamingRule(%q) error = %v, want error %v", tt.spec, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNamingRuleRDN(t *testing.T) {
+	tests := []struct {
+		name       string
+		spec       string // empty for a nil rule
+		attrs      []string
+		want       string
+		wantValues []string // "attr=value" the entry has to contain
+		wantErr    bool
+	}{
+		{
+			name:       "nil rule",
+			attrs:      []string{"cn", "Иванов, Иван"},
+			want:       `cn=Иванов\, Иван`,
+			wantValues: []string{"cn=Иванов, Иван"},
+		},
+		{
+			name:       "alias",
+			spec:       "commonName",
+			attrs:      []string{"cn", "Alice"},
+			want:       "cn=Alice",
+			wantValues: []string{"cn=Alice"},
+		},
+		{
+			name:       "local part",
+			spec:       "uid={mail_localpart}",
+			attrs:      []string{"mail", "alice.smith@example.com"},
+			want:       "uid=alice.smith",
+			wantValues: []string{"uid=alice.smith"},
+		},
+		{
+			name:       "lower case",
+			spec:       "uid={cn_lower}",
+			attrs:      []string{"cn", "Alice"},
+			want:       "uid=alice",
+			wantValues: []string{"uid=alice"},
+		},
+		{
+			name:       "several placeholders",
+			spec:       "cn={givenName} {sn}",
+			attrs:      []string{"givenName", "Alice", "sn", "Smith", "cn", "A. Smith"},
+			want:       "cn=Alice Smith",
+			wantValues: []string{"cn=Alice Smith"},
+		},
+		{
+			name:       "multi-valued",
+			spec:       "cn+employeeNumber",
+			attrs:      []string{"cn", "Smith+Jones", "employeeNumber", "42"},
+			want:       `cn=Smith\+Jones+employeeNumber=42`,
+			wantValues: []string{"cn=Smith+Jones", "employeeNumber=42"},
+		},
+		{
+			name:    "missing attribute",
+			spec:    "cn+employeeNumber",
+			attrs:   []string{"cn", "Alice"},
+			wantErr: true,
+		},
+		{
+			name:    "missing template attribute",
+			spec:    "uid={mail_localpart}",
+			attrs:   []string{"cn", "Alice"},
+			wantErr: true,
+		},
+		{
+			name:    "empty local part",
+			spec:    "uid={mail_localpart}",
+			attrs:   []string{"mail", "@example.com"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var rule *NamingRule
+			if tt.spec != "" {
+				var err error
+				if rule, err = ParseNamingRule(tt.spec); err != nil {
+					t.Fatal(err)
+				}
+			}
+			attrs := ldif.NewAttributeMap()
+			for i := 0; i+1 < len(tt.attrs); i += 2 {
+				attrs.Add(tt.attrs[i], tt.attrs[i+1])
+			}
+
+			rdn, values, err := rule.RDN(attrs)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("RDN() error = %v, want error %v", err, tt.wantErr)
+			}
+			if rdn != tt.want {
+				t.Errorf("RDN() = %q, want %q", rdn, tt.want)
+			}
+			var got []string
+			for _, value := range values {
+				got = append(got, value.Name+"="+value.Values[0])
+			}
+			if !slices.Equal(got, tt.wantValues) {
+				t.Errorf("RDN() values = %q, want %q", got, tt.wantValues)
+			}
+		})
+	}
+}
+
+func TestNameEntriesCollisions(t *testing.T) {
+	rule, err := ParseNamingRule("uid={mail_localpart}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := []ldif.Entry{
+		person("cn", "Alice", "mail", "alice@example.com"),
+		person("cn", "Alice Other", "mail", "alice@example.org"),
+		person("cn", "Alice Upper", "mail", "ALICE@example.net"),
+		person("cn", "Bob", "mail", "bob@example.com"),
+		person("cn", "Nobody"),
+	}
+
+	desired, failed := nameEntries(testOUDN, rule, entries)
+
+	var dns []string
+	for _, entry := range desired {
+		dns = append(dns, entry.DN)
+	}
+	if want := []string{"uid=alice," + testOUDN, "uid=bob," + testOUDN}; !slices.Equal(dns, want) {
+		t.Errorf("named entries = %q, want %q", dns, want)
+	}
+	if uid := desired[0].Attributes.Get("uid"); !slices.Equal(uid, []string{"alice"}) {
+		t.Errorf("uid of the first entry = %q, want the naming value added", uid)
+	}
+
+	var got []string
+	for _, f := range failed {
+		got = append(got, f.DN+" "+ldap.LDAPResultCodeMap[f.ResultCode])
+	}
+	want := []string{
+		"cn=Alice Other,o=file Entry Already Exists",
+		"cn=Alice Upper,o=file Entry Already Exists",
+		"cn=Nobody,o=file Invalid DN Syntax",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("failed entries = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,86 @@
+package loader
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/imax1000/ldap-import/ldif"
+)
+
+// Load modes
+const (
+	ModeReplace = "replace"
+	ModeSync    = "sync"
+)
+
+// Plan computes every change a load in the given mode would make,
+// without writing anything to the server. A nil naming rule names entries
+// by cn.
+func Plan(ctx context.Context, session *Session, targetOU, mode, key string, naming *NamingRule, entries []ldif.Entry) ([]Change, error) {
+	ouDN, err := TargetOUDN(session.Config, targetOU)
+	if err != nil {
+		return nil, err
+	}
+	desired, err := desiredEntries(ouDN, naming, entries)
+	if err != nil {
+		return nil, err
+	}
+
+	changes, failed, err := planChanges(ctx, session, ouDN, mode, key, desired)
+	if err != nil {
+		return nil, err
+	}
+	if len(failed) > 0 {
+		return nil, unmatchedError(failed, len(desired), key)
+	}
+	return changes, nil
+}
+
+// planChanges reads the target OU and computes the changes that turn it
+// into desired in the given mode. Every mode and the preview go through
+// here, so that they all delete entries the same way. In sync mode,
+// entries that cannot be matched on key are returned as failures.
+func planChanges(ctx context.Context, session *Session, ouDN, mode, key string, desired []ldif.Entry) ([]Change, []EntryError, error) {
+	current, err := searchOUEntries(ctx, session, ouDN)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if mode == ModeSync {
+		return diffEntries(ctx, session, ouDN, current, desired, key)
+	}
+	changes, err := replaceChanges(ctx, session, ouDN, current, desired)
+	return changes, nil, err
+}
+
+// replaceChanges lists what replaceEntries does: delete everything that is
+// there together with anything underneath it, then add everything from
+// the file
+func replaceChanges(ctx context.Context, session *Session, ouDN string, current, desired []ldif.Entry) ([]Change, error) {
+	dns := make([]string, 0, len(current))
+	for _, entry := range current {
+		dns = append(dns, entry.DN)
+	}
+
+	changes, err := deleteChanges(ctx, session, ouDN, dns)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range desired {
+		changes = append(changes, Change{Op: ChangeAdd, DN: entry.DN, Attributes: entry.Attributes})
+	}
+	return changes, nil
+}
+
+// WriteChange writes change to w as an LDIF change record
+func WriteChange(w *ldif.Writer, change Change) error {
+	switch change.Op {
+	case ChangeAdd:
+		return w.WriteAdd(change.DN, change.Attributes)
+	case ChangeModify:
+		return w.WriteModify(change.DN, change.Modifications)
+	case ChangeDelete:
+		return w.WriteDelete(change.DN)
+	}
+	return fmt.Errorf("unknown change %v", change.Op)
+}
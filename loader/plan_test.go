@@ -0,0 +1,84 @@
+package loader
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/imax1000/ldap-import/ldif"
+)
+
+func TestPlan(t *testing.T) {
+	carol := "cn=Carol," + testOUDN
+	phone := "cn=phone," + carol
+	alice := "cn=Alice," + testOUDN
+
+	tests := []struct {
+		name       string
+		treeDelete bool
+		mode       string
+		noNaming   bool
+		want       []string // "op DN"
+	}{
+		{
+			name: "replace",
+			mode: ModeReplace,
+			want: []string{"delete " + phone, "delete " + carol, "add " + alice},
+		},
+		{
+			name:       "replace with Tree Delete",
+			treeDelete: true,
+			mode:       ModeReplace,
+			want:       []string{"delete " + carol, "add " + alice},
+		},
+		{
+			name:     "no naming rule names by cn",
+			mode:     ModeReplace,
+			noNaming: true,
+			want:     []string{"delete " + phone, "delete " + carol, "add " + alice},
+		},
+		{
+			name: "sync",
+			mode: ModeSync,
+			want: []string{"delete " + phone, "delete " + carol, "add " + alice},
+		},
+	}
+
+	naming, err := ParseNamingRule("cn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := []ldif.Entry{person("cn", "Alice", "sn", "Smith", "mail", "alice@example.com")}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := newTestDirectory(t, seedCarol+seedCarolPhone, tt.treeDelete)
+			session := newTestSession(dir)
+			defer session.Close()
+
+			rule := naming
+			if tt.noNaming {
+				rule = nil
+			}
+
+			changes, err := Plan(context.Background(), session, "staff", tt.mode, "mail", rule, entries)
+			if err != nil {
+				t.Fatalf("Plan() error = %v", err)
+			}
+
+			if len(changes) != len(tt.want) {
+				t.Fatalf("Plan() returned %d changes, want %d", len(changes), len(tt.want))
+			}
+			for i, change := range changes {
+				op, dn, _ := strings.Cut(tt.want[i], " ")
+				if change.Op.String() != op || !sameDN(change.DN, dn) {
+					t.Errorf("change %d = %v %s, want %s", i, change.Op, change.DN, tt.want[i])
+				}
+			}
+
+			if got := ouContents(dir); len(got) != 2 {
+				t.Errorf("entries in OU after Plan() = %q, want them unchanged", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package loader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Progress describes how far an operation has got. Total is zero while the
+// operation is in a stage whose size is not known yet.
+type Progress struct {
+	Stage  string
+	Done   int
+	Total  int
+	Failed int
+}
+
+// Fraction returns the part of the stage that is done, from 0 to 1
+func (p Progress) Fraction() float64 {
+	if p.Total == 0 {
+		return 0
+	}
+	return float64(p.Done) / float64(p.Total)
+}
+
+// String formats the progress for display, such as
+// "Adding entries... 120/400 (2 failed)"
+func (p Progress) String() string {
+	if p.Total == 0 {
+		return p.Stage + "..."
+	}
+	s := fmt.Sprintf("%s... %d/%d", p.Stage, p.Done, p.Total)
+	if p.Failed > 0 {
+		s += fmt.Sprintf(" (%d failed)", p.Failed)
+	}
+	return s
+}
+
+// ProgressFunc receives progress reports. Calls never overlap, but they
+// may come from a goroutine other than the one that started the operation.
+// A nil ProgressFunc discards the reports.
+type ProgressFunc func(Progress)
+
+func (f ProgressFunc) stage(stage string) {
+	if f != nil {
+		f(Progress{Stage: stage})
+	}
+}
+
+func (f ProgressFunc) report(p Progress) {
+	if f != nil {
+		f(p)
+	}
+}
+
+// CanceledError is returned when an operation is canceled after it has
+// started making changes. It matches context.Canceled with errors.Is.
+type CanceledError struct {
+	Done  int
+	Total int
+}
+
+func (e *CanceledError) Error() string {
+	if e.Total == 0 {
+		return "canceled before any change was made"
+	}
+	return fmt.Sprintf("canceled after %d of %d", e.Done, e.Total)
+}
+
+func (e *CanceledError) Unwrap() error {
+	return context.Canceled
+}
+
+// canceled returns err as it is if it already tells how far the operation
+// got, and a CanceledError without counts otherwise
+func canceled(err error) error {
+	var canceledErr *CanceledError
+	if errors.As(err, &canceledErr) {
+		return err
+	}
+	return &CanceledError{}
+}
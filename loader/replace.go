@@ -0,0 +1,42 @@
+package loader
+
+import (
+	"context"
+
+	"github.com/imax1000/ldap-import/ldif"
+)
+
+// replaceEntries deletes every entry directly below the target OU,
+// together with anything underneath it, and adds entries in their place.
+// Every new DN is checked before anything is deleted. The deletes and adds
+// run as one batch, so that a cancel tells how far the whole load got.
+func replaceEntries(ctx context.Context, session *Session, targetOU string, naming *NamingRule, entries []ldif.Entry, progress ProgressFunc) error {
+	ouDN, err := TargetOUDN(session.Config, targetOU)
+	if err != nil {
+		return err
+	}
+	desired, err := desiredEntries(ouDN, naming, entries)
+	if err != nil {
+		return err
+	}
+
+	progress.stage("Reading current entries")
+	changes, _, err := planChanges(ctx, session, ouDN, ModeReplace, "", desired)
+	if err != nil {
+		return err
+	}
+
+	_, err = applyChanges(ctx, session, changes, true, progress, "Replacing entries")
+	return err
+}
+
+// addAttributes returns the attributes an entry is created with.
+// inetOrgPerson is always among the object classes, since that is what
+// replaceEntries and syncEntries look for on the next load.
+func addAttributes(entry ldif.Entry) *ldif.AttributeMap {
+	attrs := entry.Attributes.Clone()
+	if !containsFold(attrs.Get("objectClass"), "inetOrgPerson") {
+		attrs.Add("objectClass", "inetOrgPerson")
+	}
+	return attrs
+}
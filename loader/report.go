@@ -0,0 +1,83 @@
+package loader
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/imax1000/ldap-import/ldif"
+)
+
+// EntryError records a change the server rejected
+type EntryError struct {
+	DN         string
+	Op         ChangeOp
+	ResultCode uint16
+	Message    string
+
+	err error
+}
+
+func (e EntryError) Error() string {
+	if e.err != nil {
+		return fmt.Sprintf("failed to %s entry %s: %v", e.Op, e.DN, e.err)
+	}
+	return fmt.Sprintf("failed to %s entry %s: %s", e.Op, e.DN, e.Message)
+}
+
+// ResultName returns the symbolic name of the LDAP result code
+func (e EntryError) ResultName() string {
+	if name, ok := ldap.LDAPResultCodeMap[e.ResultCode]; ok {
+		return name
+	}
+	return "Unknown"
+}
+
+func newEntryError(change Change, err error) EntryError {
+	entryErr := EntryError{DN: change.DN, Op: change.Op, ResultCode: ldap.LDAPResultOther, Message: err.Error(), err: err}
+
+	var ldapErr *ldap.Error
+	if errors.As(err, &ldapErr) {
+		entryErr.ResultCode = ldapErr.ResultCode
+		if ldapErr.Err != nil {
+			entryErr.Message = ldapErr.Err.Error()
+		}
+	}
+	return entryErr
+}
+
+// loadContinueOnError applies every change it can. Changes the server
+// rejects are skipped and returned together with the total number of
+// changes; the error is only set if the load could not run at all.
+func loadContinueOnError(ctx context.Context, session *Session, targetOU, mode, key string, naming *NamingRule, entries []ldif.Entry, progress ProgressFunc) ([]EntryError, int, error) {
+	ouDN, err := TargetOUDN(session.Config, targetOU)
+	if err != nil {
+		return nil, 0, err
+	}
+	desired, failed := nameEntries(ouDN, naming, entries)
+
+	progress.stage("Reading current entries")
+	changes, unmatched, err := planChanges(ctx, session, ouDN, mode, key, desired)
+	if err != nil {
+		return nil, 0, err
+	}
+	failed = append(failed, unmatched...)
+
+	rejected, err := applyChanges(ctx, session, changes, false, progress, "Applying changes")
+	return append(failed, rejected...), len(changes) + len(failed), err
+}
+
+// WriteErrorReportCSV writes the failed entries as CSV with a header row
+func WriteErrorReportCSV(w io.Writer, failed []EntryError) error {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"dn", "operation", "result_code", "result", "message"})
+	for _, e := range failed {
+		writer.Write([]string{e.DN, e.Op.String(), strconv.Itoa(int(e.ResultCode)), e.ResultName(), e.Message})
+	}
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,385 @@
+package loader
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/imax1000/ldap-import/ldif"
+	"github.com/imax1000/ldap-import/loader/loadertest"
+)
+
+// These tests talk to an in-process LDAP server through go-ldap, so that
+// the protocol side of the loader runs as it does against a real server.
+
+// newServerConfig returns the settings for talking to server
+func newServerConfig(server *loadertest.Server) Config {
+	return Config{
+		Host:           server.URL,
+		BindDN:         testAdmin,
+		Password:       "secret",
+		BaseDN:         testBaseDN,
+		ConnectTimeout: 5 * time.Second,
+		RequestTimeout: 5 * time.Second,
+		PageSize:       DefaultPageSize,
+		Workers:        DefaultWorkers,
+		Connections:    DefaultConnections,
+	}
+}
+
+const seedOUs = `dn: ou=sales,ou=abook,dc=example,dc=com
+objectClass: organizationalUnit
+ou: sales
+
+dn: ou=support,ou=abook,dc=example,dc=com
+objectClass: organizationalUnit
+ou: support
+`
+
+func TestListOUsOverLDAP(t *testing.T) {
+	for _, pageSize := range []int{0, 1, 2, DefaultPageSize} {
+		dir := newTestDirectory(t, seedOUs, false)
+		server := loadertest.NewServer(dir)
+		defer server.Close()
+
+		config := newServerConfig(server)
+		config.PageSize = pageSize
+		session := NewSession(config)
+		defer session.Close()
+
+		ous, err := ListOUs(context.Background(), session)
+		if err != nil {
+			t.Fatalf("page size %d: ListOUs() error = %v", pageSize, err)
+		}
+		slices.Sort(ous)
+		if want := []string{"sales", "staff", "support"}; !slices.Equal(ous, want) {
+			t.Errorf("page size %d: ListOUs() = %q, want %q", pageSize, ous, want)
+		}
+	}
+}
+
+func TestLoadOverLDAP(t *testing.T) {
+	alice := person("cn", "Alice", "sn", "Smith", "mail", "alice@example.com", "telephoneNumber", "200")
+	bob := person("cn", "Bob", "sn", "Brown", "mail", "bob@example.com")
+
+	tests := []struct {
+		name       string
+		seed       string
+		treeDelete bool
+		opts       Options
+		wantErr    bool
+		wantDNs    []string
+	}{
+		{
+			name:    "replace",
+			seed:    seedCarol + seedCarolPhone,
+			opts:    Options{Mode: ModeReplace, OnError: OnErrorStop},
+			wantDNs: []string{"cn=Alice," + testOUDN, "cn=Bob," + testOUDN},
+		},
+		{
+			name:       "replace with Tree Delete",
+			seed:       seedCarol + seedCarolPhone,
+			treeDelete: true,
+			opts:       Options{Mode: ModeReplace, OnError: OnErrorStop},
+			wantDNs:    []string{"cn=Alice," + testOUDN, "cn=Bob," + testOUDN},
+		},
+		{
+			name:    "sync",
+			seed:    seedAlice + "\n" + seedCarol,
+			opts:    Options{Mode: ModeSync, Key: "mail", OnError: OnErrorStop},
+			wantDNs: []string{"cn=Alice," + testOUDN, "cn=Bob," + testOUDN},
+		},
+		{
+			name:    "rollback",
+			seed:    seedCarol + "\n" + seedBobDevice,
+			opts:    Options{Mode: ModeReplace, OnError: OnErrorRollback},
+			wantErr: true,
+			wantDNs: []string{"cn=Bob," + testOUDN, "cn=Carol," + testOUDN},
+		},
+	}
+
+	naming, err := ParseNamingRule("cn")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("XDG_DATA_HOME", t.TempDir())
+
+			dir := newTestDirectory(t, tt.seed, tt.treeDelete)
+			server := loadertest.NewServer(dir)
+			defer server.Close()
+
+			// Small pages and two connections, so that paging and the
+			// worker pool are used
+			config := newServerConfig(server)
+			config.PageSize = 1
+			config.Connections = 2
+			session := NewSession(config)
+			defer session.Close()
+
+			opts := tt.opts
+			opts.TargetOU = "staff"
+			opts.Naming = naming
+			result, err := Load(context.Background(), session, opts, []ldif.Entry{alice, bob}, nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Load() error = %v, want error %v", err, tt.wantErr)
+			}
+
+			if got := ouContents(dir); !slices.Equal(got, tt.wantDNs) {
+				t.Errorf("entries in OU = %q, want %q", got, tt.wantDNs)
+			}
+
+			// The backup holds the OU as it was before the load
+			if _, err := os.Stat(result.BackupFile); err != nil {
+				t.Errorf("backup file: %v", err)
+			}
+		})
+	}
+}
+
+func TestTLS(t *testing.T) {
+	tests := []struct {
+		name     string
+		ldaps    bool
+		security string
+		withCA   bool
+		insecure bool
+		wantErr  bool
+	}{
+		{name: "StartTLS", security: SecurityStartTLS, withCA: true},
+		{name: "StartTLS with unknown CA", security: SecurityStartTLS, wantErr: true},
+		{name: "StartTLS without verification", security: SecurityStartTLS, insecure: true},
+		{name: "LDAPS", ldaps: true, security: SecurityLDAPS, withCA: true},
+		{name: "LDAPS with unknown CA", ldaps: true, security: SecurityLDAPS, wantErr: true},
+		{name: "LDAPS without verification", ldaps: true, security: SecurityLDAPS, insecure: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := newTestDirectory(t, seedOUs, false)
+			var server *loadertest.Server
+			if tt.ldaps {
+				server = loadertest.NewTLSServer(dir)
+			} else {
+				server = loadertest.NewServer(dir)
+			}
+			defer server.Close()
+
+			config := newServerConfig(server)
+			config.Security = tt.security
+			config.InsecureSkipVerify = tt.insecure
+			if tt.withCA {
+				config.CAFile = filepath.Join(t.TempDir(), "ca.pem")
+				if err := os.WriteFile(config.CAFile, server.CertificatePEM(), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			session := NewSession(config)
+			defer session.Close()
+
+			ous, err := ListOUs(context.Background(), session)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ListOUs() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && len(ous) != 3 {
+				t.Errorf("ListOUs() = %q, want 3 OUs", ous)
+			}
+		})
+	}
+}
+
+func TestSessionOverLDAP(t *testing.T) {
+	dir := newTestDirectory(t, seedOUs, false)
+	server := loadertest.NewServer(dir)
+	defer server.Close()
+
+	t.Run("wrong password", func(t *testing.T) {
+		config := newServerConfig(server)
+		config.Password = "wrong"
+		session := NewSession(config)
+		defer session.Close()
+
+		_, err := session.Search(context.Background(), ldap.NewSearchRequest(testBaseDN,
+			ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false, "(objectClass=*)", nil, nil))
+		if !ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			t.Errorf("Search() error = %v, want invalid credentials", err)
+		}
+	})
+
+	t.Run("reconnect", func(t *testing.T) {
+		session := NewSession(newServerConfig(server))
+		defer session.Close()
+
+		if _, err := ListOUs(context.Background(), session); err != nil {
+			t.Fatalf("ListOUs() error = %v", err)
+		}
+
+		// A dropped connection is replaced without the caller noticing
+		server.CloseConnections()
+		ous, err := ListOUs(context.Background(), session)
+		if err != nil {
+			t.Fatalf("ListOUs() after the connection dropped: %v", err)
+		}
+		if len(ous) != 3 {
+			t.Errorf("ListOUs() = %q, want 3 OUs", ous)
+		}
+	})
+}
+
+func TestBindMechanisms(t *testing.T) {
+	const (
+		noCert      = ""
+		serverCert  = "server"
+		foreignCert = "foreign"
+	)
+
+	tests := []struct {
+		name      string
+		mechanism string
+		bindDN    string
+		password  string
+		cert      string
+
+		wantCode  uint16 // of the first search, zero for success
+		wantWrite bool
+	}{
+		{name: "anonymous reads but cannot write", mechanism: BindAnonymous},
+		{name: "EXTERNAL", mechanism: BindExternal, cert: serverCert, wantWrite: true},
+		{name: "EXTERNAL with a foreign certificate", mechanism: BindExternal, cert: foreignCert, wantCode: ldap.LDAPResultInvalidCredentials},
+		{name: "NTLM", mechanism: BindNTLM, bindDN: `EXAMPLE\admin`, password: "secret", wantWrite: true},
+		{name: "NTLM with wrong password", mechanism: BindNTLM, bindDN: `EXAMPLE\admin`, password: "wrong", wantCode: ldap.LDAPResultInvalidCredentials},
+		{name: "NTLM with unknown user", mechanism: BindNTLM, bindDN: `EXAMPLE\nobody`, password: "secret", wantCode: ldap.LDAPResultInvalidCredentials},
+		{name: "DIGEST-MD5", mechanism: BindDigestMD5, bindDN: "admin", password: "secret", wantWrite: true},
+		{name: "DIGEST-MD5 with wrong password", mechanism: BindDigestMD5, bindDN: "admin", password: "wrong", wantCode: ldap.LDAPResultInvalidCredentials},
+		{name: "DIGEST-MD5 with unknown user", mechanism: BindDigestMD5, bindDN: "nobody", password: "secret", wantCode: ldap.LDAPResultInvalidCredentials},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := newTestDirectory(t, seedOUs, false)
+			dir.SetPassword("admin", "secret")
+			server := loadertest.NewServer(dir)
+			defer server.Close()
+
+			config := newServerConfig(server)
+			config.BindMechanism = tt.mechanism
+			config.BindDN = tt.bindDN
+			config.Password = tt.password
+
+			if tt.cert != noCert {
+				issuer := server
+				if tt.cert == foreignCert {
+					issuer = loadertest.NewServer(loadertest.NewDirectory())
+					defer issuer.Close()
+				}
+				certPEM, keyPEM := issuer.ClientCertificate("importer")
+
+				tmp := t.TempDir()
+				config.Security = SecurityStartTLS
+				config.CAFile = filepath.Join(tmp, "ca.pem")
+				config.CertFile = filepath.Join(tmp, "client.pem")
+				config.KeyFile = filepath.Join(tmp, "client.key")
+				for file, data := range map[string][]byte{config.CAFile: server.CertificatePEM(), config.CertFile: certPEM, config.KeyFile: keyPEM} {
+					if err := os.WriteFile(file, data, 0o600); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+
+			session := NewSession(config)
+			defer session.Close()
+
+			_, err := session.Search(context.Background(), ldap.NewSearchRequest(testBaseDN,
+				ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false, "(objectClass=*)", nil, nil))
+			if tt.wantCode != 0 {
+				if !ldap.IsErrorWithCode(err, tt.wantCode) {
+					t.Fatalf("Search() error = %v, want result code %d", err, tt.wantCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Search() error = %v", err)
+			}
+
+			request := ldap.NewAddRequest("ou=new,ou=abook,"+testBaseDN, nil)
+			request.Attribute("objectClass", []string{"organizationalUnit"})
+			request.Attribute("ou", []string{"new"})
+			err = session.Add(context.Background(), request)
+			switch {
+			case tt.wantWrite && err != nil:
+				t.Errorf("Add() error = %v", err)
+			case !tt.wantWrite && !ldap.IsErrorWithCode(err, ldap.LDAPResultInsufficientAccessRights):
+				t.Errorf("Add() error = %v, want insufficient access", err)
+			}
+		})
+	}
+}
+
+func TestWorkerTimeoutOverLDAP(t *testing.T) {
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+
+	dir := newTestDirectory(t, seedCarol, false)
+	server := loadertest.NewServer(dir)
+	defer server.Close()
+
+	// One connection shared by four workers; the add of Dave gets no
+	// answer while the other adds go back and forth on the same connection
+	config := newServerConfig(server)
+	config.RequestTimeout = 200 * time.Millisecond
+	config.Retries = DefaultRetries
+	session := NewSession(config)
+	defer session.Close()
+	var dials atomic.Int32
+	session.Dial = func(ctx context.Context, config Config) (Client, error) {
+		dials.Add(1)
+		conn, err := ldap.DialURL(server.URL)
+		if err != nil {
+			return nil, err
+		}
+		conn.SetTimeout(config.RequestTimeout)
+		return conn, nil
+	}
+
+	const dave = "cn=Dave," + testOUDN
+	dir.InjectFault(loadertest.Fault{Op: "add", DN: dave, Err: errTimeout, Applied: true, Times: 1})
+
+	var entries []ldif.Entry
+	var want []string
+	for _, name := range []string{"Alice", "Bob", "Dave", "Eve", "Frank", "Grace", "Heidi", "Ivan"} {
+		entries = append(entries, person("cn", name, "sn", name))
+		want = append(want, "cn="+name+","+testOUDN)
+	}
+	naming, err := ParseNamingRule("cn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{Mode: ModeReplace, OnError: OnErrorContinue, TargetOU: "staff", Naming: naming}
+	result, err := Load(context.Background(), session, opts, entries, nil)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	// Only the add that timed out is reported, as not known to have
+	// happened rather than as a duplicate from sending it again
+	if len(result.Failed) != 1 {
+		t.Fatalf("failed entries = %v, want only %s", result.Failed, dave)
+	}
+	if failed := result.Failed[0]; !strings.EqualFold(failed.DN, dave) || !strings.Contains(failed.Message, ErrOutcomeUnknown.Error()) {
+		t.Errorf("failed entry = %v, want %s with an unknown outcome", failed, dave)
+	}
+
+	if got := ouContents(dir); !slices.Equal(got, want) {
+		t.Errorf("entries in OU = %q, want %q", got, want)
+	}
+	if n := dials.Load(); n != 1 {
+		t.Errorf("opened %d connections, want the one connection kept", n)
+	}
+}
@@ -0,0 +1,321 @@
+package loader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// maxRetryDelay caps the backoff between retries
+const maxRetryDelay = 30 * time.Second
+
+// retryBaseDelay is the wait before the first retry
+var retryBaseDelay = time.Second
+
+// Session is one authenticated connection shared by all operations of a
+// load. It connects on first use, so that everything that can be checked
+// locally is checked before the server is contacted. When the connection
+// drops, for example after the server's idle timeout, the session
+// reconnects and binds again. A read that was in flight is retried; a
+// write is only sent again if it never left, since the server may have
+// carried it out already.
+type Session struct {
+	Config Config
+
+	// OnRetry, if set, is called before waiting to retry an operation
+	OnRetry func(attempt, retries int, delay time.Duration, err error)
+
+	// Dial, if set, opens connections in place of the network dialer. The
+	// session binds them with Config.BindDN and Config.Password.
+	Dial func(ctx context.Context, config Config) (Client, error)
+
+	mu   sync.Mutex
+	conn Client
+}
+
+// NewSession returns a session for config without connecting yet
+func NewSession(config Config) *Session {
+	return &Session{Config: config}
+}
+
+// Close closes the connection, if one is open
+func (s *Session) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+// Search runs a search request
+func (s *Session) Search(ctx context.Context, request *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	var result *ldap.SearchResult
+	err := s.do(ctx, false, func(conn Client) error {
+		var err error
+		result, err = conn.Search(request)
+		return err
+	})
+	return result, err
+}
+
+// SearchPaged runs a search request with the Simple Paged Results control
+// (RFC 2696), so that results beyond the server's size limit are returned
+// too. With a page size of zero it is a plain search.
+func (s *Session) SearchPaged(ctx context.Context, request *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	if s.Config.PageSize <= 0 {
+		return s.Search(ctx, request)
+	}
+
+	var result *ldap.SearchResult
+	err := s.do(ctx, false, func(conn Client) error {
+		// SearchWithPaging keeps its cookie in the request's controls, so
+		// every attempt starts over with a copy
+		paged := *request
+		paged.Controls = append([]ldap.Control(nil), request.Controls...)
+
+		pager, ok := conn.(pagedSearcher)
+		if !ok {
+			var err error
+			result, err = conn.Search(&paged)
+			return err
+		}
+
+		var err error
+		result, err = pager.SearchWithPaging(&paged, uint32(s.Config.PageSize))
+		return err
+	})
+	return result, err
+}
+
+// Add runs an add request
+func (s *Session) Add(ctx context.Context, request *ldap.AddRequest) error {
+	return s.do(ctx, true, func(conn Client) error {
+		return conn.Add(request)
+	})
+}
+
+// Modify runs a modify request
+func (s *Session) Modify(ctx context.Context, request *ldap.ModifyRequest) error {
+	return s.do(ctx, true, func(conn Client) error {
+		return conn.Modify(request)
+	})
+}
+
+// Del runs a delete request
+func (s *Session) Del(ctx context.Context, request *ldap.DelRequest) error {
+	return s.do(ctx, true, func(conn Client) error {
+		return conn.Del(request)
+	})
+}
+
+// Extended runs an extended operation
+func (s *Session) Extended(ctx context.Context, request *ldap.ExtendedRequest) (*ldap.ExtendedResponse, error) {
+	var response *ldap.ExtendedResponse
+	err := s.do(ctx, true, func(conn Client) error {
+		ext, ok := conn.(extender)
+		if !ok {
+			return errNoExtendedOperations
+		}
+
+		var err error
+		response, err = ext.Extended(request)
+		return err
+	})
+	return response, err
+}
+
+// do runs op on the connection, opening it first if needed. A read whose
+// connection dropped is run again straight away on a new one; transient
+// errors are retried up to Config.Retries times with exponential backoff.
+//
+// A write (or extended operation) is not sent again once it has gone out
+// without an answer, because it timed out or the connection dropped: the
+// server may have carried it out, and adds, deletes and most modifies fail
+// when repeated. Its error matches ErrOutcomeUnknown instead. A write is
+// only retried when it is known not to have been carried out: the server
+// turned it down as busy or unavailable, or it was never sent.
+//
+// When ctx is canceled while op is in flight, the connection is closed,
+// since go-ldap has no other way to abort a request, and ctx.Err() is
+// returned. The next operation opens a new connection.
+func (s *Session) do(ctx context.Context, write bool, op func(conn Client) error) error {
+	reconnected := false
+	for attempt := 0; ; {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		conn, err := s.get(ctx)
+		retry := isTransient
+		if err == nil {
+			if write {
+				retry = isRefused
+			}
+			stop := context.AfterFunc(ctx, func() { s.drop(conn) })
+			err = op(conn)
+			stop()
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err == nil {
+				return nil
+			}
+
+			lost := isConnectionLost(conn, err)
+			if lost {
+				s.drop(conn)
+			}
+			if write && ldap.IsErrorWithCode(err, ldap.ErrorNetwork) && !notSent(err) {
+				return outcomeUnknown(err)
+			}
+			if lost && !reconnected {
+				reconnected = true
+				continue
+			}
+		}
+
+		if attempt >= s.Config.Retries || !retry(err) {
+			return err
+		}
+		attempt++
+
+		delay := retryDelay(attempt)
+		if s.OnRetry != nil {
+			s.OnRetry(attempt, s.Config.Retries, delay, err)
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// get returns the open connection, connecting and binding if there is
+// none or the one there has been closed
+func (s *Session) get(ctx context.Context) (Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn != nil && isClosing(s.conn) {
+		s.conn.Close()
+		s.conn = nil
+	}
+	if s.conn == nil {
+		conn, err := s.open(ctx)
+		if err != nil {
+			return nil, err
+		}
+		s.conn = conn
+	}
+	return s.conn, nil
+}
+
+// open connects and binds, through Dial if it is set
+func (s *Session) open(ctx context.Context) (Client, error) {
+	if s.Dial == nil {
+		return connect(ctx, s.Config)
+	}
+
+	conn, err := s.Dial(ctx, s.Config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to LDAP server: %w", err)
+	}
+	if err := conn.Bind(s.Config.BindDN, s.Config.Password); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to bind to LDAP server: %w", err)
+	}
+	return conn, nil
+}
+
+// drop closes a lost connection so that the next operation opens a new
+// one. If another operation has already replaced it, nothing is done.
+func (s *Session) drop(lost Client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == lost {
+		lost.Close()
+		s.conn = nil
+	}
+}
+
+// ErrOutcomeUnknown is matched by the error of a write that went out but
+// got no answer, because it timed out or the connection dropped. Whether
+// the server carried it out is not known.
+var ErrOutcomeUnknown = errors.New("outcome unknown, the server may have made the change")
+
+// outcomeUnknown marks the error of an unanswered write with
+// ErrOutcomeUnknown, keeping its result code
+func outcomeUnknown(err error) error {
+	var ldapErr *ldap.Error
+	if errors.As(err, &ldapErr) {
+		return ldap.NewError(ldapErr.ResultCode, fmt.Errorf("%w: %v", ErrOutcomeUnknown, ldapErr.Err))
+	}
+	return fmt.Errorf("%w: %v", ErrOutcomeUnknown, err)
+}
+
+// notSent reports whether a request failed because the connection was
+// already closed, before anything was written to it. go-ldap has only the
+// message to tell this apart from a request lost on the way.
+func notSent(err error) bool {
+	var ldapErr *ldap.Error
+	return errors.As(err, &ldapErr) && ldapErr.ResultCode == ldap.ErrorNetwork &&
+		ldapErr.Err != nil && ldapErr.Err.Error() == "ldap: connection closed"
+}
+
+// isConnectionLost reports whether err means the connection itself is
+// gone rather than the server rejecting the request. A request timeout
+// does not count: go-ldap keeps the connection open for the other
+// requests on it. Clients that cannot report that they are closing count
+// every network error as a lost connection.
+func isConnectionLost(conn Client, err error) bool {
+	if _, ok := conn.(closingReporter); ok {
+		return isClosing(conn)
+	}
+	return ldap.IsErrorWithCode(err, ldap.ErrorNetwork)
+}
+
+// isClosing reports whether conn is known to be closed
+func isClosing(conn Client) bool {
+	c, ok := conn.(closingReporter)
+	return ok && c.IsClosing()
+}
+
+// isTransient reports whether an operation that failed with err may
+// succeed when tried again later
+func isTransient(err error) bool {
+	return ldap.IsErrorAnyOf(err,
+		ldap.ErrorNetwork,
+		ldap.LDAPResultBusy,
+		ldap.LDAPResultUnavailable,
+		ldap.LDAPResultTimeLimitExceeded,
+		ldap.LDAPResultServerDown,
+		ldap.LDAPResultTimeout,
+	)
+}
+
+// isRefused reports whether a write that failed with err was turned down
+// without being carried out, so that sending it again cannot apply it twice
+func isRefused(err error) bool {
+	return notSent(err) || ldap.IsErrorAnyOf(err,
+		ldap.LDAPResultBusy,
+		ldap.LDAPResultUnavailable,
+	)
+}
+
+// retryDelay returns how long to wait before the given retry:
+// retryBaseDelay, doubling with every attempt up to maxRetryDelay
+func retryDelay(attempt int) time.Duration {
+	delay := retryBaseDelay
+	for i := 1; i < attempt && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, maxRetryDelay)
+}
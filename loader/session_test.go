@@ -0,0 +1,303 @@
+package loader
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/imax1000/ldap-import/loader/loadertest"
+)
+
+// errTimeout is how go-ldap reports a request that got no answer in time
+var errTimeout = ldap.NewError(ldap.ErrorNetwork, errors.New("ldap: connection timed out"))
+
+// newCountingSession returns a session that talks to dir and counts the
+// connections it opens
+func newCountingSession(dir *loadertest.Directory) (*Session, *atomic.Int32) {
+	session := newTestSession(dir)
+	session.Config.Retries = DefaultRetries
+	dials := new(atomic.Int32)
+	session.Dial = func(ctx context.Context, config Config) (Client, error) {
+		dials.Add(1)
+		return dir.Client(), nil
+	}
+	return session, dials
+}
+
+// writes are one write of every kind against seedCarol
+var writes = []struct {
+	op  string
+	dn  string
+	run func(ctx context.Context, session *Session) error
+}{
+	{
+		op: "add",
+		dn: "cn=Alice," + testOUDN,
+		run: func(ctx context.Context, session *Session) error {
+			request := ldap.NewAddRequest("cn=Alice,"+testOUDN, nil)
+			request.Attribute("objectClass", []string{"inetOrgPerson"})
+			request.Attribute("cn", []string{"Alice"})
+			request.Attribute("sn", []string{"Smith"})
+			return session.Add(ctx, request)
+		},
+	},
+	{
+		op: "modify",
+		dn: "cn=Carol," + testOUDN,
+		run: func(ctx context.Context, session *Session) error {
+			request := ldap.NewModifyRequest("cn=Carol,"+testOUDN, nil)
+			request.Add("telephoneNumber", []string{"300"})
+			return session.Modify(ctx, request)
+		},
+	},
+	{
+		op: "delete",
+		dn: "cn=Carol," + testOUDN,
+		run: func(ctx context.Context, session *Session) error {
+			return session.Del(ctx, ldap.NewDelRequest("cn=Carol,"+testOUDN, nil))
+		},
+	},
+}
+
+func TestSessionUnansweredWrite(t *testing.T) {
+	for _, write := range writes {
+		for _, applied := range []bool{false, true} {
+			name := write.op
+			if applied {
+				name += " applied"
+			}
+			t.Run(name, func(t *testing.T) {
+				dir := newTestDirectory(t, seedCarol, false)
+				session, dials := newCountingSession(dir)
+				defer session.Close()
+				before := dump(dir)
+
+				dir.InjectFault(loadertest.Fault{Op: write.op, DN: write.dn, Err: errTimeout, Applied: applied, Times: 1})
+				err := write.run(context.Background(), session)
+				if !errors.Is(err, ErrOutcomeUnknown) {
+					t.Fatalf("%s error = %v, want ErrOutcomeUnknown", write.op, err)
+				}
+				if !ldap.IsErrorWithCode(err, ldap.ErrorNetwork) {
+					t.Errorf("%s error = %v, want the network error code kept", write.op, err)
+				}
+
+				// Sent once, and the change is there exactly when the
+				// server made it
+				if changed := !maps.Equal(dump(dir), before); changed != applied {
+					t.Errorf("directory changed = %v, want %v", changed, applied)
+				}
+
+				// The timeout leaves the connection in use
+				if _, err := ListOUs(context.Background(), session); err != nil {
+					t.Fatalf("ListOUs() error = %v", err)
+				}
+				if n := dials.Load(); n != 1 {
+					t.Errorf("opened %d connections, want 1", n)
+				}
+			})
+		}
+	}
+}
+
+func TestSessionWritesAfterConnectionClosed(t *testing.T) {
+	for _, write := range writes {
+		t.Run(write.op, func(t *testing.T) {
+			dir := newTestDirectory(t, seedCarol, false)
+			session, dials := newCountingSession(dir)
+			defer session.Close()
+
+			var conn Client
+			session.Dial = func(ctx context.Context, config Config) (Client, error) {
+				dials.Add(1)
+				conn = dir.Client()
+				return conn, nil
+			}
+			if _, err := ListOUs(context.Background(), session); err != nil {
+				t.Fatalf("ListOUs() error = %v", err)
+			}
+
+			// A connection known to be closed is replaced before the write
+			// goes out, so the write is sent as usual
+			conn.Close()
+			if err := write.run(context.Background(), session); err != nil {
+				t.Fatalf("%s error = %v", write.op, err)
+			}
+			if n := dials.Load(); n != 2 {
+				t.Errorf("opened %d connections, want 2", n)
+			}
+		})
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{attempt: 1, want: time.Second},
+		{attempt: 2, want: 2 * time.Second},
+		{attempt: 3, want: 4 * time.Second},
+		{attempt: 5, want: 16 * time.Second},
+		{attempt: 6, want: maxRetryDelay},
+		{attempt: 100, want: maxRetryDelay},
+	}
+
+	for _, tt := range tests {
+		if got := retryDelay(tt.attempt); got != tt.want {
+			t.Errorf("retryDelay(%d) = %v, want %v", tt.attempt, got, tt.want)
+		}
+	}
+}
+
+func TestRetryClassification(t *testing.T) {
+	tests := []struct {
+		name          string
+		err           error
+		wantTransient bool
+		wantRefused   bool
+	}{
+		{
+			name:          "busy",
+			err:           ldap.NewError(ldap.LDAPResultBusy, errors.New("busy")),
+			wantTransient: true,
+			wantRefused:   true,
+		},
+		{
+			name:          "unavailable",
+			err:           ldap.NewError(ldap.LDAPResultUnavailable, errors.New("unavailable")),
+			wantTransient: true,
+			wantRefused:   true,
+		},
+		{
+			name:          "connection closed before sending",
+			err:           ldap.NewError(ldap.ErrorNetwork, errors.New("ldap: connection closed")),
+			wantTransient: true,
+			wantRefused:   true,
+		},
+		{
+			name:          "timed out",
+			err:           errTimeout,
+			wantTransient: true,
+		},
+		{
+			name:          "response channel closed",
+			err:           ldap.NewError(ldap.ErrorNetwork, errors.New("ldap: response channel closed")),
+			wantTransient: true,
+		},
+		{
+			name:          "time limit exceeded",
+			err:           ldap.NewError(ldap.LDAPResultTimeLimitExceeded, errors.New("time limit")),
+			wantTransient: true,
+		},
+		{
+			name: "already exists",
+			err:  ldap.NewError(ldap.LDAPResultEntryAlreadyExists, errors.New("exists")),
+		},
+		{
+			name: "unwilling to perform",
+			err:  ldap.NewError(ldap.LDAPResultUnwillingToPerform, errors.New("unwilling")),
+		},
+		{
+			name: "not an LDAP error",
+			err:  errors.New("something else"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isTransient(tt.err); got != tt.wantTransient {
+				t.Errorf("isTransient() = %v, want %v", got, tt.wantTransient)
+			}
+			if got := isRefused(tt.err); got != tt.wantRefused {
+				t.Errorf("isRefused() = %v, want %v", got, tt.wantRefused)
+			}
+		})
+	}
+}
+
+func TestSessionRetriesWrites(t *testing.T) {
+	defer func(delay time.Duration) { retryBaseDelay = delay }(retryBaseDelay)
+	retryBaseDelay = time.Millisecond
+
+	busy := ldap.NewError(ldap.LDAPResultBusy, errors.New("server busy"))
+	tests := []struct {
+		name      string
+		err       error
+		times     int
+		wantCode  uint16 // zero for success
+		wantTries []int
+	}{
+		{
+			name:      "busy once",
+			err:       busy,
+			times:     1,
+			wantTries: []int{1},
+		},
+		{
+			name:      "busy up to the last retry",
+			err:       busy,
+			times:     DefaultRetries,
+			wantTries: []int{1, 2, 3},
+		},
+		{
+			name:      "busy beyond the retries",
+			err:       busy,
+			times:     DefaultRetries + 1,
+			wantCode:  ldap.LDAPResultBusy,
+			wantTries: []int{1, 2, 3},
+		},
+		{
+			name:     "not retried",
+			err:      ldap.NewError(ldap.LDAPResultUnwillingToPerform, errors.New("unwilling")),
+			times:    1,
+			wantCode: ldap.LDAPResultUnwillingToPerform,
+		},
+	}
+
+	for _, write := range writes {
+		for _, tt := range tests {
+			t.Run(write.op+" "+tt.name, func(t *testing.T) {
+				dir := newTestDirectory(t, seedCarol, false)
+				session, _ := newCountingSession(dir)
+				defer session.Close()
+				before := dump(dir)
+
+				var tries []int
+				session.OnRetry = func(attempt, retries int, delay time.Duration, err error) {
+					if retries != DefaultRetries {
+						t.Errorf("OnRetry() retries = %d, want %d", retries, DefaultRetries)
+					}
+					if want := retryDelay(attempt); delay != want {
+						t.Errorf("OnRetry() delay = %v, want %v", delay, want)
+					}
+					if !errors.Is(err, tt.err) {
+						t.Errorf("OnRetry() error = %v, want %v", err, tt.err)
+					}
+					tries = append(tries, attempt)
+				}
+
+				dir.InjectFault(loadertest.Fault{Op: write.op, DN: write.dn, Err: tt.err, Times: tt.times})
+				err := write.run(context.Background(), session)
+				if tt.wantCode == 0 && err != nil {
+					t.Fatalf("%s error = %v", write.op, err)
+				}
+				if tt.wantCode != 0 && !ldap.IsErrorWithCode(err, tt.wantCode) {
+					t.Fatalf("%s error = %v, want %s", write.op, err, ldap.LDAPResultCodeMap[tt.wantCode])
+				}
+				if !slices.Equal(tries, tt.wantTries) {
+					t.Errorf("retries = %v, want %v", tries, tt.wantTries)
+				}
+
+				// A refused write is carried out once it gets through
+				if changed := !maps.Equal(dump(dir), before); changed != (tt.wantCode == 0) {
+					t.Errorf("directory changed = %v, want %v", changed, tt.wantCode == 0)
+				}
+			})
+		}
+	}
+}
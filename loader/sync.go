@@ -0,0 +1,358 @@
+package loader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/imax1000/ldap-import/ldif"
+)
+
+// SyncKeys lists the attributes that can match file entries to the entries
+// already in the directory
+var SyncKeys = []string{"mail", "employeeNumber", "cn"}
+
+// ChangeOp is the kind of write a Change performs
+type ChangeOp int
+
+const (
+	ChangeAdd ChangeOp = iota
+	ChangeModify
+	ChangeDelete
+)
+
+func (op ChangeOp) String() string {
+	switch op {
+	case ChangeAdd:
+		return "add"
+	case ChangeModify:
+		return "modify"
+	case ChangeDelete:
+		return "delete"
+	}
+	return fmt.Sprintf("ChangeOp(%d)", int(op))
+}
+
+// Change is a single write against the directory. Attributes is the full
+// entry for ChangeAdd, Modifications the attribute-level changes for
+// ChangeModify.
+type Change struct {
+	Op            ChangeOp
+	DN            string
+	Attributes    *ldif.AttributeMap
+	Modifications []ldif.Modification
+
+	// Controls are sent with this change in addition to those passed to
+	// applyChange
+	Controls []ldap.Control
+}
+
+// syncEntries brings the target OU in line with entries, touching only the
+// entries that actually differ
+func syncEntries(ctx context.Context, session *Session, targetOU, key string, naming *NamingRule, entries []ldif.Entry, progress ProgressFunc) error {
+	ouDN, err := TargetOUDN(session.Config, targetOU)
+	if err != nil {
+		return err
+	}
+	desired, err := desiredEntries(ouDN, naming, entries)
+	if err != nil {
+		return err
+	}
+
+	progress.stage("Reading current entries")
+	changes, failed, err := planChanges(ctx, session, ouDN, ModeSync, key, desired)
+	if err != nil {
+		return err
+	}
+	if len(failed) > 0 {
+		return unmatchedError(failed, len(desired), key)
+	}
+
+	_, err = applyChanges(ctx, session, changes, true, progress, "Synchronizing entries")
+	return err
+}
+
+// searchOUEntries returns every inetOrgPerson directly below baseDN with
+// all of its user attributes
+func searchOUEntries(ctx context.Context, session *Session, baseDN string) ([]ldif.Entry, error) {
+	searchRequest := ldap.NewSearchRequest(
+		baseDN,
+		ldap.ScopeSingleLevel, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=inetOrgPerson)",
+		[]string{"*"},
+		nil,
+	)
+
+	result, err := session.SearchPaged(ctx, searchRequest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search entries: %v", err)
+	}
+
+	entries := make([]ldif.Entry, 0, len(result.Entries))
+	for _, e := range result.Entries {
+		entries = append(entries, entryFromLDAP(e))
+	}
+	return entries, nil
+}
+
+func entryFromLDAP(e *ldap.Entry) ldif.Entry {
+	entry := ldif.Entry{DN: e.DN, Attributes: ldif.NewAttributeMap()}
+	for _, attr := range e.Attributes {
+		name, _ := ldif.CanonicalAttributeName(attr.Name)
+		entry.Attributes.Add(name, attr.Values...)
+	}
+	return entry
+}
+
+// desiredEntries returns the entries as they are created below ouDN. Every
+// DN is built and validated here, so that a bad record or two entries
+// with the same name are reported before anything is sent to the server.
+func desiredEntries(ouDN string, naming *NamingRule, entries []ldif.Entry) ([]ldif.Entry, error) {
+	desired, failed := nameEntries(ouDN, naming, entries)
+	if len(failed) > 0 {
+		return nil, fmt.Errorf("%d of %d entries cannot be named: %w", len(failed), len(entries), joinEntryErrors(failed))
+	}
+	return desired, nil
+}
+
+// unmatchedError is the error for entries diffEntries could not match on
+// key, for the load modes that stop at the first bad entry
+func unmatchedError(failed []EntryError, total int, key string) error {
+	return fmt.Errorf("%d of %d entries cannot be matched on %s: %w", len(failed), total, key, joinEntryErrors(failed))
+}
+
+// joinEntryErrors lists failed entries as one error
+func joinEntryErrors(failed []EntryError) error {
+	errs := make([]error, 0, len(failed))
+	for _, f := range failed {
+		errs = append(errs, fmt.Errorf("%s: %s", f.DN, f.Message))
+	}
+	return errors.Join(errs...)
+}
+
+// nameEntries builds the DN of every entry below ouDN. Entries that cannot
+// be named, or whose DN is already taken by an earlier entry, are returned
+// as failures, keyed by their DN in the file.
+func nameEntries(ouDN string, naming *NamingRule, entries []ldif.Entry) ([]ldif.Entry, []EntryError) {
+	desired := make([]ldif.Entry, 0, len(entries))
+	var failed []EntryError
+	taken := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		attrs := addAttributes(entry)
+		dn, values, err := entryDN(ouDN, naming, attrs)
+		if err != nil {
+			failed = append(failed, EntryError{
+				DN:         entry.DN,
+				Op:         ChangeAdd,
+				ResultCode: ldap.LDAPResultInvalidDNSyntax,
+				Message:    err.Error(),
+			})
+			continue
+		}
+
+		if other, ok := taken[normalizeDN(dn)]; ok {
+			failed = append(failed, EntryError{
+				DN:         entry.DN,
+				Op:         ChangeAdd,
+				ResultCode: ldap.LDAPResultEntryAlreadyExists,
+				Message:    fmt.Sprintf("DN %s is already used by %s", dn, other),
+			})
+			continue
+		}
+		taken[normalizeDN(dn)] = entry.DN
+
+		// The server requires the naming values to be present in the entry
+		for _, value := range values {
+			attrs.Add(value.Name, value.Values...)
+		}
+		desired = append(desired, ldif.Entry{DN: dn, Attributes: attrs})
+	}
+	return desired, failed
+}
+
+// diffEntries computes the changes that turn current into desired. Entries
+// are matched on the first value of key. A matched entry whose DN changed
+// is deleted and added again; everything else is modified in place so that
+// entryUUID and friends survive. Deletes remove anything below the entry
+// too and come first, so that a renamed entry can take over a freed DN,
+// followed by modifies and adds.
+//
+// Entries without key, or with the same value as an earlier entry, are
+// returned as failures and left out. The entry in the directory with the
+// DN of a failed entry is left alone rather than deleted.
+func diffEntries(ctx context.Context, session *Session, ouDN string, current, desired []ldif.Entry, key string) ([]Change, []EntryError, error) {
+	wanted := make(map[string]ldif.Entry, len(desired))
+	var failed []EntryError
+	skipped := make(map[string]bool)
+	for _, entry := range desired {
+		value := strings.ToLower(entry.Attributes.First(key))
+		if value == "" {
+			failed = append(failed, EntryError{
+				DN:         entry.DN,
+				Op:         ChangeAdd,
+				ResultCode: ldap.LDAPResultObjectClassViolation,
+				Message:    fmt.Sprintf("entry has no %s to match on", key),
+			})
+			skipped[normalizeDN(entry.DN)] = true
+			continue
+		}
+		if other, exists := wanted[value]; exists {
+			failed = append(failed, EntryError{
+				DN:         entry.DN,
+				Op:         ChangeAdd,
+				ResultCode: ldap.LDAPResultConstraintViolation,
+				Message:    fmt.Sprintf("%s %q is already used by %s", key, value, other.DN),
+			})
+			skipped[normalizeDN(entry.DN)] = true
+			continue
+		}
+		wanted[value] = entry
+	}
+
+	var deleted []string
+	var modifies, adds []Change
+	matched := make(map[string]bool, len(current))
+	for _, entry := range current {
+		value := strings.ToLower(entry.Attributes.First(key))
+		target, exists := wanted[value]
+		if value == "" || !exists || matched[value] {
+			if !skipped[normalizeDN(entry.DN)] {
+				deleted = append(deleted, entry.DN)
+			}
+			continue
+		}
+		matched[value] = true
+
+		if !sameDN(entry.DN, target.DN) {
+			deleted = append(deleted, entry.DN)
+			adds = append(adds, Change{Op: ChangeAdd, DN: target.DN, Attributes: target.Attributes})
+			continue
+		}
+
+		if mods := diffAttributes(entry.Attributes, target.Attributes); len(mods) > 0 {
+			modifies = append(modifies, Change{Op: ChangeModify, DN: entry.DN, Modifications: mods})
+		}
+	}
+
+	for _, entry := range desired {
+		if !skipped[normalizeDN(entry.DN)] && !matched[strings.ToLower(entry.Attributes.First(key))] {
+			adds = append(adds, Change{Op: ChangeAdd, DN: entry.DN, Attributes: entry.Attributes})
+		}
+	}
+
+	changes, err := deleteChanges(ctx, session, ouDN, deleted)
+	if err != nil {
+		return nil, nil, err
+	}
+	changes = append(changes, modifies...)
+	return append(changes, adds...), failed, nil
+}
+
+// diffAttributes returns the modifications that turn from into to.
+// Attributes missing on the server are added, attributes missing from the
+// file are deleted and changed ones are replaced. objectClass only ever
+// gains values, since removing one would make the server reject the entry.
+func diffAttributes(from, to *ldif.AttributeMap) []ldif.Modification {
+	var mods []ldif.Modification
+
+	for _, attr := range to.All() {
+		if strings.EqualFold(attr.Name, "objectClass") {
+			var missing []string
+			for _, value := range attr.Values {
+				if !containsFold(from.Get(attr.Name), value) {
+					missing = append(missing, value)
+				}
+			}
+			if len(missing) > 0 {
+				mods = append(mods, ldif.Modification{Op: "add", Name: attr.Name, Values: missing})
+			}
+			continue
+		}
+
+		switch {
+		case !from.Has(attr.Name):
+			mods = append(mods, ldif.Modification{Op: "add", Name: attr.Name, Values: attr.Values})
+		case !sameValues(from.Get(attr.Name), attr.Values):
+			mods = append(mods, ldif.Modification{Op: "replace", Name: attr.Name, Values: attr.Values})
+		}
+	}
+
+	for _, attr := range from.All() {
+		if !to.Has(attr.Name) && !strings.EqualFold(attr.Name, "objectClass") {
+			mods = append(mods, ldif.Modification{Op: "delete", Name: attr.Name})
+		}
+	}
+
+	return mods
+}
+
+// applyChange sends a single change to the server with the given controls
+func applyChange(ctx context.Context, session *Session, change Change, controls []ldap.Control) error {
+	if len(change.Controls) > 0 {
+		controls = append(append([]ldap.Control(nil), change.Controls...), controls...)
+	}
+
+	switch change.Op {
+	case ChangeAdd:
+		addRequest := ldap.NewAddRequest(change.DN, controls)
+		for _, attr := range change.Attributes.All() {
+			addRequest.Attribute(attr.Name, attr.Values)
+		}
+		return session.Add(ctx, addRequest)
+	case ChangeModify:
+		modifyRequest := ldap.NewModifyRequest(change.DN, controls)
+		for _, mod := range change.Modifications {
+			switch mod.Op {
+			case "add":
+				modifyRequest.Add(mod.Name, mod.Values)
+			case "delete":
+				modifyRequest.Delete(mod.Name, mod.Values)
+			case "replace":
+				modifyRequest.Replace(mod.Name, mod.Values)
+			}
+		}
+		return session.Modify(ctx, modifyRequest)
+	case ChangeDelete:
+		return session.Del(ctx, ldap.NewDelRequest(change.DN, controls))
+	}
+	return fmt.Errorf("unknown change %v", change.Op)
+}
+
+func sameValues(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append([]string(nil), a...)
+	b = append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// sameDN compares two DNs the way the server would, falling back to a
+// case-insensitive string comparison if either does not parse
+func sameDN(a, b string) bool {
+	parsedA, errA := ldap.ParseDN(a)
+	parsedB, errB := ldap.ParseDN(b)
+	if errA != nil || errB != nil {
+		return strings.EqualFold(a, b)
+	}
+	return parsedA.EqualFold(parsedB)
+}
+
+func containsFold(list []string, value string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
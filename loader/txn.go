@@ -0,0 +1,301 @@
+package loader
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/imax1000/ldap-import/ldif"
+)
+
+// On-error policies
+const (
+	OnErrorStop     = "stop"
+	OnErrorRollback = "rollback"
+	OnErrorContinue = "continue"
+)
+
+// OIDs of the LDAP Transactions extension (RFC 5805)
+const (
+	oidStartTransaction = "1.3.6.1.1.21.1"
+	oidTransactionSpec  = "1.3.6.1.1.21.2"
+	oidEndTransaction   = "1.3.6.1.1.21.3"
+)
+
+// RootDSE holds the server capabilities advertised in the root DSE
+type RootDSE struct {
+	SupportedExtensions []string
+	SupportedControls   []string
+}
+
+func (r *RootDSE) SupportsExtension(oid string) bool {
+	return slices.Contains(r.SupportedExtensions, oid)
+}
+
+func (r *RootDSE) SupportsControl(oid string) bool {
+	return slices.Contains(r.SupportedControls, oid)
+}
+
+// readRootDSE fetches the server capabilities
+func readRootDSE(ctx context.Context, session *Session) (*RootDSE, error) {
+	searchRequest := ldap.NewSearchRequest(
+		"",
+		ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)",
+		[]string{"supportedExtension", "supportedControl"},
+		nil,
+	)
+
+	result, err := session.Search(ctx, searchRequest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read root DSE: %v", err)
+	}
+	if len(result.Entries) == 0 {
+		return &RootDSE{}, nil
+	}
+
+	return &RootDSE{
+		SupportedExtensions: result.Entries[0].GetAttributeValues("supportedExtension"),
+		SupportedControls:   result.Entries[0].GetAttributeValues("supportedControl"),
+	}, nil
+}
+
+// loadTransactional runs a load as all-or-nothing. If the server supports
+// LDAP transactions the changes are sent in one transaction; otherwise
+// every applied change is journaled and undone in reverse order when a
+// later one fails, using an in-memory snapshot of the OU and everything
+// below it for deleted and modified entries.
+func loadTransactional(ctx context.Context, session *Session, targetOU, mode, key string, naming *NamingRule, entries []ldif.Entry, progress ProgressFunc) error {
+	ouDN, err := TargetOUDN(session.Config, targetOU)
+	if err != nil {
+		return err
+	}
+	desired, err := desiredEntries(ouDN, naming, entries)
+	if err != nil {
+		return err
+	}
+
+	progress.stage("Reading current entries")
+	changes, failed, err := planChanges(ctx, session, ouDN, mode, key, desired)
+	if err != nil {
+		return err
+	}
+	if len(failed) > 0 {
+		return unmatchedError(failed, len(desired), key)
+	}
+
+	rootDSE, err := readRootDSE(ctx, session)
+	if err != nil {
+		return err
+	}
+	if rootDSE.SupportsExtension(oidStartTransaction) && rootDSE.SupportsExtension(oidEndTransaction) {
+		return applyInTransaction(ctx, session, changes, progress)
+	}
+
+	snapshot, err := SearchSubtree(ctx, session, ouDN)
+	if err != nil {
+		return err
+	}
+	return applyWithRollback(ctx, session, changes, snapshot, progress, "Applying changes")
+}
+
+// applyInTransaction sends all changes inside one RFC 5805 transaction
+func applyInTransaction(ctx context.Context, session *Session, changes []Change, progress ProgressFunc) error {
+	response, err := session.Extended(ctx, ldap.NewExtendedRequest(oidStartTransaction, nil))
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %v", err)
+	}
+	// The identifier comes as a responseValue without a responseName, and
+	// go-ldap reports the only optional field of a response as its name
+	txnID := response.Name
+	if response.Value != nil {
+		txnID = response.Value.Data.String()
+	}
+	if txnID == "" || txnID == oidStartTransaction {
+		return fmt.Errorf("server returned no transaction identifier")
+	}
+	controls := []ldap.Control{&ldap.ControlString{
+		ControlType:  oidTransactionSpec,
+		Criticality:  true,
+		ControlValue: txnID,
+	}}
+
+	total := len(changes)
+	for i, change := range changes {
+		err := ctx.Err()
+		if err == nil {
+			err = applyChange(ctx, session, change, controls)
+		}
+		if ctx.Err() != nil {
+			endTransaction(context.WithoutCancel(ctx), session, txnID, false)
+			return fmt.Errorf("%w; transaction aborted, nothing was changed", &CanceledError{Done: i, Total: total})
+		}
+		if err != nil {
+			if abortErr := endTransaction(ctx, session, txnID, false); abortErr != nil {
+				return fmt.Errorf("failed to %s entry %s: %v (aborting the transaction failed too: %v)", change.Op, change.DN, err, abortErr)
+			}
+			return fmt.Errorf("failed to %s entry %s: %v; transaction aborted, nothing was changed", change.Op, change.DN, err)
+		}
+
+		progress.report(Progress{Stage: "Loading in transaction", Done: i + 1, Total: total})
+	}
+
+	// Once everything is sent the commit runs to the end, since aborting
+	// it half way would leave the outcome unknown
+	progress.stage("Committing transaction")
+	if err := endTransaction(context.WithoutCancel(ctx), session, txnID, true); err != nil {
+		return fmt.Errorf("failed to commit transaction, nothing was changed: %v", err)
+	}
+	return nil
+}
+
+// endTransaction commits or aborts a transaction
+func endTransaction(ctx context.Context, session *Session, txnID string, commit bool) error {
+	value := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "End Transaction Request")
+	if !commit {
+		value.AppendChild(ber.NewBoolean(ber.ClassUniversal, ber.TypePrimitive, ber.TagBoolean, false, "Commit"))
+	}
+	value.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, txnID, "Identifier"))
+
+	request := ldap.NewExtendedRequest(oidEndTransaction,
+		ber.NewString(ber.ClassContext, ber.TypePrimitive, 1, string(value.Bytes()), "Request Value"))
+	_, err := session.Extended(ctx, request)
+	// go-ldap checks the result code first and then wants a response name,
+	// which servers leave out of End Transaction responses
+	if err != nil && strings.Contains(err.Error(), "malformed extended response") {
+		return nil
+	}
+	return err
+}
+
+// applyWithRollback applies the changes one by one. When one fails, the
+// changes applied before it are undone in reverse order, restoring deleted
+// and modified entries from snapshot.
+func applyWithRollback(ctx context.Context, session *Session, changes []Change, snapshot []ldif.Entry, progress ProgressFunc, stage string) error {
+	before := make(map[string]ldif.Entry, len(snapshot))
+	for _, entry := range snapshot {
+		before[normalizeDN(entry.DN)] = entry
+	}
+
+	var undo []Change
+	total := len(changes)
+	for i, change := range changes {
+		err := ctx.Err()
+		if err == nil {
+			err = applyChange(ctx, session, change, nil)
+		}
+		if ctx.Err() != nil {
+			err = &CanceledError{Done: i, Total: total}
+		} else if err != nil {
+			err = fmt.Errorf("failed to %s entry %s: %v", change.Op, change.DN, err)
+		}
+
+		if err != nil {
+			// The rollback has to finish even when the load was canceled
+			if rollbackErr := rollback(context.WithoutCancel(ctx), session, undo, progress); rollbackErr != nil {
+				return fmt.Errorf("%w; rollback incomplete: %v", err, rollbackErr)
+			}
+			return fmt.Errorf("%w; all changes were rolled back", err)
+		}
+
+		original, exists := before[normalizeDN(change.DN)]
+		var originalPtr *ldif.Entry
+		if exists {
+			originalPtr = &original
+		}
+		if change.Op == ChangeDelete && hasControl(change.Controls, ldap.ControlTypeSubtreeDelete) {
+			// The server took the entries below along; they are restored
+			// after the entry itself
+			undo = append(undo, subtreeUndo(change.DN, snapshot)...)
+		}
+		undo = append(undo, inverseChange(change, originalPtr))
+
+		progress.report(Progress{Stage: stage, Done: i + 1, Total: total})
+	}
+
+	return nil
+}
+
+// rollback applies undo changes in reverse order. It keeps going after a
+// failure so that as much as possible is restored.
+func rollback(ctx context.Context, session *Session, undo []Change, progress ProgressFunc) error {
+	var failed []string
+	total := len(undo)
+	for i := total - 1; i >= 0; i-- {
+		change := undo[i]
+		if err := applyChange(ctx, session, change, nil); err != nil {
+			failed = append(failed, fmt.Sprintf("%s %s: %v", change.Op, change.DN, err))
+		}
+
+		done := total - i
+		progress.report(Progress{Stage: "Rolling back", Done: done, Total: total})
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d undo operations failed:\n%s", len(failed), total, strings.Join(failed, "\n"))
+	}
+	return nil
+}
+
+// subtreeUndo returns the adds that restore the snapshot entries below dn.
+// Deeper entries come first, since rollback applies undo in reverse order.
+func subtreeUndo(dn string, snapshot []ldif.Entry) []Change {
+	suffix := "," + normalizeDN(dn)
+	var undo []Change
+	for i := len(snapshot) - 1; i >= 0; i-- {
+		entry := snapshot[i]
+		if strings.HasSuffix(normalizeDN(entry.DN), suffix) {
+			undo = append(undo, Change{Op: ChangeAdd, DN: entry.DN, Attributes: entry.Attributes})
+		}
+	}
+	return undo
+}
+
+// hasControl reports whether controls contain one of the given type
+func hasControl(controls []ldap.Control, controlType string) bool {
+	for _, control := range controls {
+		if control.GetControlType() == controlType {
+			return true
+		}
+	}
+	return false
+}
+
+// inverseChange returns the change that undoes change. before is the entry
+// as it was prior to the change and is nil for adds.
+func inverseChange(change Change, before *ldif.Entry) Change {
+	switch change.Op {
+	case ChangeAdd:
+		return Change{Op: ChangeDelete, DN: change.DN}
+	case ChangeDelete:
+		if before == nil {
+			return Change{Op: ChangeAdd, DN: change.DN, Attributes: ldif.NewAttributeMap()}
+		}
+		return Change{Op: ChangeAdd, DN: change.DN, Attributes: before.Attributes}
+	}
+
+	var mods []ldif.Modification
+	for _, mod := range change.Modifications {
+		switch {
+		case mod.Op == "add" && len(mod.Values) > 0:
+			mods = append(mods, ldif.Modification{Op: "delete", Name: mod.Name, Values: mod.Values})
+		case before != nil && before.Attributes.Has(mod.Name):
+			mods = append(mods, ldif.Modification{Op: "replace", Name: mod.Name, Values: before.Attributes.Get(mod.Name)})
+		default:
+			mods = append(mods, ldif.Modification{Op: "delete", Name: mod.Name})
+		}
+	}
+	return Change{Op: ChangeModify, DN: change.DN, Modifications: mods}
+}
+
+// normalizeDN returns a form of dn suitable as a map key
+func normalizeDN(dn string) string {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil {
+		return strings.ToLower(dn)
+	}
+	return strings.ToLower(parsed.String())
+}
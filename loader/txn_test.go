@@ -0,0 +1,128 @@
+package loader
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/imax1000/ldap-import/ldif"
+	"github.com/imax1000/ldap-import/loader/loadertest"
+)
+
+func TestLoadInTransaction(t *testing.T) {
+	alice := person("cn", "Alice", "sn", "Smith", "mail", "alice@example.com")
+	bob := person("cn", "Bob", "sn", "Brown", "mail", "bob@example.com")
+
+	tests := []struct {
+		name     string
+		overLDAP bool
+		seed     string
+		cancel   bool
+
+		wantErr  string
+		wantDNs  []string
+		wantDone bool // whether the commit was sent
+	}{
+		{
+			name:     "commit",
+			seed:     seedCarol + seedCarolPhone,
+			wantDNs:  []string{"cn=Alice," + testOUDN, "cn=Bob," + testOUDN},
+			wantDone: true,
+		},
+		{
+			name:     "commit over LDAP",
+			overLDAP: true,
+			seed:     seedCarol + seedCarolPhone,
+			wantDNs:  []string{"cn=Alice," + testOUDN, "cn=Bob," + testOUDN},
+			wantDone: true,
+		},
+		{
+			name:     "failed commit changes nothing",
+			seed:     seedCarol + "\n" + seedBobDevice,
+			wantErr:  "failed to commit transaction, nothing was changed",
+			wantDNs:  []string{"cn=Bob," + testOUDN, "cn=Carol," + testOUDN},
+			wantDone: true,
+		},
+		{
+			name:     "failed commit over LDAP changes nothing",
+			overLDAP: true,
+			seed:     seedCarol + "\n" + seedBobDevice,
+			wantErr:  "failed to commit transaction, nothing was changed",
+			wantDNs:  []string{"cn=Bob," + testOUDN, "cn=Carol," + testOUDN},
+			wantDone: true,
+		},
+		{
+			name:    "abort on cancel",
+			seed:    seedCarol + seedCarolPhone,
+			cancel:  true,
+			wantErr: "transaction aborted, nothing was changed",
+			wantDNs: []string{"cn=Carol," + testOUDN, "cn=phone,cn=Carol," + testOUDN},
+		},
+		{
+			name:     "abort on cancel over LDAP",
+			overLDAP: true,
+			seed:     seedCarol + seedCarolPhone,
+			cancel:   true,
+			wantErr:  "transaction aborted, nothing was changed",
+			wantDNs:  []string{"cn=Carol," + testOUDN, "cn=phone,cn=Carol," + testOUDN},
+		},
+	}
+
+	naming, err := ParseNamingRule("cn")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("XDG_DATA_HOME", t.TempDir())
+
+			dir := newTestDirectory(t, tt.seed, false)
+			dir.SupportTransactions()
+
+			var session *Session
+			if tt.overLDAP {
+				server := loadertest.NewServer(dir)
+				defer server.Close()
+				session = NewSession(newServerConfig(server))
+			} else {
+				session = newTestSession(dir)
+			}
+			defer session.Close()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			var stages []string
+			progress := func(p Progress) {
+				stages = append(stages, p.Stage)
+				if tt.cancel && p.Stage == "Loading in transaction" && p.Done == 2 {
+					cancel()
+				}
+			}
+
+			opts := Options{TargetOU: "staff", Mode: ModeReplace, OnError: OnErrorRollback, Naming: naming}
+			_, err := Load(ctx, session, opts, []ldif.Entry{alice, bob}, progress)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("Load() error = %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Fatalf("Load() error = %v, want %q", err, tt.wantErr)
+			}
+			if tt.cancel && !errors.Is(err, context.Canceled) {
+				t.Errorf("Load() error %v does not match context.Canceled", err)
+			}
+
+			if !slices.Contains(stages, "Loading in transaction") {
+				t.Errorf("stages = %q, want the load to run in a transaction", stages)
+			}
+			if got := slices.Contains(stages, "Committing transaction"); got != tt.wantDone {
+				t.Errorf("committed = %v, want %v", got, tt.wantDone)
+			}
+			if got := ouContents(dir); !slices.Equal(got, tt.wantDNs) {
+				t.Errorf("entries in OU = %q, want %q", got, tt.wantDNs)
+			}
+		})
+	}
+}
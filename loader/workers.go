@@ -0,0 +1,118 @@
+package loader
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Defaults for the concurrency settings
+const (
+	DefaultWorkers     = 4
+	DefaultConnections = 1
+)
+
+// applyChanges sends changes with up to Config.Workers operations in
+// flight, spread over Config.Connections connections and limited to
+// Config.RateLimit operations per second. Consecutive changes of the same
+// kind at the same depth run concurrently; a phase only starts once the one
+// before it is done, so that entries are deleted before they are added
+// again under the same DN, and children before their parents.
+//
+// Every change the server rejects is returned as an EntryError. With
+// stopOnError, no further changes are sent after the first failure and it
+// is returned as the error; otherwise the error is only set on cancel.
+func applyChanges(ctx context.Context, session *Session, changes []Change, stopOnError bool, progress ProgressFunc, stage string) ([]EntryError, error) {
+	sessions := []*Session{session}
+	for i := 1; i < session.Config.Connections; i++ {
+		extra := NewSession(session.Config)
+		extra.OnRetry = session.OnRetry
+		extra.Dial = session.Dial
+		defer extra.Close()
+		sessions = append(sessions, extra)
+	}
+
+	workers := max(session.Config.Workers, 1)
+
+	var limiter <-chan time.Time
+	if session.Config.RateLimit > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(session.Config.RateLimit))
+		defer ticker.Stop()
+		limiter = ticker.C
+	}
+
+	var (
+		mu     sync.Mutex
+		failed []EntryError
+		done   int
+	)
+	total := len(changes)
+
+	for start := 0; start < total; {
+		end := start + 1
+		depth := dnDepth(changes[start].DN)
+		for end < total && changes[end].Op == changes[start].Op && dnDepth(changes[end].DN) == depth {
+			end++
+		}
+
+		jobs := make(chan Change)
+		var wg sync.WaitGroup
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func(worker *Session) {
+				defer wg.Done()
+				for change := range jobs {
+					err := applyChange(ctx, worker, change, nil)
+					if ctx.Err() != nil {
+						// Aborted in flight; it counts neither as done
+						// nor as failed
+						continue
+					}
+
+					mu.Lock()
+					if err != nil {
+						failed = append(failed, newEntryError(change, err))
+					}
+					done++
+					progress.report(Progress{Stage: stage, Done: done, Total: total, Failed: len(failed)})
+					mu.Unlock()
+				}
+			}(sessions[w%len(sessions)])
+		}
+
+	send:
+		for _, change := range changes[start:end] {
+			mu.Lock()
+			stop := stopOnError && len(failed) > 0
+			mu.Unlock()
+			if stop {
+				break
+			}
+
+			if limiter != nil {
+				select {
+				case <-limiter:
+				case <-ctx.Done():
+					break send
+				}
+			}
+			select {
+			case jobs <- change:
+			case <-ctx.Done():
+				break send
+			}
+		}
+		close(jobs)
+		wg.Wait()
+
+		if ctx.Err() != nil {
+			return failed, &CanceledError{Done: done, Total: total}
+		}
+		if stopOnError && len(failed) > 0 {
+			return failed, failed[0]
+		}
+		start = end
+	}
+
+	return failed, nil
+}
@@ -1,62 +1,48 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"strings"
-	"sync"
+	"time"
 
 	"github.com/gen2brain/iup-go/iup"
-	"github.com/go-ldap/ldap/v3"
 	"github.com/gotk3/gotk3/glib"
 	"github.com/gotk3/gotk3/gtk"
+	"github.com/imax1000/ldap-import/ldif"
+	"github.com/imax1000/ldap-import/loader"
+	"github.com/imax1000/ldap-import/orgtree"
 )
 
-// LDAPConfig stores connection configuration
-type LDAPConfig struct {
-	Host     string
-	Port     string
-	BindDN   string
-	Password string
-	BaseDN   string
-}
-
-// LDIFEntry represents a single LDAP entry from the LDIF file
-type LDIFEntry struct {
-	DN              string
-	ObjectClass     string
-	SN              string
-	CN              string
-	OU              string
-	Title           string
-	Mail            string
-	GivenName       string
-	Initials        string
-	TelephoneNumber string
-	L               string
-	PostalAddress   string
-	O               string
-}
-
 // ProgressDialog manages the progress window
 type ProgressDialog struct {
 	Window    *gtk.Dialog
 	Progress  *gtk.ProgressBar
 	Label     *gtk.Label
 	CancelBtn *gtk.Button
-	Canceled  bool
-	Mutex     sync.Mutex
+
+	// Context is canceled by the Cancel button
+	Context context.Context
+	cancel  context.CancelFunc
 }
 
 var (
-	config     LDAPConfig
+	config     loader.Config
 	counterDlg iup.Ihandle
+
+	// vault is the password vault once it has been unlocked
+	vault *Vault
 )
 
 func main() {
+	// A command on the command line runs without the main window
+	if len(os.Args) > 1 {
+		os.Exit(runCLI(os.Args[1:]))
+	}
+
 	// Initialize GTK
 	gtk.Init(nil)
 	os.Setenv("GDK_BACKEND", "x11")
@@ -101,8 +87,45 @@ func createMainWindow() (*gtk.Window, error) {
 	}
 	grid.Attach(connLabel, 0, 0, 2, 1)
 
+	// Saved profiles
+	profileLabel, err := gtk.LabelNew("Profile:")
+	if err != nil {
+		return nil, err
+	}
+	profileCombo, err := gtk.ComboBoxTextNew()
+	if err != nil {
+		return nil, err
+	}
+	profileBox, err := gtk.BoxNew(gtk.ORIENTATION_HORIZONTAL, 5)
+	if err != nil {
+		return nil, err
+	}
+	saveProfileBtn, err := gtk.ButtonNewWithLabel("Save")
+	if err != nil {
+		return nil, err
+	}
+	deleteProfileBtn, err := gtk.ButtonNewWithLabel("Delete")
+	if err != nil {
+		return nil, err
+	}
+	importProfilesBtn, err := gtk.ButtonNewWithLabel("Import")
+	if err != nil {
+		return nil, err
+	}
+	exportProfilesBtn, err := gtk.ButtonNewWithLabel("Export")
+	if err != nil {
+		return nil, err
+	}
+	profileBox.PackStart(saveProfileBtn, false, false, 0)
+	profileBox.PackStart(deleteProfileBtn, false, false, 0)
+	profileBox.PackStart(importProfilesBtn, false, false, 0)
+	profileBox.PackStart(exportProfilesBtn, false, false, 0)
+	grid.Attach(profileLabel, 0, 1, 1, 1)
+	grid.Attach(profileCombo, 1, 1, 1, 1)
+	grid.Attach(profileBox, 2, 1, 1, 1)
+
 	// Host
-	hostLabel, err := gtk.LabelNew("Host:")
+	hostLabel, err := gtk.LabelNew("Host or URL:")
 	if err != nil {
 		return nil, err
 	}
@@ -110,9 +133,9 @@ func createMainWindow() (*gtk.Window, error) {
 	if err != nil {
 		return nil, err
 	}
-	hostEntry.SetPlaceholderText("ldap.example.com")
-	grid.Attach(hostLabel, 0, 1, 1, 1)
-	grid.Attach(hostEntry, 1, 1, 1, 1)
+	hostEntry.SetPlaceholderText("ldap.example.com or ldapi:///")
+	grid.Attach(hostLabel, 0, 2, 1, 1)
+	grid.Attach(hostEntry, 1, 2, 1, 1)
 	hostEntry.SetText("localhost")
 
 	// Port
@@ -125,8 +148,31 @@ func createMainWindow() (*gtk.Window, error) {
 		return nil, err
 	}
 	portEntry.SetText("389")
-	grid.Attach(portLabel, 0, 2, 1, 1)
-	grid.Attach(portEntry, 1, 2, 1, 1)
+	grid.Attach(portLabel, 0, 3, 1, 1)
+	grid.Attach(portEntry, 1, 3, 1, 1)
+	hostEntry.Connect("changed", func() {
+		// The port is part of an LDAP URL
+		host, _ := hostEntry.GetText()
+		portEntry.SetSensitive(!strings.Contains(host, "://"))
+	})
+
+	// Bind mechanism
+	bindMechLabel, err := gtk.LabelNew("Bind Mechanism:")
+	if err != nil {
+		return nil, err
+	}
+	bindMechCombo, err := gtk.ComboBoxTextNew()
+	if err != nil {
+		return nil, err
+	}
+	bindMechCombo.Append(loader.BindSimple, "Simple")
+	bindMechCombo.Append(loader.BindAnonymous, "Anonymous")
+	bindMechCombo.Append(loader.BindExternal, "SASL EXTERNAL")
+	bindMechCombo.Append(loader.BindNTLM, "NTLM")
+	bindMechCombo.Append(loader.BindDigestMD5, "DIGEST-MD5")
+	bindMechCombo.SetActiveID(loader.BindSimple)
+	grid.Attach(bindMechLabel, 0, 4, 1, 1)
+	grid.Attach(bindMechCombo, 1, 4, 1, 1)
 
 	// Bind DN
 	bindDNLabel, err := gtk.LabelNew("Bind DN:")
@@ -139,8 +185,8 @@ func createMainWindow() (*gtk.Window, error) {
 	}
 	bindDNEntry.SetPlaceholderText("cn=admin,dc=example,dc=com")
 	bindDNEntry.SetText("cn=admin,dc=mail,dc=local")
-	grid.Attach(bindDNLabel, 0, 3, 1, 1)
-	grid.Attach(bindDNEntry, 1, 3, 1, 1)
+	grid.Attach(bindDNLabel, 0, 5, 1, 1)
+	grid.Attach(bindDNEntry, 1, 5, 1, 1)
 
 	// Password
 	passLabel, err := gtk.LabelNew("Password:")
@@ -151,10 +197,29 @@ func createMainWindow() (*gtk.Window, error) {
 	if err != nil {
 		return nil, err
 	}
-	passEntry.SetText("123456")
 	passEntry.SetVisibility(false)
-	grid.Attach(passLabel, 0, 4, 1, 1)
-	grid.Attach(passEntry, 1, 4, 1, 1)
+	passEntry.SetPlaceholderText("empty: from the vault or $" + passwordEnv)
+	grid.Attach(passLabel, 0, 6, 1, 1)
+	grid.Attach(passEntry, 1, 6, 1, 1)
+
+	bindMechCombo.Connect("changed", func() {
+		mech := bindMechCombo.GetActiveID()
+		needsUser := mech != loader.BindAnonymous && mech != loader.BindExternal
+		bindDNEntry.SetSensitive(needsUser)
+		passEntry.SetSensitive(needsUser)
+
+		switch mech {
+		case loader.BindNTLM:
+			bindDNLabel.SetText("User:")
+			bindDNEntry.SetPlaceholderText("DOMAIN\\user or user@domain")
+		case loader.BindDigestMD5:
+			bindDNLabel.SetText("User:")
+			bindDNEntry.SetPlaceholderText("user")
+		default:
+			bindDNLabel.SetText("Bind DN:")
+			bindDNEntry.SetPlaceholderText("cn=admin,dc=example,dc=com")
+		}
+	})
 
 	// Base DN
 	baseDNLabel, err := gtk.LabelNew("Base DN:")
@@ -167,8 +232,151 @@ func createMainWindow() (*gtk.Window, error) {
 	}
 	baseDNEntry.SetPlaceholderText("dc=example,dc=com")
 	baseDNEntry.SetText("dc=mail,dc=local")
-	grid.Attach(baseDNLabel, 0, 5, 1, 1)
-	grid.Attach(baseDNEntry, 1, 5, 1, 1)
+	grid.Attach(baseDNLabel, 0, 7, 1, 1)
+	grid.Attach(baseDNEntry, 1, 7, 1, 1)
+
+	// Address book container
+	abookLabel, err := gtk.LabelNew("Address Book OU:")
+	if err != nil {
+		return nil, err
+	}
+	abookEntry, err := gtk.EntryNew()
+	if err != nil {
+		return nil, err
+	}
+	abookEntry.SetText(loader.DefaultAbookOU)
+	grid.Attach(abookLabel, 0, 8, 1, 1)
+	grid.Attach(abookEntry, 1, 8, 1, 1)
+
+	// Connection security
+	securityLabel, err := gtk.LabelNew("Security:")
+	if err != nil {
+		return nil, err
+	}
+	securityCombo, err := gtk.ComboBoxTextNew()
+	if err != nil {
+		return nil, err
+	}
+	securityCombo.Append(loader.SecurityPlain, "None (plain LDAP)")
+	securityCombo.Append(loader.SecurityStartTLS, "StartTLS")
+	securityCombo.Append(loader.SecurityLDAPS, "LDAPS")
+	securityCombo.SetActiveID(loader.SecurityPlain)
+	tlsBtn, err := gtk.ButtonNewWithLabel("TLS Options")
+	if err != nil {
+		return nil, err
+	}
+	tlsBtn.SetSensitive(false)
+	securityCombo.Connect("changed", func() {
+		security := securityCombo.GetActiveID()
+		tlsBtn.SetSensitive(security != loader.SecurityPlain)
+
+		port, _ := portEntry.GetText()
+		if security == loader.SecurityLDAPS && port == "389" {
+			portEntry.SetText("636")
+		} else if security != loader.SecurityLDAPS && port == "636" {
+			portEntry.SetText("389")
+		}
+	})
+	tlsBtn.Connect("clicked", func() {
+		showTLSOptionsDialog(win, &config)
+	})
+	grid.Attach(securityLabel, 0, 9, 1, 1)
+	grid.Attach(securityCombo, 1, 9, 1, 1)
+	grid.Attach(tlsBtn, 2, 9, 1, 1)
+
+	// Timeouts and retries
+	timeoutLabel, err := gtk.LabelNew("Timeouts (s):")
+	if err != nil {
+		return nil, err
+	}
+	timeoutBox, err := gtk.BoxNew(gtk.ORIENTATION_HORIZONTAL, 5)
+	if err != nil {
+		return nil, err
+	}
+	connectTimeoutSpin, err := gtk.SpinButtonNewWithRange(1, 300, 1)
+	if err != nil {
+		return nil, err
+	}
+	connectTimeoutSpin.SetValue(loader.DefaultConnectTimeout.Seconds())
+	connectTimeoutSpin.SetTooltipText("Connect timeout in seconds")
+	requestTimeoutSpin, err := gtk.SpinButtonNewWithRange(1, 3600, 1)
+	if err != nil {
+		return nil, err
+	}
+	requestTimeoutSpin.SetValue(loader.DefaultRequestTimeout.Seconds())
+	requestTimeoutSpin.SetTooltipText("Timeout for each request in seconds")
+	retriesLabel, err := gtk.LabelNew("Retries:")
+	if err != nil {
+		return nil, err
+	}
+	retriesSpin, err := gtk.SpinButtonNewWithRange(0, 10, 1)
+	if err != nil {
+		return nil, err
+	}
+	retriesSpin.SetValue(loader.DefaultRetries)
+	retriesSpin.SetTooltipText("How often to retry when the server is busy, unavailable or unreachable")
+	timeoutBox.PackStart(connectTimeoutSpin, true, true, 0)
+	timeoutBox.PackStart(requestTimeoutSpin, true, true, 0)
+	timeoutBox.PackStart(retriesLabel, false, false, 0)
+	timeoutBox.PackStart(retriesSpin, true, true, 0)
+	grid.Attach(timeoutLabel, 0, 10, 1, 1)
+	grid.Attach(timeoutBox, 1, 10, 1, 1)
+
+	// Page size
+	pageSizeLabel, err := gtk.LabelNew("Page Size:")
+	if err != nil {
+		return nil, err
+	}
+	pageSizeSpin, err := gtk.SpinButtonNewWithRange(0, 10000, 50)
+	if err != nil {
+		return nil, err
+	}
+	pageSizeSpin.SetValue(loader.DefaultPageSize)
+	pageSizeSpin.SetTooltipText("Entries per page when reading from the server; must not exceed the server's size limit. 0 turns paging off")
+	grid.Attach(pageSizeLabel, 0, 11, 1, 1)
+	grid.Attach(pageSizeSpin, 1, 11, 1, 1)
+
+	// Concurrency
+	workersLabel, err := gtk.LabelNew("Workers:")
+	if err != nil {
+		return nil, err
+	}
+	workersBox, err := gtk.BoxNew(gtk.ORIENTATION_HORIZONTAL, 5)
+	if err != nil {
+		return nil, err
+	}
+	workersSpin, err := gtk.SpinButtonNewWithRange(1, 64, 1)
+	if err != nil {
+		return nil, err
+	}
+	workersSpin.SetValue(loader.DefaultWorkers)
+	workersSpin.SetTooltipText("Number of operations sent to the server at once")
+	connectionsLabel, err := gtk.LabelNew("Connections:")
+	if err != nil {
+		return nil, err
+	}
+	connectionsSpin, err := gtk.SpinButtonNewWithRange(1, 16, 1)
+	if err != nil {
+		return nil, err
+	}
+	connectionsSpin.SetValue(loader.DefaultConnections)
+	rateLabel, err := gtk.LabelNew("Max/s:")
+	if err != nil {
+		return nil, err
+	}
+	rateSpin, err := gtk.SpinButtonNewWithRange(0, 10000, 10)
+	if err != nil {
+		return nil, err
+	}
+	rateSpin.SetValue(0)
+	rateSpin.SetTooltipText("Maximum operations per second, 0 for no limit")
+	workersBox.PackStart(workersSpin, true, true, 0)
+	workersBox.PackStart(connectionsLabel, false, false, 0)
+	workersBox.PackStart(connectionsSpin, true, true, 0)
+	workersBox.PackStart(rateLabel, false, false, 0)
+	workersBox.PackStart(rateSpin, true, true, 0)
+	grid.Attach(workersLabel, 0, 12, 1, 1)
+	grid.Attach(workersBox, 1, 12, 1, 1)
 
 	// File selection
 	fileLabel, err := gtk.LabelNew("LDIF File:")
@@ -236,9 +444,9 @@ func createMainWindow() (*gtk.Window, error) {
 			fileEntry.SetText(filename)
 		}
 	})
-	grid.Attach(fileLabel, 0, 6, 1, 1)
-	grid.Attach(fileEntry, 1, 6, 1, 1)
-	grid.Attach(fileBtn, 2, 6, 1, 1)
+	grid.Attach(fileLabel, 0, 13, 1, 1)
+	grid.Attach(fileEntry, 1, 13, 1, 1)
+	grid.Attach(fileBtn, 2, 13, 1, 1)
 
 	// OU selection
 	ouLabel, err := gtk.LabelNew("Target OU:")
@@ -254,19 +462,39 @@ func createMainWindow() (*gtk.Window, error) {
 		return nil, err
 	}
 
+	// readConfig copies the connection settings from the widgets into
+	// config. The TLS options are edited in place by their dialog, and
+	// handlers that connect resolve the password with bindPassword.
+	readConfig := func() {
+		config.Host, _ = hostEntry.GetText()
+		config.Port, _ = portEntry.GetText()
+		config.BindDN, _ = bindDNEntry.GetText()
+		config.Password, _ = passEntry.GetText()
+		config.BaseDN, _ = baseDNEntry.GetText()
+		config.AbookOU, _ = abookEntry.GetText()
+		config.BindMechanism = bindMechCombo.GetActiveID()
+		config.Security = securityCombo.GetActiveID()
+		config.ConnectTimeout = time.Duration(connectTimeoutSpin.GetValueAsInt()) * time.Second
+		config.RequestTimeout = time.Duration(requestTimeoutSpin.GetValueAsInt()) * time.Second
+		config.Retries = retriesSpin.GetValueAsInt()
+		config.PageSize = pageSizeSpin.GetValueAsInt()
+		config.Workers = workersSpin.GetValueAsInt()
+		config.Connections = connectionsSpin.GetValueAsInt()
+		config.RateLimit = rateSpin.GetValueAsInt()
+	}
+
 	refreshBtn.Connect("clicked", func() {
-		//		var config LDAPConfig
+		//		var config loader.Config
 
 		//		config.Host, err =
-		//		config := LDAPConfig{
-		config.Host, err = hostEntry.GetText()
-		config.Port, err = portEntry.GetText()
-		config.BindDN, err = bindDNEntry.GetText()
-		config.Password, err = passEntry.GetText()
-		config.BaseDN, err = baseDNEntry.GetText()
+		//		config := loader.Config{
+		readConfig()
+		config.Password = bindPassword(win, profileCombo.GetActiveID(), config)
 		//		}
 
-		ous, err := getOUs(config)
+		session := loader.NewSession(config)
+		ous, err := loader.ListOUs(context.Background(), session)
+		session.Close()
 		if err != nil {
 			showErrorDialog(win, "Failed to get OUs: "+err.Error())
 			return
@@ -277,9 +505,228 @@ func createMainWindow() (*gtk.Window, error) {
 			ouCombo.AppendText(ou)
 		}
 	})
-	grid.Attach(ouLabel, 0, 7, 1, 1)
-	grid.Attach(ouCombo, 1, 7, 1, 1)
-	grid.Attach(refreshBtn, 2, 7, 1, 1)
+	grid.Attach(ouLabel, 0, 14, 1, 1)
+	grid.Attach(ouCombo, 1, 14, 1, 1)
+	grid.Attach(refreshBtn, 2, 14, 1, 1)
+
+	// Load mode
+	modeLabel, err := gtk.LabelNew("Load Mode:")
+	if err != nil {
+		return nil, err
+	}
+	modeCombo, err := gtk.ComboBoxTextNew()
+	if err != nil {
+		return nil, err
+	}
+	modeCombo.Append(loader.ModeReplace, "Replace all entries")
+	modeCombo.Append(loader.ModeSync, "Incremental sync")
+	modeCombo.SetActiveID(loader.ModeReplace)
+	grid.Attach(modeLabel, 0, 15, 1, 1)
+	grid.Attach(modeCombo, 1, 15, 1, 1)
+
+	// Sync key
+	keyLabel, err := gtk.LabelNew("Sync Key:")
+	if err != nil {
+		return nil, err
+	}
+	keyCombo, err := gtk.ComboBoxTextNew()
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range loader.SyncKeys {
+		keyCombo.Append(key, key)
+	}
+	keyCombo.SetActiveID(loader.SyncKeys[0])
+	keyCombo.SetSensitive(false)
+	modeCombo.Connect("changed", func() {
+		keyCombo.SetSensitive(modeCombo.GetActiveID() == loader.ModeSync)
+	})
+	grid.Attach(keyLabel, 0, 16, 1, 1)
+	grid.Attach(keyCombo, 1, 16, 1, 1)
+
+	// Error handling
+	onErrorLabel, err := gtk.LabelNew("On Error:")
+	if err != nil {
+		return nil, err
+	}
+	onErrorCombo, err := gtk.ComboBoxTextNew()
+	if err != nil {
+		return nil, err
+	}
+	onErrorCombo.Append(loader.OnErrorStop, "Stop at the failed entry")
+	onErrorCombo.Append(loader.OnErrorRollback, "Roll back all changes")
+	onErrorCombo.Append(loader.OnErrorContinue, "Skip failed entries and report them")
+	onErrorCombo.SetActiveID(loader.OnErrorStop)
+	grid.Attach(onErrorLabel, 0, 17, 1, 1)
+	grid.Attach(onErrorCombo, 1, 17, 1, 1)
+
+	// Naming attribute or template
+	namingLabel, err := gtk.LabelNew("Naming:")
+	if err != nil {
+		return nil, err
+	}
+	namingCombo, err := gtk.ComboBoxTextNewWithEntry()
+	if err != nil {
+		return nil, err
+	}
+	for _, spec := range loader.NamingPresets {
+		namingCombo.Append(spec, spec)
+	}
+	namingCombo.SetActiveID(loader.NamingPresets[0])
+	namingCombo.SetTooltipText("Attribute the entries are named by, e.g. uid, a multi-valued RDN such as cn+employeeNumber, or a template such as uid={mail_localpart}")
+	grid.Attach(namingLabel, 0, 18, 1, 1)
+	grid.Attach(namingCombo, 1, 18, 1, 1)
+
+	// Profile handling, once all the fields it fills in exist
+	profiles, err := loadProfiles()
+	if err != nil {
+		log.Println("Error loading profiles:", err)
+	}
+	fillProfiles := func(active string) {
+		profileCombo.RemoveAll()
+		for _, p := range profiles {
+			profileCombo.Append(p.Name, p.Name)
+		}
+		profileCombo.SetActiveID(active)
+	}
+	fillProfiles("")
+
+	profileCombo.Connect("changed", func() {
+		// The password typed for one profile must not be sent to the
+		// server of the next; an unlocked vault fills in the stored one
+		passEntry.SetText("")
+		config.Password = ""
+		i := findProfile(profiles, profileCombo.GetActiveID())
+		if i < 0 {
+			return
+		}
+		if vault != nil {
+			if password, ok := vault.Get(profiles[i].Name); ok {
+				passEntry.SetText(password)
+			}
+		}
+		p := profiles[i]
+		p.Apply(&config)
+
+		hostEntry.SetText(p.Host)
+		portEntry.SetText(p.Port)
+		bindDNEntry.SetText(p.BindDN)
+		baseDNEntry.SetText(p.BaseDN)
+		abookEntry.SetText(p.AbookOU)
+		if p.AbookOU == "" {
+			abookEntry.SetText(loader.DefaultAbookOU)
+		}
+		bindMechCombo.SetActiveID(loader.BindSimple)
+		if p.BindMechanism != "" {
+			bindMechCombo.SetActiveID(p.BindMechanism)
+		}
+		securityCombo.SetActiveID(loader.SecurityPlain)
+		if p.Security != "" {
+			securityCombo.SetActiveID(p.Security)
+		}
+
+		ouCombo.RemoveAll()
+		if p.TargetOU != "" {
+			ouCombo.AppendText(p.TargetOU)
+			ouCombo.SetActive(0)
+		}
+	})
+
+	saveProfileBtn.Connect("clicked", func() {
+		name, ok := showInputDialog(win, "Save the current settings as profile:", profileCombo.GetActiveID(), false)
+		if !ok {
+			return
+		}
+		name = strings.TrimSpace(name)
+		if name == "" {
+			showErrorDialog(win, "Please enter a profile name")
+			return
+		}
+
+		readConfig()
+
+		updated := mergeProfiles(profiles, []Profile{newProfile(name, config, ouCombo.GetActiveText())})
+		if err := saveProfiles(updated); err != nil {
+			showErrorDialog(win, "Failed to save profile: "+err.Error())
+			return
+		}
+		profiles = updated
+		fillProfiles(name)
+
+		password, _ := passEntry.GetText()
+		if password != "" && showConfirmDialog(win, "Store the password in the encrypted password vault?") {
+			if v := unlockVault(win); v != nil {
+				if err := v.Set(name, password); err != nil {
+					showErrorDialog(win, "Failed to store the password: "+err.Error())
+				}
+			}
+		}
+	})
+
+	deleteProfileBtn.Connect("clicked", func() {
+		name := profileCombo.GetActiveID()
+		i := findProfile(profiles, name)
+		if i < 0 {
+			showErrorDialog(win, "Please select a profile first")
+			return
+		}
+		if !showConfirmDialog(win, "Delete profile \""+name+"\"?") {
+			return
+		}
+
+		updated := append(append([]Profile(nil), profiles[:i]...), profiles[i+1:]...)
+		if err := saveProfiles(updated); err != nil {
+			showErrorDialog(win, "Failed to delete profile: "+err.Error())
+			return
+		}
+		profiles = updated
+		fillProfiles("")
+
+		// A locked vault keeps the password until it is overwritten
+		if vault != nil {
+			if err := vault.Delete(name); err != nil {
+				showErrorDialog(win, "Failed to remove the password from the vault: "+err.Error())
+			}
+		}
+	})
+
+	importProfilesBtn.Connect("clicked", func() {
+		filename := chooseProfilesFile(win, gtk.FILE_CHOOSER_ACTION_OPEN)
+		if filename == "" {
+			return
+		}
+
+		imported, err := readProfilesFile(filename)
+		if err != nil {
+			showErrorDialog(win, "Failed to import profiles: "+err.Error())
+			return
+		}
+		updated := mergeProfiles(profiles, imported)
+		if err := saveProfiles(updated); err != nil {
+			showErrorDialog(win, "Failed to save profiles: "+err.Error())
+			return
+		}
+		profiles = updated
+		fillProfiles(profileCombo.GetActiveID())
+		showInfoDialog(win, fmt.Sprintf("Imported %d profiles from:\n%s", len(imported), filename))
+	})
+
+	exportProfilesBtn.Connect("clicked", func() {
+		if len(profiles) == 0 {
+			showErrorDialog(win, "There are no profiles to export")
+			return
+		}
+		filename := chooseProfilesFile(win, gtk.FILE_CHOOSER_ACTION_SAVE)
+		if filename == "" {
+			return
+		}
+
+		if err := writeProfilesFile(filename, profiles); err != nil {
+			showErrorDialog(win, "Failed to export profiles: "+err.Error())
+			return
+		}
+		showInfoDialog(win, fmt.Sprintf("Exported %d profiles to:\n%s", len(profiles), filename))
+	})
 
 	// Buttons
 	btnBox, err := gtk.BoxNew(gtk.ORIENTATION_HORIZONTAL, 5)
@@ -298,13 +745,16 @@ func createMainWindow() (*gtk.Window, error) {
 			return
 		}
 
-		entries, err := parseLDIF(filename)
+		entries, warnings, err := ldif.ReadFile(context.Background(), filename)
 		if err != nil {
 			showErrorDialog(win, "Failed to parse LDIF file: "+err.Error())
 			return
 		}
-		showTreeWindow(win, buildOrgTree(entries), entries, config)
-		//		showTreeWindow(win, buildOrgTree(entries), entries)
+		if len(warnings) > 0 {
+			showWarningDialog(win, "The LDIF file has attributes this tool does not know:\n\n"+strings.Join(warnings, "\n"))
+		}
+		showTreeWindow(win, orgtree.Build(entries), entries, config)
+		//		showTreeWindow(win, orgtree.Build(entries), entries)
 	})
 
 	loadBtn, err := gtk.ButtonNewWithLabel("Load Data")
@@ -313,11 +763,8 @@ func createMainWindow() (*gtk.Window, error) {
 	}
 	loadBtn.Connect("clicked", func() {
 
-		config.Host, err = hostEntry.GetText()
-		config.Port, err = portEntry.GetText()
-		config.BindDN, err = bindDNEntry.GetText()
-		config.Password, err = passEntry.GetText()
-		config.BaseDN, err = baseDNEntry.GetText()
+		readConfig()
+		config.Password = bindPassword(win, profileCombo.GetActiveID(), config)
 
 		targetOU := ouCombo.GetActiveText()
 		if targetOU == "" {
@@ -331,473 +778,1036 @@ func createMainWindow() (*gtk.Window, error) {
 			return
 		}
 
-		entries, err := parseLDIF(filename)
+		entries, warnings, err := ldif.ReadFile(context.Background(), filename)
 		if err != nil {
 			showErrorDialog(win, "Failed to parse LDIF file: "+err.Error())
 			return
 		}
 		if len(entries) == 0 {
 		}
+		if len(warnings) > 0 && !showConfirmDialog(win,
+			"The LDIF file has attributes this tool does not know:\n\n"+strings.Join(warnings, "\n")+
+				"\n\nThey will be sent to the server as they are. Continue?") {
+			return
+		}
 
-		go func() {
-			progressDialog := createProgressDialog(win, "Loading Data", "Deleting old entries...")
-			//		defer progressDialog.Window.Destroy()
-
-			err := deleteOldEntries(config, targetOU, progressDialog)
-			if err != nil {
-				glib.IdleAdd(func() {
-					showErrorDialog(win, "Failed to delete old entries: "+err.Error())
-				})
-				return
-			}
+		mode := modeCombo.GetActiveID()
+		key := keyCombo.GetActiveID()
+		onError := onErrorCombo.GetActiveID()
+		naming, err := loader.ParseNamingRule(namingCombo.GetActiveText())
+		if err != nil {
+			showErrorDialog(win, err.Error())
+			return
+		}
 
-			if progressDialog.IsCanceled() {
-				return
-			}
+		go func() {
+			progressDialog := createProgressDialog(win, "Loading Data", "Backing up target OU...")
+			defer progressDialog.Close()
 
-			progressDialog.SetLabel("Adding new entries...")
-			err = addNewEntries(config, targetOU, entries, progressDialog)
-			if err != nil {
-				glib.IdleAdd(func() {
-					showErrorDialog(win, "Failed to add new entries: "+err.Error())
-				})
-				return
-			}
+			// Backup and load share one connection
+			session := loader.NewSession(config)
+			session.OnRetry = progressDialog.ShowRetry
+			defer session.Close()
 
+			opts := loader.Options{TargetOU: targetOU, Mode: mode, Key: key, OnError: onError, Naming: naming}
+			result, err := loader.Load(progressDialog.Context, session, opts, entries, progressDialog.Report)
 			glib.IdleAdd(func() {
-				showInfoDialog(win, "Data loaded successfully!")
-			})
+				if errors.Is(err, context.Canceled) {
+					message := capitalize(err.Error())
+					if result.BackupFile != "" {
+						message += "\n\nThe previous content was saved to:\n" + result.BackupFile
+					}
+					showInfoDialog(win, message)
+					return
+				}
+				if err != nil {
+					message := capitalize(err.Error())
+					if result.BackupFile != "" {
+						message += "\n\nThe previous content was saved to:\n" + result.BackupFile
+					}
+					showErrorDialog(win, message)
+					return
+				}
 
+				if len(result.Failed) > 0 {
+					showErrorReportWindow(win, result.Failed, result.Total)
+					return
+				}
+				if mode == loader.ModeSync && onError == loader.OnErrorStop {
+					showInfoDialog(win, "Data synchronized successfully!\n\nBackup saved to:\n"+result.BackupFile)
+					return
+				}
+				showInfoDialog(win, "Data loaded successfully!\n\nBackup saved to:\n"+result.BackupFile)
+			})
 		}()
 	})
 
-	btnBox.PackStart(buildTreeBtn, true, true, 0)
-	btnBox.PackStart(loadBtn, true, true, 0)
-	grid.Attach(btnBox, 0, 8, 3, 1)
-
-	win.Add(grid)
-	return win, nil
-}
-
-func getOUs(config LDAPConfig) ([]string, error) {
-	conn, err := ldap.Dial("tcp", fmt.Sprintf("%s:%s", config.Host, config.Port))
+	previewBtn, err := gtk.ButtonNewWithLabel("Preview Changes")
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to LDAP server: %v", err)
+		return nil, err
 	}
-	defer conn.Close()
+	previewBtn.Connect("clicked", func() {
+		readConfig()
+		config.Password = bindPassword(win, profileCombo.GetActiveID(), config)
 
-	err = conn.Bind(config.BindDN, config.Password)
-	if err != nil {
-		return nil, fmt.Errorf("failed to bind to LDAP server: %v", err)
-	}
+		targetOU := ouCombo.GetActiveText()
+		if targetOU == "" {
+			showErrorDialog(win, "Please select target OU")
+			return
+		}
 
-	searchRequest := ldap.NewSearchRequest(
-		"ou=abook,"+config.BaseDN,
-		ldap.ScopeSingleLevel, ldap.NeverDerefAliases, 0, 0, false,
-		"(objectClass=organizationalUnit)",
-		[]string{"ou"},
-		nil,
-	)
+		filename, _ := fileEntry.GetText()
+		if filename == "" {
+			showErrorDialog(win, "Please select an LDIF file first")
+			return
+		}
 
-	result, err := conn.Search(searchRequest)
-	if err != nil {
-		return nil, fmt.Errorf("failed to search OUs: %v", err)
-	}
+		entries, _, err := ldif.ReadFile(context.Background(), filename)
+		if err != nil {
+			showErrorDialog(win, "Failed to parse LDIF file: "+err.Error())
+			return
+		}
+
+		mode := modeCombo.GetActiveID()
+		key := keyCombo.GetActiveID()
+		naming, err := loader.ParseNamingRule(namingCombo.GetActiveText())
+		if err != nil {
+			showErrorDialog(win, err.Error())
+			return
+		}
+
+		go func() {
+			session := loader.NewSession(config)
+			defer session.Close()
+
+			changes, err := loader.Plan(context.Background(), session, targetOU, mode, key, naming, entries)
+			glib.IdleAdd(func() {
+				if err != nil {
+					showErrorDialog(win, "Failed to compute changes: "+err.Error())
+					return
+				}
+				showPlanWindow(win, changes)
+			})
+		}()
+	})
 
-	var ous []string
-	for _, entry := range result.Entries {
-		ous = append(ous, entry.GetAttributeValue("ou"))
+	restoreBtn, err := gtk.ButtonNewWithLabel("Restore Backup")
+	if err != nil {
+		return nil, err
 	}
+	restoreBtn.Connect("clicked", func() {
+		readConfig()
+		config.Password = bindPassword(win, profileCombo.GetActiveID(), config)
 
-	return ous, nil
+		filename := chooseBackupFile(win)
+		if filename == "" {
+			return
+		}
+
+		if !showConfirmDialog(win, "Everything currently in the OU saved in\n"+filename+
+			"\nwill be replaced with the backup. Continue?") {
+			return
+		}
+
+		go func() {
+			progressDialog := createProgressDialog(win, "Restoring Backup", "Reading backup...")
+			defer progressDialog.Close()
+
+			session := loader.NewSession(config)
+			session.OnRetry = progressDialog.ShowRetry
+			defer session.Close()
+
+			err := loader.Restore(progressDialog.Context, session, filename, progressDialog.Report)
+			if errors.Is(err, context.Canceled) {
+				glib.IdleAdd(func() {
+					showInfoDialog(win, capitalize(err.Error()))
+				})
+				return
+			}
+			if err != nil {
+				glib.IdleAdd(func() {
+					showErrorDialog(win, "Failed to restore backup: "+err.Error())
+				})
+				return
+			}
+
+			glib.IdleAdd(func() {
+				showInfoDialog(win, "Backup restored successfully!")
+			})
+		}()
+	})
+
+	btnBox.PackStart(buildTreeBtn, true, true, 0)
+	btnBox.PackStart(previewBtn, true, true, 0)
+	btnBox.PackStart(loadBtn, true, true, 0)
+	btnBox.PackStart(restoreBtn, true, true, 0)
+	grid.Attach(btnBox, 0, 19, 3, 1)
+
+	win.Add(grid)
+	return win, nil
 }
 
-func parseLDIF(filename string) ([]LDIFEntry, error) {
-	file, err := os.Open(filename)
+func showTreeWindow(parent *gtk.Window, root *orgtree.Node, entries []ldif.Entry, config loader.Config) {
+
+	// Create tree window
+	treeWindow, err := gtk.WindowNew(gtk.WINDOW_TOPLEVEL)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open file: %v", err)
+		log.Println("Error creating tree window:", err)
+		return
 	}
-	defer file.Close()
 
-	var entries []LDIFEntry
-	var currentEntry LDIFEntry
-	var inEntry bool
+	treeWindow.SetTitle("Organizational Structure")
+	treeWindow.SetDefaultSize(500, 600)
+	treeWindow.SetTransientFor(parent)
+	treeWindow.SetModal(true)
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
+	// Create main container
+	mainBox, err := gtk.BoxNew(gtk.ORIENTATION_VERTICAL, 5)
+	if err != nil {
+		log.Println("Error creating main box:", err)
+		treeWindow.Destroy()
+		return
+	}
 
-		if line == "" {
-			if inEntry {
-				entries = append(entries, currentEntry)
-				currentEntry = LDIFEntry{}
-				inEntry = false
-			}
-			continue
-		}
+	// Create button box
+	buttonBox, err := gtk.BoxNew(gtk.ORIENTATION_HORIZONTAL, 5)
+	if err != nil {
+		log.Println("Error creating button box:", err)
+		treeWindow.Destroy()
+		return
+	}
 
-		if strings.HasPrefix(line, "#") {
-			continue
+	// Create export button
+	exportBtn, err := gtk.ButtonNewWithLabel("Export to LDIF")
+	if err != nil {
+		log.Println("Error creating export button:", err)
+		treeWindow.Destroy()
+		return
+	}
+	////////////////////////////////////////////////////////////////////
+	//	exportBtn.Connect("clicked", func() {
+	//		exportToLDIF(parent, entries)
+	//	})
+
+	// Create close button
+	closeBtn, err := gtk.ButtonNewWithLabel("Close")
+	if err != nil {
+		log.Println("Error creating close button:", err)
+		treeWindow.Destroy()
+		return
+	}
+	closeBtn.Connect("clicked", func() {
+		treeWindow.Destroy()
+	})
+
+	buttonBox.PackEnd(closeBtn, false, false, 0)
+	buttonBox.PackEnd(exportBtn, false, false, 5)
+	mainBox.PackStart(buttonBox, false, false, 5)
+
+	// Create scrolled window
+	scrolledWindow, err := gtk.ScrolledWindowNew(nil, nil)
+	if err != nil {
+		log.Println("Error creating scrolled window:", err)
+		treeWindow.Destroy()
+		return
+	}
+
+	// Create tree view
+	treeView, err := gtk.TreeViewNew()
+	if err != nil {
+		log.Println("Error creating tree view:", err)
+		treeWindow.Destroy()
+		return
+	}
+
+	// Create tree store
+	treeStore, err := gtk.TreeStoreNew(glib.TYPE_STRING)
+	if err != nil {
+		log.Println("Error creating tree store:", err)
+		treeWindow.Destroy()
+		return
+	}
+
+	// Populate tree store
+	populateTreeStore(treeStore, nil, root)
+
+	// Create column
+	column, err := gtk.TreeViewColumnNew()
+	if err != nil {
+		log.Println("Error creating tree column:", err)
+		treeWindow.Destroy()
+		return
+	}
+
+	column.SetTitle("Organizational Structure")
+
+	exportBtn.Connect("clicked", func() {
+		exportTreeToLDIF(parent, treeStore, root)
+	})
+
+	renderer, err := gtk.CellRendererTextNew()
+	if err != nil {
+		log.Println("Error creating cell renderer:", err)
+		treeWindow.Destroy()
+		return
+	}
+
+	column.PackStart(renderer, true)
+	column.AddAttribute(renderer, "text", 0)
+	treeView.AppendColumn(column)
+
+	treeView.SetModel(treeStore)
+	scrolledWindow.Add(treeView)
+	mainBox.PackStart(scrolledWindow, true, true, 0)
+
+	treeWindow.Add(mainBox)
+	treeWindow.ShowAll()
+}
+
+// showErrorReportWindow lists the entries the server rejected during a
+// continue-on-error load and lets the user export them as CSV
+func showErrorReportWindow(parent *gtk.Window, failed []loader.EntryError, total int) {
+	reportWindow, err := gtk.WindowNew(gtk.WINDOW_TOPLEVEL)
+	if err != nil {
+		log.Println("Error creating report window:", err)
+		return
+	}
+
+	reportWindow.SetTitle("Failed Entries")
+	reportWindow.SetDefaultSize(800, 500)
+	reportWindow.SetTransientFor(parent)
+	reportWindow.SetModal(true)
+
+	mainBox, err := gtk.BoxNew(gtk.ORIENTATION_VERTICAL, 5)
+	if err != nil {
+		log.Println("Error creating main box:", err)
+		reportWindow.Destroy()
+		return
+	}
+	mainBox.SetBorderWidth(5)
+
+	summaryLabel, err := gtk.LabelNew(fmt.Sprintf("%d of %d changes failed", len(failed), total))
+	if err != nil {
+		log.Println("Error creating summary label:", err)
+		reportWindow.Destroy()
+		return
+	}
+
+	buttonBox, err := gtk.BoxNew(gtk.ORIENTATION_HORIZONTAL, 5)
+	if err != nil {
+		log.Println("Error creating button box:", err)
+		reportWindow.Destroy()
+		return
+	}
+
+	exportBtn, err := gtk.ButtonNewWithLabel("Export to CSV")
+	if err != nil {
+		log.Println("Error creating export button:", err)
+		reportWindow.Destroy()
+		return
+	}
+	exportBtn.Connect("clicked", func() {
+		saveErrorReportCSV(parent, failed)
+	})
+
+	closeBtn, err := gtk.ButtonNewWithLabel("Close")
+	if err != nil {
+		log.Println("Error creating close button:", err)
+		reportWindow.Destroy()
+		return
+	}
+	closeBtn.Connect("clicked", func() {
+		reportWindow.Destroy()
+	})
+
+	buttonBox.PackStart(summaryLabel, false, false, 5)
+	buttonBox.PackEnd(closeBtn, false, false, 0)
+	buttonBox.PackEnd(exportBtn, false, false, 5)
+	mainBox.PackStart(buttonBox, false, false, 5)
+
+	scrolledWindow, err := gtk.ScrolledWindowNew(nil, nil)
+	if err != nil {
+		log.Println("Error creating scrolled window:", err)
+		reportWindow.Destroy()
+		return
+	}
+
+	listStore, err := gtk.ListStoreNew(glib.TYPE_STRING, glib.TYPE_STRING, glib.TYPE_STRING, glib.TYPE_STRING)
+	if err != nil {
+		log.Println("Error creating list store:", err)
+		reportWindow.Destroy()
+		return
+	}
+	for _, e := range failed {
+		iter := listStore.Append()
+		listStore.Set(iter, []int{0, 1, 2, 3}, []interface{}{
+			e.DN,
+			e.Op.String(),
+			fmt.Sprintf("%d (%s)", e.ResultCode, e.ResultName()),
+			e.Message,
+		})
+	}
+
+	treeView, err := gtk.TreeViewNewWithModel(listStore)
+	if err != nil {
+		log.Println("Error creating tree view:", err)
+		reportWindow.Destroy()
+		return
+	}
+
+	for i, title := range []string{"DN", "Operation", "Result", "Message"} {
+		renderer, err := gtk.CellRendererTextNew()
+		if err != nil {
+			log.Println("Error creating cell renderer:", err)
+			reportWindow.Destroy()
+			return
 		}
+		column, err := gtk.TreeViewColumnNewWithAttribute(title, renderer, "text", i)
+		if err != nil {
+			log.Println("Error creating column:", err)
+			reportWindow.Destroy()
+			return
+		}
+		column.SetResizable(true)
+		treeView.AppendColumn(column)
+	}
 
-		parts := strings.SplitN(line, ":", 2)
-		if len(parts) != 2 {
-			continue
+	scrolledWindow.Add(treeView)
+	mainBox.PackStart(scrolledWindow, true, true, 0)
+
+	reportWindow.Add(mainBox)
+	reportWindow.ShowAll()
+}
+
+// saveErrorReportCSV writes the failed entries to a CSV file
+func saveErrorReportCSV(parent *gtk.Window, failed []loader.EntryError) {
+	saveDialog, err := gtk.FileChooserDialogNewWith2Buttons(
+		"Save Report as CSV",
+		parent,
+		gtk.FILE_CHOOSER_ACTION_SAVE,
+		"Cancel",
+		gtk.RESPONSE_CANCEL,
+		"Save",
+		gtk.RESPONSE_ACCEPT,
+	)
+	if err != nil {
+		showErrorDialog(parent, "Error creating save dialog: "+err.Error())
+		return
+	}
+	defer saveDialog.Destroy()
+
+	filter, err := gtk.FileFilterNew()
+	if err != nil {
+		showErrorDialog(parent, "Error creating file filter: "+err.Error())
+		return
+	}
+	filter.SetName("CSV Files")
+	filter.AddPattern("*.csv")
+	saveDialog.AddFilter(filter)
+	saveDialog.SetCurrentName("failed-entries.csv")
+
+	if saveDialog.Run() != gtk.RESPONSE_ACCEPT {
+		return
+	}
+
+	filename := saveDialog.GetFilename()
+	if !strings.HasSuffix(filename, ".csv") {
+		filename += ".csv"
+	}
+
+	file, err := os.Create(filename)
+	if err != nil {
+		showErrorDialog(parent, "Error creating file: "+err.Error())
+		return
+	}
+	defer file.Close()
+
+	if err := loader.WriteErrorReportCSV(file, failed); err != nil {
+		showErrorDialog(parent, "Error writing to file: "+err.Error())
+		return
+	}
+
+	showInfoDialog(parent, fmt.Sprintf(
+		"Successfully exported %d failed entries to:\n%s",
+		len(failed),
+		filename,
+	))
+}
+
+// chooseBackupFile asks for a backup file, starting in the backup directory.
+// It returns "" if the user canceled.
+func chooseBackupFile(parent *gtk.Window) string {
+	fileChooser, err := gtk.FileChooserDialogNewWith2Buttons(
+		"Select Backup",
+		parent,
+		gtk.FILE_CHOOSER_ACTION_OPEN,
+		"Cancel",
+		gtk.RESPONSE_CANCEL,
+		"Open",
+		gtk.RESPONSE_ACCEPT,
+	)
+	if err != nil {
+		log.Println("Error creating file chooser:", err)
+		return ""
+	}
+	defer fileChooser.Destroy()
+
+	if dir, err := loader.BackupDir(); err == nil {
+		fileChooser.SetCurrentFolder(dir)
+	}
+
+	filter, err := gtk.FileFilterNew()
+	if err != nil {
+		log.Println("Error creating file filter:", err)
+		return ""
+	}
+	filter.SetName("LDIF Files")
+	filter.AddPattern("*.ldif")
+	fileChooser.AddFilter(filter)
+
+	if fileChooser.Run() != gtk.RESPONSE_ACCEPT {
+		return ""
+	}
+	return fileChooser.GetFilename()
+}
+
+// showPlanWindow lists the changes a load would make, with counts per
+// operation, and lets the user save them as an LDIF change file
+func showPlanWindow(parent *gtk.Window, changes []loader.Change) {
+	planWindow, err := gtk.WindowNew(gtk.WINDOW_TOPLEVEL)
+	if err != nil {
+		log.Println("Error creating preview window:", err)
+		return
+	}
+
+	planWindow.SetTitle("Planned Changes")
+	planWindow.SetDefaultSize(700, 500)
+	planWindow.SetTransientFor(parent)
+	planWindow.SetModal(true)
+
+	mainBox, err := gtk.BoxNew(gtk.ORIENTATION_VERTICAL, 5)
+	if err != nil {
+		log.Println("Error creating main box:", err)
+		planWindow.Destroy()
+		return
+	}
+	mainBox.SetBorderWidth(5)
+
+	counts := countChanges(changes)
+	summaryLabel, err := gtk.LabelNew(fmt.Sprintf(
+		"Deletes: %d    Modifies: %d    Adds: %d",
+		counts[loader.ChangeDelete], counts[loader.ChangeModify], counts[loader.ChangeAdd],
+	))
+	if err != nil {
+		log.Println("Error creating summary label:", err)
+		planWindow.Destroy()
+		return
+	}
+
+	buttonBox, err := gtk.BoxNew(gtk.ORIENTATION_HORIZONTAL, 5)
+	if err != nil {
+		log.Println("Error creating button box:", err)
+		planWindow.Destroy()
+		return
+	}
+
+	saveBtn, err := gtk.ButtonNewWithLabel("Save as LDIF")
+	if err != nil {
+		log.Println("Error creating save button:", err)
+		planWindow.Destroy()
+		return
+	}
+	saveBtn.Connect("clicked", func() {
+		savePlanToLDIF(parent, changes)
+	})
+
+	closeBtn, err := gtk.ButtonNewWithLabel("Close")
+	if err != nil {
+		log.Println("Error creating close button:", err)
+		planWindow.Destroy()
+		return
+	}
+	closeBtn.Connect("clicked", func() {
+		planWindow.Destroy()
+	})
+
+	buttonBox.PackStart(summaryLabel, false, false, 5)
+	buttonBox.PackEnd(closeBtn, false, false, 0)
+	buttonBox.PackEnd(saveBtn, false, false, 5)
+	mainBox.PackStart(buttonBox, false, false, 5)
+
+	scrolledWindow, err := gtk.ScrolledWindowNew(nil, nil)
+	if err != nil {
+		log.Println("Error creating scrolled window:", err)
+		planWindow.Destroy()
+		return
+	}
+
+	listStore, err := gtk.ListStoreNew(glib.TYPE_STRING, glib.TYPE_STRING, glib.TYPE_STRING)
+	if err != nil {
+		log.Println("Error creating list store:", err)
+		planWindow.Destroy()
+		return
+	}
+	for _, change := range changes {
+		iter := listStore.Append()
+		listStore.Set(iter, []int{0, 1, 2}, []interface{}{change.Op.String(), change.DN, describeChange(change)})
+	}
+
+	treeView, err := gtk.TreeViewNewWithModel(listStore)
+	if err != nil {
+		log.Println("Error creating tree view:", err)
+		planWindow.Destroy()
+		return
+	}
+
+	for i, title := range []string{"Operation", "DN", "Details"} {
+		renderer, err := gtk.CellRendererTextNew()
+		if err != nil {
+			log.Println("Error creating cell renderer:", err)
+			planWindow.Destroy()
+			return
+		}
+		column, err := gtk.TreeViewColumnNewWithAttribute(title, renderer, "text", i)
+		if err != nil {
+			log.Println("Error creating column:", err)
+			planWindow.Destroy()
+			return
 		}
+		column.SetResizable(true)
+		treeView.AppendColumn(column)
+	}
 
-		key := strings.TrimSpace(parts[0])
-		value := strings.TrimSpace(parts[1])
-
-		switch key {
-		case "dn":
-			currentEntry.DN = value
-			inEntry = true
-		case "objectclass":
-			currentEntry.ObjectClass = value
-		case "sn":
-			currentEntry.SN = value
-		case "cn":
-			currentEntry.CN = value
-		case "ou":
-			currentEntry.OU = value
-		case "title":
-			currentEntry.Title = value
-		case "mail":
-			currentEntry.Mail = value
-		case "givenName":
-			currentEntry.GivenName = value
-		case "initials":
-			currentEntry.Initials = value
-		case "telephoneNumber":
-			currentEntry.TelephoneNumber = value
-		case "l":
-			currentEntry.L = value
-		case "postalAddress":
-			currentEntry.PostalAddress = value
-		case "o":
-			currentEntry.O = value
+	scrolledWindow.Add(treeView)
+	mainBox.PackStart(scrolledWindow, true, true, 0)
+
+	planWindow.Add(mainBox)
+	planWindow.ShowAll()
+}
+
+// countChanges returns how many changes of each kind there are
+func countChanges(changes []loader.Change) map[loader.ChangeOp]int {
+	counts := make(map[loader.ChangeOp]int)
+	for _, change := range changes {
+		counts[change.Op]++
+	}
+	return counts
+}
+
+// describeChange summarizes a change in one line for the preview
+func describeChange(change loader.Change) string {
+	switch change.Op {
+	case loader.ChangeAdd:
+		return fmt.Sprintf("%d attributes", change.Attributes.Len())
+	case loader.ChangeModify:
+		parts := make([]string, 0, len(change.Modifications))
+		for _, mod := range change.Modifications {
+			parts = append(parts, mod.Op+" "+mod.Name)
 		}
+		return strings.Join(parts, "; ")
+	}
+	return ""
+}
+
+// savePlanToLDIF writes the planned changes as an LDIF change file
+func savePlanToLDIF(parent *gtk.Window, changes []loader.Change) {
+	saveDialog, err := gtk.FileChooserDialogNewWith2Buttons(
+		"Save Changes as LDIF",
+		parent,
+		gtk.FILE_CHOOSER_ACTION_SAVE,
+		"Cancel",
+		gtk.RESPONSE_CANCEL,
+		"Save",
+		gtk.RESPONSE_ACCEPT,
+	)
+	if err != nil {
+		showErrorDialog(parent, "Error creating save dialog: "+err.Error())
+		return
+	}
+	defer saveDialog.Destroy()
+
+	filter, err := gtk.FileFilterNew()
+	if err != nil {
+		showErrorDialog(parent, "Error creating file filter: "+err.Error())
+		return
 	}
+	filter.SetName("LDIF Files")
+	filter.AddPattern("*.ldif")
+	saveDialog.AddFilter(filter)
+	saveDialog.SetCurrentName("changes.ldif")
 
-	if inEntry {
-		entries = append(entries, currentEntry)
+	if saveDialog.Run() != gtk.RESPONSE_ACCEPT {
+		return
+	}
+
+	filename := saveDialog.GetFilename()
+	if !strings.HasSuffix(filename, ".ldif") {
+		filename += ".ldif"
+	}
+
+	file, err := os.Create(filename)
+	if err != nil {
+		showErrorDialog(parent, "Error creating file: "+err.Error())
+		return
+	}
+	defer file.Close()
+
+	writer := ldif.NewWriter(file)
+	for _, change := range changes {
+		if err := loader.WriteChange(writer, change); err != nil {
+			showErrorDialog(parent, "Error writing to file: "+err.Error())
+			return
+		}
 	}
-
-	if err := scanner.Err(); err != nil {
-		return nil, fmt.Errorf("error reading file: %v", err)
+	if err := writer.Flush(); err != nil {
+		showErrorDialog(parent, "Error writing to file: "+err.Error())
+		return
 	}
 
-	return entries, nil
+	showInfoDialog(parent, fmt.Sprintf(
+		"Successfully exported %d changes to:\n%s",
+		len(changes),
+		filename,
+	))
 }
 
-// OrgNode represents a node in the organizational tree
-type OrgNode struct {
-	Name     string
-	Children map[string]*OrgNode
-}
+// Helper function to populate tree store
+func populateTreeStore(store *gtk.TreeStore, parent *gtk.TreeIter, node *orgtree.Node) {
+	iter := store.Append(parent)
+	store.SetValue(iter, 0, node.Name)
 
-func buildOrgTree(entries []LDIFEntry) *OrgNode {
-	root := &OrgNode{
-		Name:     "Organization",
-		Children: make(map[string]*OrgNode),
+	for _, child := range node.Children {
+		populateTreeStore(store, iter, child)
 	}
+}
 
-	for _, entry := range entries {
-		str := entry.O
-		if str == "filial" || len(str) == 0 {
-			continue
-		}
+// unlockVault returns the password vault, asking for the passphrase the
+// first time in a session. It returns nil if the user canceled.
+func unlockVault(parent *gtk.Window) *Vault {
+	if vault != nil {
+		return vault
+	}
 
-		orgParts := strings.SplitN(entry.O, ",", 2)
-		orgName := strings.TrimSpace(orgParts[0])
-		var deptName string
-		if len(orgParts) > 1 {
-			deptName = strings.TrimSpace(orgParts[1])
+	exists := vaultExists()
+	message := "Enter the passphrase of the password vault:"
+	if !exists {
+		message = "Choose a passphrase for the new password vault:"
+	}
+	for {
+		passphrase, ok := showInputDialog(parent, message, "", true)
+		if !ok {
+			return nil
 		}
-
-		// Find or create organization node
-		orgNode, exists := root.Children[orgName]
 		if !exists {
-			orgNode = &OrgNode{
-				Name:     orgName,
-				Children: make(map[string]*OrgNode),
+			repeated, ok := showInputDialog(parent, "Repeat the passphrase:", "", true)
+			if !ok {
+				return nil
 			}
-			root.Children[orgName] = orgNode
-		}
-
-		// Handle department and OU
-		if deptName != "" {
-			// Organization has departments
-			deptNode, exists := orgNode.Children[deptName]
-			if !exists {
-				deptNode = &OrgNode{
-					Name:     deptName,
-					Children: make(map[string]*OrgNode),
-				}
-				orgNode.Children[deptName] = deptNode
+			if repeated != passphrase {
+				showErrorDialog(parent, "The passphrases do not match")
+				continue
 			}
+		}
 
-			// Add OU under department
-			if entry.OU != "" {
-				if _, exists := deptNode.Children[entry.OU]; !exists {
-					deptNode.Children[entry.OU] = &OrgNode{
-						Name:     entry.OU,
-						Children: make(map[string]*OrgNode),
-					}
-				}
-			}
-		} else {
-			// Organization has no departments, add OU directly under org
-			if entry.OU != "" {
-				if _, exists := orgNode.Children[entry.OU]; !exists {
-					orgNode.Children[entry.OU] = &OrgNode{
-						Name:     entry.OU,
-						Children: make(map[string]*OrgNode),
-					}
-				}
-			}
+		v, err := openVault(passphrase)
+		if err != nil {
+			showErrorDialog(parent, "Failed to unlock the password vault: "+err.Error())
+			continue
 		}
+		vault = v
+		return vault
 	}
-
-	return root
 }
 
-func showTreeWindow(parent *gtk.Window, root *OrgNode, entries []LDIFEntry, config LDAPConfig) {
+// bindPassword returns the password to bind with: the one typed in, else
+// the one passed in the environment, else the one stored in the vault for
+// the selected profile
+func bindPassword(parent *gtk.Window, profile string, cfg loader.Config) string {
+	if cfg.Password != "" || cfg.BindMechanism == loader.BindAnonymous || cfg.BindMechanism == loader.BindExternal {
+		return cfg.Password
+	}
 
-	// Create tree window
-	treeWindow, err := gtk.WindowNew(gtk.WINDOW_TOPLEVEL)
+	password, ok, err := passwordFromEnvironment()
 	if err != nil {
-		log.Println("Error creating tree window:", err)
-		return
+		log.Println("Error reading password from environment:", err)
+	}
+	if ok {
+		return password
 	}
 
-	treeWindow.SetTitle("Organizational Structure")
-	treeWindow.SetDefaultSize(500, 600)
-	treeWindow.SetTransientFor(parent)
-	treeWindow.SetModal(true)
+	if profile == "" || !vaultExists() {
+		return ""
+	}
+	if v := unlockVault(parent); v != nil {
+		password, _ = v.Get(profile)
+	}
+	return password
+}
 
-	// Create main container
-	mainBox, err := gtk.BoxNew(gtk.ORIENTATION_VERTICAL, 5)
+// showInputDialog asks for a line of text, prefilled with text. ok is false
+// if the user canceled.
+func showInputDialog(parent *gtk.Window, message, text string, secret bool) (string, bool) {
+	dialog, err := gtk.DialogNew()
 	if err != nil {
-		log.Println("Error creating main box:", err)
-		treeWindow.Destroy()
-		return
+		log.Println("Error creating input dialog:", err)
+		return "", false
 	}
+	defer dialog.Destroy()
 
-	// Create button box
-	buttonBox, err := gtk.BoxNew(gtk.ORIENTATION_HORIZONTAL, 5)
+	dialog.SetTransientFor(parent)
+	dialog.SetModal(true)
+	dialog.AddButton("Cancel", gtk.RESPONSE_CANCEL)
+	dialog.AddButton("OK", gtk.RESPONSE_OK)
+	dialog.SetDefaultResponse(gtk.RESPONSE_OK)
+
+	contentArea, err := dialog.GetContentArea()
 	if err != nil {
-		log.Println("Error creating button box:", err)
-		treeWindow.Destroy()
-		return
+		log.Println("Error getting content area:", err)
+		return "", false
 	}
 
-	// Create export button
-	exportBtn, err := gtk.ButtonNewWithLabel("Export to LDIF")
+	box, err := gtk.BoxNew(gtk.ORIENTATION_VERTICAL, 5)
 	if err != nil {
-		log.Println("Error creating export button:", err)
-		treeWindow.Destroy()
-		return
+		log.Println("Error creating box:", err)
+		return "", false
 	}
-	////////////////////////////////////////////////////////////////////
-	//	exportBtn.Connect("clicked", func() {
-	//		exportToLDIF(parent, entries, config.BaseDN)
-	//	})
+	box.SetBorderWidth(10)
 
-	// Create close button
-	closeBtn, err := gtk.ButtonNewWithLabel("Close")
+	label, err := gtk.LabelNew(message)
 	if err != nil {
-		log.Println("Error creating close button:", err)
-		treeWindow.Destroy()
-		return
+		log.Println("Error creating label:", err)
+		return "", false
 	}
-	closeBtn.Connect("clicked", func() {
-		treeWindow.Destroy()
-	})
+	entry, err := gtk.EntryNew()
+	if err != nil {
+		log.Println("Error creating entry:", err)
+		return "", false
+	}
+	entry.SetText(text)
+	entry.SetVisibility(!secret)
+	entry.SetActivatesDefault(true)
 
-	buttonBox.PackEnd(closeBtn, false, false, 0)
-	buttonBox.PackEnd(exportBtn, false, false, 5)
-	mainBox.PackStart(buttonBox, false, false, 5)
+	box.PackStart(label, false, false, 0)
+	box.PackStart(entry, false, false, 0)
+	contentArea.Add(box)
+	dialog.ShowAll()
 
-	// Create scrolled window
-	scrolledWindow, err := gtk.ScrolledWindowNew(nil, nil)
+	if dialog.Run() != gtk.RESPONSE_OK {
+		return "", false
+	}
+	value, err := entry.GetText()
 	if err != nil {
-		log.Println("Error creating scrolled window:", err)
-		treeWindow.Destroy()
-		return
+		return "", false
 	}
+	return value, true
+}
 
-	// Create tree view
-	treeView, err := gtk.TreeViewNew()
-	if err != nil {
-		log.Println("Error creating tree view:", err)
-		treeWindow.Destroy()
-		return
+// chooseProfilesFile asks for a profile file to import from or export to.
+// It returns "" if the user canceled.
+func chooseProfilesFile(parent *gtk.Window, action gtk.FileChooserAction) string {
+	title, button := "Import Profiles", "Open"
+	if action == gtk.FILE_CHOOSER_ACTION_SAVE {
+		title, button = "Export Profiles", "Save"
 	}
 
-	// Create tree store
-	treeStore, err := gtk.TreeStoreNew(glib.TYPE_STRING)
+	fileChooser, err := gtk.FileChooserDialogNewWith2Buttons(
+		title,
+		parent,
+		action,
+		"Cancel",
+		gtk.RESPONSE_CANCEL,
+		button,
+		gtk.RESPONSE_ACCEPT,
+	)
 	if err != nil {
-		log.Println("Error creating tree store:", err)
-		treeWindow.Destroy()
-		return
+		log.Println("Error creating file chooser:", err)
+		return ""
 	}
+	defer fileChooser.Destroy()
 
-	// Populate tree store
-	populateTreeStore(treeStore, nil, root)
+	if action == gtk.FILE_CHOOSER_ACTION_SAVE {
+		fileChooser.SetDoOverwriteConfirmation(true)
+		fileChooser.SetCurrentName("ldap-import-profiles.json")
+	}
 
-	// Create column
-	column, err := gtk.TreeViewColumnNew()
+	filter, err := gtk.FileFilterNew()
 	if err != nil {
-		log.Println("Error creating tree column:", err)
-		treeWindow.Destroy()
-		return
+		log.Println("Error creating file filter:", err)
+		return ""
 	}
+	filter.SetName("JSON Files")
+	filter.AddPattern("*.json")
+	fileChooser.AddFilter(filter)
 
-	column.SetTitle("Organizational Structure")
-
-	exportBtn.Connect("clicked", func() {
-		exportTreeToLDIF(parent, treeStore, root)
-	})
+	if fileChooser.Run() != gtk.RESPONSE_ACCEPT {
+		return ""
+	}
+	return fileChooser.GetFilename()
+}
 
-	renderer, err := gtk.CellRendererTextNew()
+// showTLSOptionsDialog edits the TLS settings of cfg: CA bundle, client
+// certificate and key, minimum TLS version and certificate verification
+func showTLSOptionsDialog(parent *gtk.Window, cfg *loader.Config) {
+	dialog, err := gtk.DialogNew()
 	if err != nil {
-		log.Println("Error creating cell renderer:", err)
-		treeWindow.Destroy()
+		log.Println("Error creating TLS options dialog:", err)
 		return
 	}
+	defer dialog.Destroy()
 
-	column.PackStart(renderer, true)
-	column.AddAttribute(renderer, "text", 0)
-	treeView.AppendColumn(column)
+	dialog.SetTitle("TLS Options")
+	dialog.SetTransientFor(parent)
+	dialog.SetModal(true)
+	dialog.AddButton("Cancel", gtk.RESPONSE_CANCEL)
+	dialog.AddButton("OK", gtk.RESPONSE_OK)
 
-	treeView.SetModel(treeStore)
-	scrolledWindow.Add(treeView)
-	mainBox.PackStart(scrolledWindow, true, true, 0)
+	contentArea, err := dialog.GetContentArea()
+	if err != nil {
+		log.Println("Error getting content area:", err)
+		return
+	}
 
-	treeWindow.Add(mainBox)
-	treeWindow.ShowAll()
-}
+	grid, err := gtk.GridNew()
+	if err != nil {
+		log.Println("Error creating grid:", err)
+		return
+	}
+	grid.SetBorderWidth(10)
+	grid.SetRowSpacing(5)
+	grid.SetColumnSpacing(5)
 
-// Helper function to populate tree store
-func populateTreeStore(store *gtk.TreeStore, parent *gtk.TreeIter, node *OrgNode) {
-	iter := store.Append(parent)
-	store.SetValue(iter, 0, node.Name)
+	files := []struct {
+		label string
+		value string
+		entry *gtk.Entry
+	}{
+		{label: "CA Bundle:", value: cfg.CAFile},
+		{label: "Client Certificate:", value: cfg.CertFile},
+		{label: "Client Key:", value: cfg.KeyFile},
+	}
+	for i := range files {
+		label, err := gtk.LabelNew(files[i].label)
+		if err != nil {
+			log.Println("Error creating label:", err)
+			return
+		}
+		entry, err := gtk.EntryNew()
+		if err != nil {
+			log.Println("Error creating entry:", err)
+			return
+		}
+		entry.SetText(files[i].value)
+		entry.SetPlaceholderText("PEM file")
+		browseBtn, err := gtk.ButtonNewWithLabel("Browse")
+		if err != nil {
+			log.Println("Error creating browse button:", err)
+			return
+		}
+		title := strings.TrimSuffix(files[i].label, ":")
+		browseBtn.Connect("clicked", func() {
+			if filename := choosePEMFile(parent, title); filename != "" {
+				entry.SetText(filename)
+			}
+		})
+		files[i].entry = entry
 
-	for _, child := range node.Children {
-		populateTreeStore(store, iter, child)
+		grid.Attach(label, 0, i, 1, 1)
+		grid.Attach(entry, 1, i, 1, 1)
+		grid.Attach(browseBtn, 2, i, 1, 1)
 	}
-}
 
-func deleteOldEntries(config LDAPConfig, targetOU string, progress *ProgressDialog) error {
-	conn, err := ldap.Dial("tcp", fmt.Sprintf("%s:%s", config.Host, config.Port))
+	versionLabel, err := gtk.LabelNew("Minimum TLS Version:")
 	if err != nil {
-		return fmt.Errorf("failed to connect to LDAP server: %v", err)
+		log.Println("Error creating label:", err)
+		return
 	}
-	defer conn.Close()
-
-	err = conn.Bind(config.BindDN, config.Password)
+	versionCombo, err := gtk.ComboBoxTextNew()
 	if err != nil {
-		return fmt.Errorf("failed to bind to LDAP server: %v", err)
+		log.Println("Error creating combo box:", err)
+		return
 	}
+	for _, version := range []string{"1.0", "1.1", "1.2", "1.3"} {
+		versionCombo.Append(version, "TLS "+version)
+	}
+	if cfg.MinTLSVersion != "" {
+		versionCombo.SetActiveID(cfg.MinTLSVersion)
+	} else {
+		versionCombo.SetActiveID("1.2")
+	}
+	grid.Attach(versionLabel, 0, 3, 1, 1)
+	grid.Attach(versionCombo, 1, 3, 1, 1)
 
-	searchRequest := ldap.NewSearchRequest(
-		"ou="+targetOU+",ou=abook,"+config.BaseDN,
-		ldap.ScopeSingleLevel, ldap.NeverDerefAliases, 0, 0, false,
-		"(objectClass=inetOrgPerson)",
-		[]string{"dn"},
-		nil,
-	)
-
-	result, err := conn.Search(searchRequest)
+	skipVerifyCheck, err := gtk.CheckButtonNewWithLabel("Skip server certificate verification (insecure)")
 	if err != nil {
-		return fmt.Errorf("failed to search entries: %v", err)
+		log.Println("Error creating check button:", err)
+		return
 	}
-
-	total := len(result.Entries)
-	for i, entry := range result.Entries {
-		if progress.IsCanceled() {
-			return fmt.Errorf("operation canceled by user")
-		}
-
-		delRequest := ldap.NewDelRequest(entry.DN, nil)
-		if err := conn.Del(delRequest); err != nil {
-			return fmt.Errorf("failed to delete entry %s: %v", entry.DN, err)
+	skipVerifyCheck.SetActive(cfg.InsecureSkipVerify)
+	skipVerifyCheck.Connect("toggled", func() {
+		if skipVerifyCheck.GetActive() {
+			showWarningDialog(parent, "The server certificate will not be checked. Anyone able to intercept "+
+				"the connection can pose as the server and read the bind password.\n\n"+
+				"Use this only for testing.")
 		}
+	})
+	grid.Attach(skipVerifyCheck, 0, 4, 3, 1)
 
-		len := float64(i+1) / float64(total)
+	contentArea.Add(grid)
+	dialog.ShowAll()
 
-		glib.IdleAdd(func() {
-			progress.Progress.SetFraction(len)
-			progress.Label.SetText(fmt.Sprintf("Deleting entries... %d/%d", i+1, total))
-		})
+	if dialog.Run() != gtk.RESPONSE_OK {
+		return
 	}
 
-	return nil
+	cfg.CAFile, _ = files[0].entry.GetText()
+	cfg.CertFile, _ = files[1].entry.GetText()
+	cfg.KeyFile, _ = files[2].entry.GetText()
+	cfg.MinTLSVersion = versionCombo.GetActiveID()
+	cfg.InsecureSkipVerify = skipVerifyCheck.GetActive()
 }
 
-func addNewEntries(config LDAPConfig, targetOU string, entries []LDIFEntry, progress *ProgressDialog) error {
-	conn, err := ldap.Dial("tcp", fmt.Sprintf("%s:%s", config.Host, config.Port))
+// choosePEMFile asks for a certificate or key file. It returns "" if the
+// user canceled.
+func choosePEMFile(parent *gtk.Window, title string) string {
+	fileChooser, err := gtk.FileChooserDialogNewWith2Buttons(
+		title,
+		parent,
+		gtk.FILE_CHOOSER_ACTION_OPEN,
+		"Cancel",
+		gtk.RESPONSE_CANCEL,
+		"Open",
+		gtk.RESPONSE_ACCEPT,
+	)
 	if err != nil {
-		return fmt.Errorf("failed to connect to LDAP server: %v", err)
+		log.Println("Error creating file chooser:", err)
+		return ""
 	}
-	defer conn.Close()
+	defer fileChooser.Destroy()
 
-	err = conn.Bind(config.BindDN, config.Password)
+	filter, err := gtk.FileFilterNew()
 	if err != nil {
-		return fmt.Errorf("failed to bind to LDAP server: %v", err)
+		log.Println("Error creating file filter:", err)
+		return ""
 	}
+	filter.SetName("PEM Files")
+	filter.AddPattern("*.pem")
+	filter.AddPattern("*.crt")
+	filter.AddPattern("*.key")
+	fileChooser.AddFilter(filter)
 
-	total := len(entries)
-	for i, entry := range entries {
-		if progress.IsCanceled() {
-			return fmt.Errorf("operation canceled by user")
-		}
-
-		dn := fmt.Sprintf("cn=%s,ou=%s,ou=abook,%s", entry.CN, targetOU, config.BaseDN)
-		addRequest := ldap.NewAddRequest(dn, nil)
-
-		addRequest.Attribute("objectClass", []string{"inetOrgPerson"})
-		addRequest.Attribute("sn", []string{entry.SN})
-		addRequest.Attribute("cn", []string{entry.CN})
-		addRequest.Attribute("ou", []string{entry.OU})
-		if entry.Title != "" {
-			addRequest.Attribute("title", []string{entry.Title})
-		}
-		if entry.Mail != "" {
-			addRequest.Attribute("mail", []string{entry.Mail})
-		}
-		if entry.GivenName != "" {
-			addRequest.Attribute("givenName", []string{entry.GivenName})
-		}
-		if entry.Initials != "" {
-			addRequest.Attribute("initials", []string{entry.Initials})
-		}
-		if entry.TelephoneNumber != "" {
-			addRequest.Attribute("telephoneNumber", []string{entry.TelephoneNumber})
-		}
-		if entry.L != "" {
-			addRequest.Attribute("l", []string{entry.L})
-		}
-		if entry.PostalAddress != "" {
-			addRequest.Attribute("postalAddress", []string{entry.PostalAddress})
-		}
-		if entry.O != "" {
-			addRequest.Attribute("o", []string{entry.O})
-		}
-
-		if err := conn.Add(addRequest); err != nil {
-			return fmt.Errorf("failed to add entry %s: %v", dn, err)
-		}
-
-		progressVal := float64(i+1) / float64(total)
-		glib.IdleAdd(func() {
-			progress.Progress.SetFraction(progressVal)
-			progress.Label.SetText(fmt.Sprintf("Adding entries... %d/%d", i+1, total))
-		})
+	filter2, err := gtk.FileFilterNew()
+	if err != nil {
+		log.Println("Error creating file filter:", err)
+		return ""
 	}
+	filter2.SetName("All Files")
+	filter2.AddPattern("*")
+	fileChooser.AddFilter(filter2)
 
-	return nil
+	if fileChooser.Run() != gtk.RESPONSE_ACCEPT {
+		return ""
+	}
+	return fileChooser.GetFilename()
 }
 
 func createProgressDialog(parent *gtk.Window, title, initialMessage string) *ProgressDialog {
@@ -858,13 +1868,11 @@ func createProgressDialog(parent *gtk.Window, title, initialMessage string) *Pro
 		Progress:  progressBar,
 		Label:     label,
 		CancelBtn: cancelBtn,
-		Canceled:  false,
 	}
+	pd.Context, pd.cancel = context.WithCancel(context.Background())
 
 	cancelBtn.Connect("clicked", func() {
-		pd.Mutex.Lock()
-		pd.Canceled = true
-		pd.Mutex.Unlock()
+		pd.cancel()
 	})
 
 	dialog.ShowAll()
@@ -878,10 +1886,42 @@ func (pd *ProgressDialog) SetLabel(text string) {
 	})
 }
 
-func (pd *ProgressDialog) IsCanceled() bool {
-	pd.Mutex.Lock()
-	defer pd.Mutex.Unlock()
-	return pd.Canceled
+// SetFraction updates the progress bar and its label
+func (pd *ProgressDialog) SetFraction(fraction float64, text string) {
+	glib.IdleAdd(func() {
+		pd.Progress.SetFraction(fraction)
+		pd.Label.SetText(text)
+	})
+}
+
+// Close cancels whatever is still running and closes the dialog
+func (pd *ProgressDialog) Close() {
+	pd.cancel()
+	glib.IdleAdd(func() {
+		pd.Window.Destroy()
+	})
+}
+
+// Report shows a progress report from the loader
+func (pd *ProgressDialog) Report(p loader.Progress) {
+	if p.Total == 0 {
+		pd.SetLabel(p.String())
+		return
+	}
+	pd.SetFraction(p.Fraction(), p.String())
+}
+
+// ShowRetry tells the user that an operation failed and is tried again
+func (pd *ProgressDialog) ShowRetry(attempt, retries int, delay time.Duration, err error) {
+	pd.SetLabel(fmt.Sprintf("%v\nRetrying in %s (attempt %d of %d)...", err, delay, attempt, retries))
+}
+
+// capitalize turns an error message into a sentence for a dialog
+func capitalize(message string) string {
+	if message == "" {
+		return message
+	}
+	return strings.ToUpper(message[:1]) + message[1:]
 }
 
 func showErrorDialog(parent *gtk.Window, message string) {
@@ -908,7 +1948,34 @@ func showInfoDialog(parent *gtk.Window, message string) {
 	dialog.Destroy()
 }
 
-func exportTreeToLDIF(parent *gtk.Window, treeStore *gtk.TreeStore, node *OrgNode) {
+func showWarningDialog(parent *gtk.Window, message string) {
+	dialog := gtk.MessageDialogNew(
+		parent,
+		gtk.DIALOG_MODAL,
+		gtk.MESSAGE_WARNING,
+		gtk.BUTTONS_OK,
+		message,
+	)
+	dialog.Run()
+	dialog.Destroy()
+}
+
+// showConfirmDialog asks a yes/no question and reports whether the user
+// answered yes
+func showConfirmDialog(parent *gtk.Window, message string) bool {
+	dialog := gtk.MessageDialogNew(
+		parent,
+		gtk.DIALOG_MODAL,
+		gtk.MESSAGE_QUESTION,
+		gtk.BUTTONS_YES_NO,
+		message,
+	)
+	response := dialog.Run()
+	dialog.Destroy()
+	return response == gtk.RESPONSE_YES
+}
+
+func exportTreeToLDIF(parent *gtk.Window, treeStore *gtk.TreeStore, node *orgtree.Node) {
 	// Create save file dialog
 	saveDialog, err := gtk.FileChooserDialogNewWith2Buttons(
 		"Save as LDIF",
@@ -1021,7 +2088,7 @@ func exportTreeToLDIF(parent *gtk.Window, treeStore *gtk.TreeStore, node *OrgNod
 	// ))
 }
 
-func exportToLDIF(parent *gtk.Window, entries []LDIFEntry, baseDN string) {
+func exportToLDIF(parent *gtk.Window, entries []ldif.Entry) {
 	// Create save file dialog
 	saveDialog, err := gtk.FileChooserDialogNewWith2Buttons(
 		"Save as LDIF",
@@ -1068,45 +2135,16 @@ func exportToLDIF(parent *gtk.Window, entries []LDIFEntry, baseDN string) {
 	defer file.Close()
 
 	// Generate LDIF content
-	var buf bytes.Buffer
+	writer := ldif.NewWriter(file)
 	for _, entry := range entries {
-		buf.WriteString(fmt.Sprintf("dn: cn=%s,%s\n", entry.DN, baseDN))
-		buf.WriteString("objectClass: inetOrgPerson\n")
-		buf.WriteString(fmt.Sprintf("cn: %s\n", entry.CN))
-		buf.WriteString(fmt.Sprintf("sn: %s\n", entry.SN))
-
-		if entry.OU != "" {
-			buf.WriteString(fmt.Sprintf("ou: %s\n", entry.OU))
-		}
-		if entry.Title != "" {
-			buf.WriteString(fmt.Sprintf("title: %s\n", entry.Title))
-		}
-		if entry.Mail != "" {
-			buf.WriteString(fmt.Sprintf("mail: %s\n", entry.Mail))
-		}
-		if entry.GivenName != "" {
-			buf.WriteString(fmt.Sprintf("givenName: %s\n", entry.GivenName))
-		}
-		if entry.Initials != "" {
-			buf.WriteString(fmt.Sprintf("initials: %s\n", entry.Initials))
-		}
-		if entry.TelephoneNumber != "" {
-			buf.WriteString(fmt.Sprintf("telephoneNumber: %s\n", entry.TelephoneNumber))
-		}
-		if entry.L != "" {
-			buf.WriteString(fmt.Sprintf("l: %s\n", entry.L))
-		}
-		if entry.PostalAddress != "" {
-			buf.WriteString(fmt.Sprintf("postalAddress: %s\n", entry.PostalAddress))
-		}
-		if entry.O != "" {
-			buf.WriteString(fmt.Sprintf("o: %s\n", entry.O))
+		if err := writer.WriteEntry(entry.DN, entry.Attributes); err != nil {
+			showErrorDialog(parent, "Error writing to file: "+err.Error())
+			return
 		}
-		buf.WriteString("\n")
 	}
 
 	// Write to file
-	if _, err := file.Write(buf.Bytes()); err != nil {
+	if err := writer.Flush(); err != nil {
 		showErrorDialog(parent, "Error writing to file: "+err.Error())
 		return
 	}
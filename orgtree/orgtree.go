@@ -0,0 +1,107 @@
+// Package orgtree builds the organizational structure an address book
+// describes.
+package orgtree
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/imax1000/ldap-import/ldif"
+)
+
+// Node is a node in the organizational tree
+type Node struct {
+	Name     string
+	Children map[string]*Node
+}
+
+// Build builds the tree of organizations, departments and OUs from the o
+// and ou attributes of entries. An "o" of "Org, Department" puts the OU
+// under a department of the organization.
+func Build(entries []ldif.Entry) *Node {
+	root := &Node{
+		Name:     "Organization",
+		Children: make(map[string]*Node),
+	}
+
+	for _, entry := range entries {
+		str := entry.Attributes.First("o")
+		if str == "filial" || len(str) == 0 {
+			continue
+		}
+		ou := entry.Attributes.First("ou")
+
+		orgParts := strings.SplitN(str, ",", 2)
+		orgName := strings.TrimSpace(orgParts[0])
+		var deptName string
+		if len(orgParts) > 1 {
+			deptName = strings.TrimSpace(orgParts[1])
+		}
+
+		// Find or create organization node
+		orgNode, exists := root.Children[orgName]
+		if !exists {
+			orgNode = &Node{
+				Name:     orgName,
+				Children: make(map[string]*Node),
+			}
+			root.Children[orgName] = orgNode
+		}
+
+		// Handle department and OU
+		if deptName != "" {
+			// Organization has departments
+			deptNode, exists := orgNode.Children[deptName]
+			if !exists {
+				deptNode = &Node{
+					Name:     deptName,
+					Children: make(map[string]*Node),
+				}
+				orgNode.Children[deptName] = deptNode
+			}
+
+			// Add OU under department
+			if ou != "" {
+				if _, exists := deptNode.Children[ou]; !exists {
+					deptNode.Children[ou] = &Node{
+						Name:     ou,
+						Children: make(map[string]*Node),
+					}
+				}
+			}
+		} else {
+			// Organization has no departments, add OU directly under org
+			if ou != "" {
+				if _, exists := orgNode.Children[ou]; !exists {
+					orgNode.Children[ou] = &Node{
+						Name:     ou,
+						Children: make(map[string]*Node),
+					}
+				}
+			}
+		}
+	}
+
+	return root
+}
+
+// Print writes the tree one node per line, children sorted by name and
+// indented under their parent
+func Print(w io.Writer, root *Node) {
+	printNode(w, root, 0)
+}
+
+func printNode(w io.Writer, node *Node, depth int) {
+	fmt.Fprintf(w, "%s%s\n", strings.Repeat("  ", depth), node.Name)
+
+	names := make([]string, 0, len(node.Children))
+	for name := range node.Children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		printNode(w, node.Children[name], depth+1)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/imax1000/ldap-import/loader"
+)
+
+// Profile is a saved set of connection settings. The password is never
+// part of a profile.
+type Profile struct {
+	Name               string `json:"name"`
+	Host               string `json:"host"`
+	Port               string `json:"port,omitempty"`
+	BindMechanism      string `json:"bind_mechanism,omitempty"`
+	BindDN             string `json:"bind_dn,omitempty"`
+	BaseDN             string `json:"base_dn"`
+	AbookOU            string `json:"abook_ou,omitempty"`
+	TargetOU           string `json:"target_ou,omitempty"`
+	Security           string `json:"security,omitempty"`
+	CAFile             string `json:"ca_file,omitempty"`
+	CertFile           string `json:"cert_file,omitempty"`
+	KeyFile            string `json:"key_file,omitempty"`
+	MinTLSVersion      string `json:"min_tls_version,omitempty"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify,omitempty"`
+}
+
+type profileFile struct {
+	Profiles []Profile `json:"profiles"`
+}
+
+// newProfile takes the profile settings from config
+func newProfile(name string, config loader.Config, targetOU string) Profile {
+	return Profile{
+		Name:               name,
+		Host:               config.Host,
+		Port:               config.Port,
+		BindMechanism:      config.BindMechanism,
+		BindDN:             config.BindDN,
+		BaseDN:             config.BaseDN,
+		AbookOU:            config.AbookOU,
+		TargetOU:           targetOU,
+		Security:           config.Security,
+		CAFile:             config.CAFile,
+		CertFile:           config.CertFile,
+		KeyFile:            config.KeyFile,
+		MinTLSVersion:      config.MinTLSVersion,
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}
+}
+
+// Apply copies the profile settings into config. Settings that are not
+// part of a profile are kept.
+func (p Profile) Apply(config *loader.Config) {
+	config.Host = p.Host
+	config.Port = p.Port
+	config.BindMechanism = p.BindMechanism
+	config.BindDN = p.BindDN
+	config.BaseDN = p.BaseDN
+	config.AbookOU = p.AbookOU
+	config.Security = p.Security
+	config.CAFile = p.CAFile
+	config.CertFile = p.CertFile
+	config.KeyFile = p.KeyFile
+	config.MinTLSVersion = p.MinTLSVersion
+	config.InsecureSkipVerify = p.InsecureSkipVerify
+}
+
+// profilesPath returns the file profiles are kept in. It follows the XDG
+// base directory spec.
+func profilesPath() (string, error) {
+	configHome := os.Getenv("XDG_CONFIG_HOME")
+	if configHome == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		configHome = filepath.Join(home, ".config")
+	}
+	return filepath.Join(configHome, "ldap-import", "profiles.json"), nil
+}
+
+// loadProfiles returns the saved profiles, or none if nothing was saved yet
+func loadProfiles() ([]Profile, error) {
+	filename, err := profilesPath()
+	if err != nil {
+		return nil, err
+	}
+
+	profiles, err := readProfilesFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return profiles, err
+}
+
+// saveProfiles replaces the saved profiles
+func saveProfiles(profiles []Profile) error {
+	filename, err := profilesPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0o700); err != nil {
+		return fmt.Errorf("failed to create config directory: %v", err)
+	}
+	return writeProfilesFile(filename, profiles)
+}
+
+// readProfilesFile reads profiles from a file written by writeProfilesFile
+func readProfilesFile(filename string) ([]Profile, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var file profileFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid profile file %s: %v", filename, err)
+	}
+	for i, p := range file.Profiles {
+		if strings.TrimSpace(p.Name) == "" {
+			return nil, fmt.Errorf("invalid profile file %s: profile %d has no name", filename, i+1)
+		}
+	}
+	return file.Profiles, nil
+}
+
+// writeProfilesFile writes profiles sorted by name. The file is replaced
+// in one step, so that a failed write does not lose the old profiles.
+func writeProfilesFile(filename string, profiles []Profile) error {
+	sorted := append([]Profile(nil), profiles...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return strings.ToLower(sorted[i].Name) < strings.ToLower(sorted[j].Name)
+	})
+
+	data, err := json.MarshalIndent(profileFile{Profiles: sorted}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(filename), ".profiles-*.json")
+	if err != nil {
+		return fmt.Errorf("failed to write profiles: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write profiles: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write profiles: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), filename); err != nil {
+		return fmt.Errorf("failed to write profiles: %v", err)
+	}
+	return nil
+}
+
+// mergeProfiles adds the imported profiles to profiles. An imported
+// profile replaces an existing one with the same name.
+func mergeProfiles(profiles, imported []Profile) []Profile {
+	merged := append([]Profile(nil), profiles...)
+	for _, p := range imported {
+		if i := findProfile(merged, p.Name); i >= 0 {
+			merged[i] = p
+		} else {
+			merged = append(merged, p)
+		}
+	}
+	return merged
+}
+
+// findProfile returns the index of the profile with the given name, or -1
+func findProfile(profiles []Profile, name string) int {
+	for i, p := range profiles {
+		if p.Name == name {
+			return i
+		}
+	}
+	return -1
+}
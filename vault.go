@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// Environment variables for passing the bind password in headless runs
+const (
+	passwordEnv   = "LDAP_IMPORT_PASSWORD"
+	passwordFdEnv = "LDAP_IMPORT_PASSWORD_FD"
+)
+
+// scrypt parameters for new vaults
+const (
+	vaultScryptN = 1 << 15
+	vaultScryptR = 8
+	vaultScryptP = 1
+)
+
+// Ceilings on the scrypt parameters read from a vault file, so that a
+// tampered file cannot make unlocking take unbounded memory or time
+const (
+	vaultMaxScryptN = 1 << 20
+	vaultMaxScryptR = 32
+	vaultMaxScryptP = 16
+)
+
+// vaultVersion is the format of new vaults. Version 2 authenticates the
+// header together with the passwords; version 1 vaults are still read and
+// are written as version 2 the next time they are saved.
+const vaultVersion = 2
+
+// Vault keeps bind passwords per profile in a file encrypted with AES-GCM
+// under a key derived from a master passphrase with scrypt
+type Vault struct {
+	path      string
+	key       []byte
+	file      vaultFile
+	passwords map[string]string
+}
+
+// vaultFile is the vault as stored on disk. Data holds the passwords,
+// encrypted, so that not even the profile names can be read without the
+// passphrase.
+type vaultFile struct {
+	Version int    `json:"version"`
+	KDF     string `json:"kdf"`
+	Salt    []byte `json:"salt"`
+	N       int    `json:"n"`
+	R       int    `json:"r"`
+	P       int    `json:"p"`
+	Nonce   []byte `json:"nonce"`
+	Data    []byte `json:"data"`
+}
+
+// header returns the fields the key is derived from, which are
+// authenticated as additional data so that they cannot be swapped
+// unnoticed. Version 1 vaults authenticate none.
+func (f vaultFile) header() []byte {
+	if f.Version == 1 {
+		return nil
+	}
+	return fmt.Appendf(nil, "ldap-import vault %d %s n=%d r=%d p=%d salt=%x", f.Version, f.KDF, f.N, f.R, f.P, f.Salt)
+}
+
+// vaultPath returns the vault file, next to the profiles
+func vaultPath() (string, error) {
+	profiles, err := profilesPath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(profiles), "vault.json"), nil
+}
+
+// vaultExists reports whether a vault has been created
+func vaultExists() bool {
+	filename, err := vaultPath()
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(filename)
+	return err == nil
+}
+
+// openVault unlocks the vault with passphrase, creating an empty one if
+// there is none yet
+func openVault(passphrase string) (*Vault, error) {
+	if passphrase == "" {
+		return nil, errors.New("the vault passphrase is empty")
+	}
+
+	filename, err := vaultPath()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+		v := &Vault{
+			path:      filename,
+			file:      vaultFile{Version: vaultVersion, KDF: "scrypt", Salt: salt, N: vaultScryptN, R: vaultScryptR, P: vaultScryptP},
+			passwords: make(map[string]string),
+		}
+		if v.key, err = scrypt.Key([]byte(passphrase), salt, v.file.N, v.file.R, v.file.P, 32); err != nil {
+			return nil, err
+		}
+		return v, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read vault: %v", err)
+	}
+
+	v := &Vault{path: filename}
+	if err := json.Unmarshal(data, &v.file); err != nil {
+		return nil, fmt.Errorf("invalid vault %s: %v", filename, err)
+	}
+	if (v.file.Version != 1 && v.file.Version != vaultVersion) || v.file.KDF != "scrypt" {
+		return nil, fmt.Errorf("unsupported vault format in %s", filename)
+	}
+	if v.file.N > vaultMaxScryptN || v.file.R > vaultMaxScryptR || v.file.P > vaultMaxScryptP {
+		return nil, fmt.Errorf("invalid vault %s: scrypt parameters N=%d r=%d p=%d exceed the limits", filename, v.file.N, v.file.R, v.file.P)
+	}
+
+	v.key, err = scrypt.Key([]byte(passphrase), v.file.Salt, v.file.N, v.file.R, v.file.P, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid vault %s: %v", filename, err)
+	}
+	gcm, err := v.cipher()
+	if err != nil {
+		return nil, err
+	}
+	plain, err := gcm.Open(nil, v.file.Nonce, v.file.Data, v.file.header())
+	if err != nil {
+		return nil, errors.New("wrong passphrase, or the vault is damaged")
+	}
+	if err := json.Unmarshal(plain, &v.passwords); err != nil {
+		return nil, fmt.Errorf("invalid vault %s: %v", filename, err)
+	}
+	return v, nil
+}
+
+// Get returns the password stored for a profile
+func (v *Vault) Get(profile string) (string, bool) {
+	password, ok := v.passwords[profile]
+	return password, ok
+}
+
+// Set stores the password for a profile and saves the vault
+func (v *Vault) Set(profile, password string) error {
+	v.passwords[profile] = password
+	return v.save()
+}
+
+// Delete removes the password of a profile and saves the vault
+func (v *Vault) Delete(profile string) error {
+	if _, ok := v.passwords[profile]; !ok {
+		return nil
+	}
+	delete(v.passwords, profile)
+	return v.save()
+}
+
+func (v *Vault) cipher() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(v.key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// save encrypts the passwords with a fresh nonce and replaces the file
+func (v *Vault) save() error {
+	gcm, err := v.cipher()
+	if err != nil {
+		return err
+	}
+	plain, err := json.Marshal(v.passwords)
+	if err != nil {
+		return err
+	}
+
+	file := v.file
+	file.Version = vaultVersion
+	file.Nonce = make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(file.Nonce); err != nil {
+		return err
+	}
+	file.Data = gcm.Seal(nil, file.Nonce, plain, file.header())
+
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(v.path), 0o700); err != nil {
+		return fmt.Errorf("failed to create config directory: %v", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(v.path), ".vault-*.json")
+	if err != nil {
+		return fmt.Errorf("failed to write vault: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write vault: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write vault: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), v.path); err != nil {
+		return fmt.Errorf("failed to write vault: %v", err)
+	}
+
+	v.file = file
+	return nil
+}
+
+// The password from the environment is read once, since a file descriptor
+// can only be read from once
+var (
+	envPasswordOnce sync.Once
+	envPassword     string
+	envPasswordOK   bool
+	envPasswordErr  error
+)
+
+// passwordFromEnvironment returns the bind password passed in the
+// environment, either directly or as the number of a file descriptor to
+// read the first line from. ok is false if neither is set.
+func passwordFromEnvironment() (password string, ok bool, err error) {
+	envPasswordOnce.Do(func() {
+		envPassword, envPasswordOK, envPasswordErr = readPasswordFromEnvironment()
+	})
+	return envPassword, envPasswordOK, envPasswordErr
+}
+
+func readPasswordFromEnvironment() (string, bool, error) {
+	if fdText := os.Getenv(passwordFdEnv); fdText != "" {
+		fd, err := strconv.Atoi(fdText)
+		if err != nil || fd < 0 {
+			return "", false, fmt.Errorf("%s is not a file descriptor: %q", passwordFdEnv, fdText)
+		}
+
+		file := os.NewFile(uintptr(fd), "password")
+		if file == nil {
+			return "", false, fmt.Errorf("file descriptor %d is not open", fd)
+		}
+		defer file.Close()
+
+		line, err := bufio.NewReader(file).ReadString('\n')
+		if err != nil && line == "" {
+			return "", false, fmt.Errorf("failed to read password from file descriptor %d: %v", fd, err)
+		}
+		return strings.TrimRight(line, "\r\n"), true, nil
+	}
+
+	if password, ok := os.LookupEnv(passwordEnv); ok {
+		return password, true, nil
+	}
+	return "", false, nil
+}